@@ -7,6 +7,7 @@ import (
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
 )
 
 type mockJobClient struct {
@@ -51,6 +52,15 @@ func (m *mockJobClient) listFinishedJobs(since time.Time) (*jobsResp, error) {
 	return nil, args.Error(1)
 }
 
+func (m *mockJobClient) fetchSparkStages(id string) ([]sparkStage, error) {
+	args := m.Called(id)
+	returnVal := args.Get(0)
+	if returnVal != nil {
+		return args.Get(0).([]sparkStage), args.Error(1)
+	}
+	return nil, args.Error(1)
+}
+
 func (m *mockJobClient) updateJob(job *job) error {
 	return nil
 }
@@ -82,13 +92,16 @@ func TestGetNonExistentJob(t *testing.T) {
 
 func TestGetJobFromMemory(t *testing.T) {
 	var id = "job_from_memory"
-	var job = &job{}
+	var job = &job{Details: jobDetail{ID: id}}
 	var jt = setJobTracker(new(mockJobClient))
-	jt.jobs[jobID(id)] = job
+	jt.saveJob(job)
 
 	res := getJob(id)
 
-	assert.Equal(t, res, job)
+	require.NotNil(t, res)
+	assert.Equal(t, job.Details, res.Details)
+	assert.Equal(t, "foo", res.Cluster)
+	assert.Empty(t, job.Cluster, "stored jobs shouldn't be changed")
 }
 
 func TestGetJobFromS3(t *testing.T) {
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"strings"
+	"time"
+)
+
+// YARN application types with framework-specific enrichers.
+const (
+	appTypeMapReduce = "MAPREDUCE"
+	appTypeSpark     = "SPARK"
+	appTypeTez       = "TEZ"
+)
+
+// appEnricher fills in the framework-specific details of a running
+// application on top of what the resource manager reports for it. Jobs of
+// unknown application types only get the resource manager's details.
+type appEnricher interface {
+	enrich(client RecentJobClient, job *job) error
+}
+
+var appEnrichers = map[string]appEnricher{
+	appTypeMapReduce: mapReduceEnricher{},
+	appTypeSpark:     sparkEnricher{},
+	appTypeTez:       tezEnricher{},
+}
+
+// isMapReduce reports whether a job is a MapReduce job. The history server
+// doesn't report an application type, and it only knows about MapReduce
+// jobs.
+func (j *job) isMapReduce() bool {
+	return j.Details.Type == "" || j.Details.Type == appTypeMapReduce
+}
+
+// keepEnrichment fills in the framework-specific details of a job from prev,
+// the last version of it that was enriched, and keeps what the resource
+// manager reported for it.
+func (j *job) keepEnrichment(prev *job) {
+	listed := j.Details
+	j.Details = prev.Details
+	j.Details.ID = listed.ID
+	j.Details.Name = listed.Name
+	j.Details.User = listed.User
+	j.Details.State = listed.State
+	j.Details.StartTime = listed.StartTime
+	j.Details.FinishTime = listed.FinishTime
+	j.Details.yarnApp = listed.yarnApp
+	j.Counters = prev.Counters
+	j.Tasks = prev.Tasks
+}
+
+// mapReduceEnricher reads job details, conf, counters and tasks from the
+// MapReduce application master.
+type mapReduceEnricher struct{}
+
+func (mapReduceEnricher) enrich(client RecentJobClient, job *job) error {
+	details, err := client.fetchJobDetails(job.Details.ID)
+	if err != nil {
+		log.Println("An error occurred fetching job details", job.Details.ID, err)
+		return err
+	}
+	details.yarnApp = job.Details.yarnApp
+	job.Details = details
+
+	conf, err := client.fetchConf(job.Details.ID)
+	if err != nil {
+		log.Println("An error occurred fetching job conf", job.Details.ID, err)
+		return err
+	}
+	job.conf.update(conf)
+
+	// This is a hack because Brushfire isn't setting the job name properly.
+	if strings.Index(job.Details.Name, "null/") != -1 && job.conf.name != "" {
+		job.Details.Name = strings.Replace(job.Details.Name, "null/", job.conf.name+"/", 1)
+	}
+
+	counters, err := client.listCounters(job.Details.ID)
+	if err != nil {
+		log.Println("An error occurred fetching job counters", job.Details.ID, err)
+		return err
+	}
+	job.Counters = counters
+
+	tasks, err := client.fetchTasks(job.Details.ID)
+	if err != nil {
+		log.Println("An error occurred fetching job tasks", job.Details.ID, err)
+		return err
+	}
+	job.Details.MapsTotalTime = sumTimes(tasks.Map)
+	job.Details.ReducesTotalTime = sumTimes(tasks.Reduce)
+	job.Tasks.Map = trimTasks(tasks.Map)
+	job.Tasks.Reduce = trimTasks(tasks.Reduce)
+
+	return nil
+}
+
+type sparkStage struct {
+	ID                int64  `json:"stageId"`
+	Status            string `json:"status"`
+	NumTasks          int    `json:"numTasks"`
+	NumActiveTasks    int    `json:"numActiveTasks"`
+	NumCompleteTasks  int    `json:"numCompleteTasks"`
+	NumFailedTasks    int    `json:"numFailedTasks"`
+	NumKilledTasks    int    `json:"numKilledTasks"`
+	ExecutorRunTime   int64  `json:"executorRunTime"`
+	InputBytes        int    `json:"inputBytes"`
+	OutputBytes       int    `json:"outputBytes"`
+	ShuffleReadBytes  int    `json:"shuffleReadBytes"`
+	ShuffleWriteBytes int    `json:"shuffleWriteBytes"`
+	SubmissionTime    string `json:"submissionTime"`
+	CompletionTime    string `json:"completionTime"`
+}
+
+// The Spark REST API formats dates like 2015-02-03T16:42:59.720GMT.
+const sparkTimeLayout = "2006-01-02T15:04:05.000GMT"
+
+func parseSparkTime(s string) int64 {
+	t, err := time.Parse(sparkTimeLayout, s)
+	if err != nil {
+		return 0
+	}
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+// sparkEnricher summarizes the stages reported by the Spark driver's REST
+// API. Spark has no map/reduce split, so stage tasks are counted as maps and
+// each stage shows up as one entry in the map task timeline.
+type sparkEnricher struct{}
+
+func (sparkEnricher) enrich(client RecentJobClient, job *job) error {
+	stages, err := client.fetchSparkStages(job.Details.ID)
+	if err != nil {
+		log.Println("An error occurred fetching spark stages", job.Details.ID, err)
+		return err
+	}
+
+	d := &job.Details
+	d.MapsTotal, d.MapsCompleted, d.MapsRunning, d.MapsFailed, d.MapsKilled = 0, 0, 0, 0, 0
+	d.MapsTotalTime = 0
+
+	totals := make(map[string]int)
+	timeline := make([][]int64, 0, len(stages))
+	for _, stage := range stages {
+		d.MapsTotal += stage.NumTasks
+		d.MapsCompleted += stage.NumCompleteTasks
+		d.MapsRunning += stage.NumActiveTasks
+		d.MapsFailed += stage.NumFailedTasks
+		d.MapsKilled += stage.NumKilledTasks
+		d.MapsTotalTime += stage.ExecutorRunTime
+
+		totals["Spark.INPUT_BYTES"] += stage.InputBytes
+		totals["Spark.OUTPUT_BYTES"] += stage.OutputBytes
+		totals["Spark.SHUFFLE_READ_BYTES"] += stage.ShuffleReadBytes
+		totals["Spark.SHUFFLE_WRITE_BYTES"] += stage.ShuffleWriteBytes
+
+		if stage.Status == "PENDING" || stage.Status == "SKIPPED" {
+			continue
+		}
+		timeline = append(timeline, []int64{parseSparkTime(stage.SubmissionTime), parseSparkTime(stage.CompletionTime)})
+	}
+
+	d.MapsPending = d.MapsTotal - d.MapsCompleted - d.MapsRunning
+	if d.MapsPending < 0 {
+		d.MapsPending = 0
+	}
+	if d.MapsTotal > 0 {
+		d.MapProgress = 100 * float32(d.MapsCompleted) / float32(d.MapsTotal)
+	}
+
+	counters := make([]counter, 0, len(totals))
+	for name, total := range totals {
+		counters = append(counters, counter{Name: name, Total: total, Map: total})
+	}
+	job.Counters = counters
+	job.Tasks.Map = trimTasks(timeline)
+
+	return nil
+}
+
+type tezVertex struct {
+	ID                 string      `json:"id"`
+	Status             string      `json:"status"`
+	Progress           json.Number `json:"progress"`
+	TotalTasks         json.Number `json:"totalTasks"`
+	RunningTasks       json.Number `json:"runningTasks"`
+	SucceededTasks     json.Number `json:"succeededTasks"`
+	FailedTaskAttempts json.Number `json:"failedTaskAttempts"`
+	KilledTaskAttempts json.Number `json:"killedTaskAttempts"`
+}
+
+// numberInt reads a json.Number that may have been sent as either a number
+// or a string, as the Tez AM does.
+func numberInt(n json.Number) int {
+	i, err := n.Int64()
+	if err != nil {
+		f, _ := n.Float64()
+		return int(f)
+	}
+	return int(i)
+}
+
+// tezEnricher summarizes the vertices of the Tez DAG currently running in
+// the application master. Vertex tasks are counted as maps.
+type tezEnricher struct{}
+
+func (tezEnricher) enrich(client RecentJobClient, job *job) error {
+	vertices, err := client.fetchTezVertices(job.Details.ID)
+	if err != nil {
+		log.Println("An error occurred fetching tez vertices", job.Details.ID, err)
+		return err
+	}
+
+	d := &job.Details
+	d.MapsTotal, d.MapsCompleted, d.MapsRunning, d.MapsFailed, d.MapsKilled = 0, 0, 0, 0, 0
+	for _, vertex := range vertices {
+		d.MapsTotal += numberInt(vertex.TotalTasks)
+		d.MapsCompleted += numberInt(vertex.SucceededTasks)
+		d.MapsRunning += numberInt(vertex.RunningTasks)
+		d.MapsFailed += numberInt(vertex.FailedTaskAttempts)
+		d.MapsKilled += numberInt(vertex.KilledTaskAttempts)
+	}
+
+	d.MapsPending = d.MapsTotal - d.MapsCompleted - d.MapsRunning
+	if d.MapsPending < 0 {
+		d.MapsPending = 0
+	}
+	if d.MapsTotal > 0 {
+		d.MapProgress = 100 * float32(d.MapsCompleted) / float32(d.MapsTotal)
+	}
+
+	return nil
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAppDetailFinalStatus(t *testing.T) {
+	app := appDetail{
+		ID:          "application_1_0001",
+		State:       "FINISHED",
+		FinalStatus: "FAILED",
+		yarnApp:     yarnApp{Type: appTypeSpark, Queue: "default", AllocatedMB: 2048},
+	}
+
+	details := app.jobDetail()
+	assert.Equal(t, "FAILED", details.State, "finished apps should report their final status")
+	assert.Equal(t, "default", details.Queue, "the queue should be kept")
+	assert.Equal(t, 2048, details.AllocatedMB, "the allocated memory should be kept")
+
+	app.State = "RUNNING"
+	app.FinalStatus = "UNDEFINED"
+	assert.Equal(t, "RUNNING", app.jobDetail().State, "running apps should report their state")
+}
+
+func TestSparkEnricher(t *testing.T) {
+	client := new(mockJobClient)
+	client.On("fetchSparkStages", "application_1_0001").Return([]sparkStage{
+		{Status: "COMPLETE", NumTasks: 10, NumCompleteTasks: 10, InputBytes: 100,
+			SubmissionTime: "2015-02-03T16:42:59.720GMT", CompletionTime: "2015-02-03T16:43:08.731GMT"},
+		{Status: "ACTIVE", NumTasks: 5, NumCompleteTasks: 1, NumActiveTasks: 2, NumFailedTasks: 1,
+			SubmissionTime: "2015-02-03T16:43:08.800GMT"},
+		{Status: "PENDING", NumTasks: 5},
+	}, nil)
+
+	job := &job{Details: jobDetail{ID: "application_1_0001", yarnApp: yarnApp{Type: appTypeSpark}}}
+	jt := newJobTracker("foo", "", "", client, &hdfsJobHistoryClient{})
+	require.NoError(t, jt.updateJob(job), "enriching a spark app should work")
+
+	assert.Equal(t, 20, job.Details.MapsTotal, "stage tasks should count as maps")
+	assert.Equal(t, 11, job.Details.MapsCompleted, "completed tasks should be summed")
+	assert.Equal(t, 2, job.Details.MapsRunning, "active tasks should be summed")
+	assert.Equal(t, 7, job.Details.MapsPending, "pending tasks should be derived")
+	assert.Equal(t, 1, job.Details.MapsFailed, "failed tasks should be summed")
+	assert.Equal(t, [][]int64{{1422981779720, 1422981788731}, {1422981788800, 0}}, job.Tasks.Map, "started stages should be in the timeline")
+}
+
+func TestUnknownAppTypeIsNotEnriched(t *testing.T) {
+	client := new(mockJobClient)
+	job := &job{Details: jobDetail{ID: "application_1_0002", yarnApp: yarnApp{Type: "SLIDER"}}}
+	jt := newJobTracker("foo", "", "", client, &hdfsJobHistoryClient{})
+
+	assert.NoError(t, jt.updateJob(job), "unknown app types should keep their RM details")
+	client.AssertExpectations(t)
+}
+
+func TestFailedEnrichmentKeepsListing(t *testing.T) {
+	client := new(mockJobClient)
+	client.On("fetchSparkStages", "application_1_0001").Return(nil, errors.New("driver unreachable"))
+	jt := newJobTracker("foo", "", "", client, &hdfsJobHistoryClient{})
+
+	polled := time.Now().Add(-time.Minute)
+	jt.saveJob(&job{
+		Details: jobDetail{ID: "application_1_0001", State: "RUNNING", MapsTotal: 20, MapsCompleted: 11,
+			yarnApp: yarnApp{Type: appTypeSpark, Progress: 10}},
+		Tasks:   tasks{Map: [][]int64{{1000, 2000}}},
+		running: true,
+		updated: polled,
+	})
+
+	listed := &job{
+		Details: jobDetail{ID: "application_1_0001", State: "RUNNING", yarnApp: yarnApp{Type: appTypeSpark, Progress: 50}},
+		running: true,
+		updated: time.Now(),
+	}
+	go jt.updateRunningJob(listed)
+	event := <-jt.updates
+	assert.Equal(t, eventJobUpdated, event.typ, "the resource manager's details should still be published")
+
+	saved := jt.getJob("application_1_0001")
+	require.NotNil(t, saved)
+	assert.Equal(t, float32(50), saved.Details.Progress, "the resource manager's details should be saved")
+	assert.True(t, saved.updated.After(polled), "the job should count as polled")
+	assert.Equal(t, 20, saved.Details.MapsTotal, "the last stages should be kept")
+	assert.Equal(t, [][]int64{{1000, 2000}}, saved.Tasks.Map, "the last stages should be kept")
+}
@@ -30,6 +30,17 @@ type Job struct {
 	} `json:"details"`
 }
 
+// Event is a server-sent event from Timberlake. Removal events only fill in
+// the job's ID.
+type Event struct {
+	Type string
+	Job  Job
+}
+
+type jobRef struct {
+	ID string `json:"id"`
+}
+
 type SlackMessage struct {
 	Text      string `json:"text"`
 	Emoji     string `json:"icon_emoji"`
@@ -42,9 +53,10 @@ var finished = make(map[string]bool, 0)
 
 var finishedStates = []string{"SUCCEEDED", "FAILED", "KILLED"}
 
-func listen(events chan<- Job) {
+func listen(events chan<- Event) {
 	defer close(events)
 	backoff := -2
+	lastEventID := ""
 	for {
 		backoff = int(math.Min(float64(backoff+2), 10))
 		if backoff > 0 {
@@ -52,9 +64,19 @@ func listen(events chan<- Job) {
 			time.Sleep(time.Second * time.Duration(backoff))
 		}
 
-		url := strings.TrimRight(*internalURL, "/") + "/sse"
+		// We only need whole jobs, not deltas.
+		url := strings.TrimRight(*internalURL, "/") + "/sse?format=full"
 		log.Println("Getting", url)
-		resp, err := http.Get(url)
+		req, err := http.NewRequest("GET", url, nil)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		// Timberlake replays the events we missed while we were away.
+		if lastEventID != "" {
+			req.Header.Set("Last-Event-ID", lastEventID)
+		}
+		resp, err := http.DefaultClient.Do(req)
 		if err != nil {
 			log.Println(err)
 			continue
@@ -64,23 +86,32 @@ func listen(events chan<- Job) {
 		log.Println("Scanning for events.")
 		backoff = 0
 
-		var buf string
+		var buf, eventType string
 
-		prefix := "data: "
 		reader := bufio.NewReader(resp.Body)
 		readline, err := reader.ReadString('\n')
 		for err == nil {
-			line := string(readline)
-			if strings.Index(line, prefix) == 0 {
-				buf += line[len(prefix):]
-			} else {
-				job := &Job{}
-				err := json.Unmarshal([]byte(strings.Trim(buf, "\n")), job)
+			line := strings.TrimRight(readline, "\n")
+			switch {
+			case strings.HasPrefix(line, "data: "):
+				buf += line[len("data: "):] + "\n"
+			case strings.HasPrefix(line, "id: "):
+				lastEventID = line[len("id: "):]
+			case strings.HasPrefix(line, "event: "):
+				eventType = line[len("event: "):]
+			case line == "" && eventType == "resync":
+				log.Println("Missed events that couldn't be replayed.")
+				buf, eventType = "", ""
+			case line == "" && buf != "":
+				event, err := parseEvent(eventType, strings.Trim(buf, "\n"))
+				buf, eventType = "", ""
 				if err != nil {
 					log.Println(err)
+					break
 				}
-				buf = ""
-				events <- *job
+				events <- event
+			default:
+				// Anything else is a comment, like the heartbeats.
 			}
 			readline, err = reader.ReadString('\n')
 		}
@@ -89,9 +120,36 @@ func listen(events chan<- Job) {
 	}
 }
 
-func listener(events <-chan Job) {
-	for job := range events {
+// parseEvent reads the payload of the events we care about. Job events carry
+// the whole job, and removals just its ID.
+func parseEvent(eventType string, data string) (Event, error) {
+	event := Event{Type: eventType}
+	switch eventType {
+	case "job.added", "job.updated", "job.finished":
+		err := json.Unmarshal([]byte(data), &event.Job)
+		return event, err
+	case "job.removed":
+		ref := jobRef{}
+		err := json.Unmarshal([]byte(data), &ref)
+		event.Job.Details.ID = ref.ID
+		return event, err
+	}
+	return event, nil
+}
+
+func listener(events <-chan Event) {
+	for event := range events {
+		job := event.Job
 		id := job.Details.ID
+		switch event.Type {
+		case "job.added", "job.updated", "job.finished":
+		case "job.removed":
+			delete(running, id)
+			delete(finished, id)
+			continue
+		default:
+			continue
+		}
 		if job.Details.User == "root" {
 			continue
 		}
@@ -171,7 +229,7 @@ func alert(job Job) {
 		fmt.Println(err)
 	} else {
 		fmt.Println(resp)
-        	defer resp.Body.Close()
+		defer resp.Body.Close()
 	}
 }
 
@@ -199,7 +257,7 @@ func isFinished(job Job) bool {
 
 func main() {
 	flag.Parse()
-	events := make(chan Job, 0)
+	events := make(chan Event, 0)
 	go listen(events)
 	listener(events)
 }
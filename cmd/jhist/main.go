@@ -0,0 +1,292 @@
+// Command jhist prints what Timberlake would show about a finished job, from
+// its jhist file and, if it can find one, its _conf.xml file:
+//
+//	$ jhist [--json] job_1329348432655_0001-...-SUCCEEDED-default.jhist [job_1329348432655_0001_conf.xml]
+//
+// Without a conf file, it looks for one next to the jhist file.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/stripe/timberlake/jhist"
+)
+
+var jsonOutput = flag.Bool("json", false, "Print the analysis as JSON.")
+
+// analysis is everything printed about a job.
+type analysis struct {
+	Details       details                        `json:"details"`
+	Counters      []jhist.Counter                `json:"counters"`
+	Tasks         map[string]taskTimes           `json:"tasks"`
+	Errors        map[string][]jhist.TaskAttempt `json:"errors"`
+	ScaldingSteps []string                       `json:"scaldingSteps"`
+}
+
+// details are named as they are in Timberlake's /jobs/:id.
+type details struct {
+	ID         string `json:"id"`
+	Name       string `json:"name"`
+	User       string `json:"user"`
+	State      string `json:"state"`
+	StartTime  int64  `json:"startTime"`
+	FinishTime int64  `json:"finishTime"`
+
+	MapsTotal     int `json:"mapsTotal"`
+	MapsCompleted int `json:"mapsCompleted"`
+	MapsFailed    int `json:"failedMapAttempts"`
+	MapsKilled    int `json:"killedMapAttempts"`
+
+	ReducesTotal     int `json:"reducesTotal"`
+	ReducesCompleted int `json:"reducesCompleted"`
+	ReducesFailed    int `json:"failedReduceAttempts"`
+	ReducesKilled    int `json:"killedReduceAttempts"`
+
+	Input  string `json:"input"`
+	Output string `json:"output"`
+}
+
+// taskTimes are percentiles of how long the finished attempts of one type
+// of task took, in milliseconds.
+type taskTimes struct {
+	Attempts int   `json:"attempts"`
+	P50      int64 `json:"p50"`
+	P90      int64 `json:"p90"`
+	P99      int64 `json:"p99"`
+	Max      int64 `json:"max"`
+}
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [--json] JHIST [CONF]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() < 1 || flag.NArg() > 2 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	histFile := flag.Arg(0)
+	confFile := flag.Arg(1)
+	if confFile == "" {
+		confFile = findConf(histFile)
+	}
+
+	a, err := analyze(histFile, confFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if *jsonOutput {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(a)
+	} else {
+		err = a.print(os.Stdout)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// findConf returns the conf file the history server would have put next to a
+// jhist file, if it's there.
+func findConf(histFile string) string {
+	id := strings.SplitN(filepath.Base(histFile), "-", 2)[0]
+	confFile := filepath.Join(filepath.Dir(histFile), id+"_conf.xml")
+	if _, err := os.Stat(confFile); err != nil {
+		return ""
+	}
+	return confFile
+}
+
+// analyze reads a job's files. confFile may be empty.
+func analyze(histFile, confFile string) (*analysis, error) {
+	f, err := os.Open(histFile)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	job, err := jhist.Load(f)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read history file at %s: %s", histFile, err)
+	}
+
+	conf := map[string]string{}
+	if confFile != "" {
+		f, err := os.Open(confFile)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+
+		if conf, err = jhist.LoadConf(f); err != nil {
+			return nil, fmt.Errorf("couldn't read jobconf at %s: %s", confFile, err)
+		}
+	}
+
+	maps, reduces := job.TaskTimes()
+	return &analysis{
+		Details: details{
+			ID:               job.ID,
+			Name:             job.Name,
+			User:             job.User,
+			State:            job.State,
+			StartTime:        job.StartTime,
+			FinishTime:       job.FinishTime,
+			MapsTotal:        job.MapsTotal,
+			MapsCompleted:    job.MapsCompleted,
+			MapsFailed:       job.MapsFailed,
+			MapsKilled:       job.MapsKilled,
+			ReducesTotal:     job.ReducesTotal,
+			ReducesCompleted: job.ReducesCompleted,
+			ReducesFailed:    job.ReducesFailed,
+			ReducesKilled:    job.ReducesKilled,
+			Input:            conf["mapreduce.input.fileinputformat.inputdir"],
+			Output:           conf["mapreduce.output.fileoutputformat.outputdir"],
+		},
+		Counters: job.Counters(),
+		Tasks: map[string]taskTimes{
+			"maps":    percentiles(maps),
+			"reduces": percentiles(reduces),
+		},
+		Errors:        job.Errors(),
+		ScaldingSteps: scaldingSteps(conf["scalding.step.descriptions"]),
+	}, nil
+}
+
+// percentiles summarizes the durations of the attempts that finished.
+func percentiles(pairs [][]int64) taskTimes {
+	var durations []int64
+	for _, pair := range pairs {
+		if pair[0] > 0 && pair[1] >= pair[0] {
+			durations = append(durations, pair[1]-pair[0])
+		}
+	}
+	if len(durations) == 0 {
+		return taskTimes{}
+	}
+	sort.Slice(durations, func(i, j int) bool { return durations[i] < durations[j] })
+
+	rank := func(p int) int64 {
+		return durations[(len(durations)*p+99)/100-1]
+	}
+	return taskTimes{
+		Attempts: len(durations),
+		P50:      rank(50),
+		P90:      rank(90),
+		P99:      rank(99),
+		Max:      durations[len(durations)-1],
+	}
+}
+
+var scaldingLine = regexp.MustCompile(`[\w.]+:\d+`)
+
+// scaldingSteps splits scalding.step.descriptions into the source lines of
+// each step, without repeats, the same way the job page does.
+func scaldingSteps(descriptions string) []string {
+	steps := []string{}
+	seen := make(map[string]bool)
+	for _, step := range strings.Split(descriptions, ",") {
+		step = strings.TrimSpace(step)
+		if step != "" && !seen[step] {
+			seen[step] = true
+			steps = append(steps, step)
+		}
+	}
+	return steps
+}
+
+func (a *analysis) print(out io.Writer) error {
+	w := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	d := a.Details
+	fmt.Fprintf(w, "ID\t%s\n", d.ID)
+	fmt.Fprintf(w, "Name\t%s\n", d.Name)
+	fmt.Fprintf(w, "User\t%s\n", d.User)
+	fmt.Fprintf(w, "State\t%s\n", d.State)
+	fmt.Fprintf(w, "Start\t%s\n", formatTime(d.StartTime))
+	fmt.Fprintf(w, "Finish\t%s\n", formatTime(d.FinishTime))
+	fmt.Fprintf(w, "Duration\t%s\n", formatDuration(d.FinishTime-d.StartTime))
+	fmt.Fprintf(w, "Maps\t%d total, %d completed, %d failed, %d killed\n", d.MapsTotal, d.MapsCompleted, d.MapsFailed, d.MapsKilled)
+	fmt.Fprintf(w, "Reduces\t%d total, %d completed, %d failed, %d killed\n", d.ReducesTotal, d.ReducesCompleted, d.ReducesFailed, d.ReducesKilled)
+	fmt.Fprintf(w, "Input\t%s\n", d.Input)
+	fmt.Fprintf(w, "Output\t%s\n", d.Output)
+
+	fmt.Fprintf(w, "\nTask times\tattempts\tp50\tp90\tp99\tmax\n")
+	for _, kind := range []string{"maps", "reduces"} {
+		t := a.Tasks[kind]
+		fmt.Fprintf(w, "%s\t%d\t%s\t%s\t%s\t%s\n", kind, t.Attempts,
+			formatDuration(t.P50), formatDuration(t.P90), formatDuration(t.P99), formatDuration(t.Max))
+	}
+
+	fmt.Fprintf(w, "\nCounters\ttotal\tmap\treduce\n")
+	for _, c := range a.Counters {
+		fmt.Fprintf(w, "%s\t%d\t%d\t%d\n", c.Name, c.Total, c.Map, c.Reduce)
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	if len(a.Errors) > 0 {
+		// The most common errors first.
+		var errors []string
+		for e := range a.Errors {
+			errors = append(errors, e)
+		}
+		sort.Slice(errors, func(i, j int) bool {
+			if len(a.Errors[errors[i]]) != len(a.Errors[errors[j]]) {
+				return len(a.Errors[errors[i]]) > len(a.Errors[errors[j]])
+			}
+			return errors[i] < errors[j]
+		})
+
+		fmt.Fprintf(out, "\nErrors\n")
+		for _, e := range errors {
+			attempts := a.Errors[e]
+			fmt.Fprintf(out, "\n%d failed attempts:\n", len(attempts))
+			for _, attempt := range attempts {
+				fmt.Fprintf(out, "  %s on %s\n", attempt.ID, attempt.Hostname)
+			}
+			fmt.Fprintf(out, "%s\n", strings.TrimSpace(e))
+		}
+	}
+
+	if len(a.ScaldingSteps) > 0 {
+		fmt.Fprintf(out, "\nScalding steps\n")
+		for _, step := range a.ScaldingSteps {
+			if short := scaldingLine.FindString(step); short != "" && short != step {
+				fmt.Fprintf(out, "  %s  (%s)\n", short, step)
+			} else {
+				fmt.Fprintf(out, "  %s\n", step)
+			}
+		}
+	}
+	return nil
+}
+
+func formatTime(ms int64) string {
+	if ms <= 0 {
+		return "-"
+	}
+	return time.Unix(0, ms*int64(time.Millisecond)).Format(time.RFC3339)
+}
+
+func formatDuration(ms int64) string {
+	if ms <= 0 {
+		return "-"
+	}
+	return (time.Duration(ms) * time.Millisecond).String()
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAnalyze(t *testing.T) {
+	a, err := analyze("../../test/sleepjob.jhist", "../../test/conf.xml")
+	require.NoError(t, err)
+
+	assert.Equal(t, "Sleep job", a.Details.Name)
+	assert.Equal(t, "/input/dir", a.Details.Input)
+	assert.Equal(t, 1, a.Tasks["reduces"].Attempts)
+	assert.Equal(t, int64(3605), a.Tasks["reduces"].Max)
+	assert.Len(t, a.Errors["This is an error."], 1)
+
+	var out bytes.Buffer
+	require.NoError(t, a.print(&out))
+	assert.Contains(t, out.String(), "This is an error.")
+	assert.Contains(t, out.String(), "FileSystemCounter.HDFS_BYTES_READ")
+
+	assert.Equal(t, "", findConf("../../test/sleepjob.jhist"))
+}
+
+func TestPercentiles(t *testing.T) {
+	var pairs [][]int64
+	for i := int64(1); i <= 100; i++ {
+		pairs = append(pairs, []int64{1000, 1000 + i})
+	}
+	pairs = append(pairs, []int64{0, 0}, []int64{1000, 0})
+
+	assert.Equal(t, taskTimes{Attempts: 100, P50: 50, P90: 90, P99: 99, Max: 100}, percentiles(pairs))
+	assert.Equal(t, taskTimes{}, percentiles(nil))
+}
+
+func TestScaldingSteps(t *testing.T) {
+	steps := scaldingSteps("com.example.Job.run(Job.scala:12), com.example.Job.run(Job.scala:30),com.example.Job.run(Job.scala:12)")
+	assert.Equal(t, []string{"com.example.Job.run(Job.scala:12)", "com.example.Job.run(Job.scala:30)"}, steps)
+	assert.Equal(t, []string{}, scaldingSteps(""))
+}
@@ -1,8 +1,9 @@
 package main
 
 import (
-	"encoding/xml"
 	"io"
+
+	"github.com/stripe/timberlake/jhist"
 )
 
 type conf struct {
@@ -13,16 +14,6 @@ type conf struct {
 	name          string
 }
 
-type confProperty struct {
-	Name  string `xml:"name"`
-	Value string `xml:"value"`
-}
-
-type parsedJobConf struct {
-	XMLName    xml.Name       `xml:"configuration"`
-	Properties []confProperty `xml:"property"`
-}
-
 // update applies known configuration properties to the job object.
 func (conf *conf) update(c map[string]string) {
 	if conf.Flags == nil {
@@ -45,18 +36,5 @@ func (conf *conf) update(c map[string]string) {
 
 // loadConf loads a job's hadoop conf from an xml file represented by r.
 func loadConf(r io.Reader) (map[string]string, error) {
-	decoder := xml.NewDecoder(r)
-
-	parsed := parsedJobConf{}
-	err := decoder.Decode(&parsed)
-	if err != nil {
-		return nil, err
-	}
-
-	conf := make(map[string]string, len(parsed.Properties))
-	for _, prop := range parsed.Properties {
-		conf[prop.Name] = prop.Value
-	}
-
-	return conf, nil
+	return jhist.LoadConf(r)
 }
@@ -0,0 +1,376 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/signal"
+	"reflect"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+var configFile = flag.String("config", "", "A YAML or JSON file defining the clusters, in place of --cluster-name and the other per-cluster flags. Settings it leaves out default to the flags. It's reloaded on SIGHUP.")
+
+// clusterConfig is everything we need to know to track a cluster. In the
+// config file, it's one of the entries under clusters:
+//
+//	clusters:
+//	  - name: prod
+//	    resourceManagers: [http://rm1:8088, http://rm2:8088]
+//	    historyServers: [http://hs:19888]
+//	    namenodes: [nn1:8020, nn2:8020]
+//	    pollInterval: 5s
+//	    memoryBudget: 512MB
+//	    auth:
+//	      keytab: /etc/timberlake.keytab
+//	      principal: timberlake/host.example.com@EXAMPLE.COM
+type clusterConfig struct {
+	Name                     string        `yaml:"name"`
+	ResourceManagers         []string      `yaml:"resourceManagers"`
+	HistoryServers           []string      `yaml:"historyServers"`
+	Proxies                  []string      `yaml:"proxies"`
+	Namenodes                []string      `yaml:"namenodes"`
+	PublicResourceManagerURL string        `yaml:"publicResourceManagerUrl"`
+	PublicHistoryServerURL   string        `yaml:"publicHistoryServerUrl"`
+	HistoryDir               string        `yaml:"historyDir"`
+	IntermediateHistoryDir   string        `yaml:"intermediateHistoryDir"`
+	LogsDir                  string        `yaml:"logsDir"`
+	LogsDirSuffix            string        `yaml:"logsDirSuffix"`
+	PollInterval             time.Duration `yaml:"pollInterval"`
+	HTTPTimeout              time.Duration `yaml:"httpTimeout"`
+	MemoryBudget             byteSize      `yaml:"memoryBudget"`
+	EvictionPolicy           string        `yaml:"evictionPolicy"`
+	HDFSReads                int           `yaml:"hdfsReads"`
+	ReplayDir                string        `yaml:"replayDir"`
+	ReplaySpeed              float64       `yaml:"replaySpeed"`
+	Auth                     authConfig    `yaml:"auth"`
+}
+
+// authConfig is how to log in to a cluster. Without a keytab, requests
+// aren't authenticated.
+type authConfig struct {
+	Keytab            string `yaml:"keytab"`
+	Principal         string `yaml:"principal"`
+	KerberosConfig    string `yaml:"kerberosConfig"`
+	NamenodePrincipal string `yaml:"namenodePrincipal"`
+}
+
+// flagDefaults fills in the settings a cluster leaves out from the flags.
+func flagDefaults(cfg clusterConfig) clusterConfig {
+	if cfg.HistoryDir == "" {
+		cfg.HistoryDir = *yarnHistoryDir
+	}
+	if cfg.IntermediateHistoryDir == "" {
+		cfg.IntermediateHistoryDir = *yarnIntermediateHistoryDir
+	}
+	if cfg.LogsDir == "" {
+		cfg.LogsDir = *yarnLogDir
+	}
+	if cfg.LogsDirSuffix == "" {
+		cfg.LogsDirSuffix = *yarnLogDirSuffix
+	}
+	if cfg.PollInterval == 0 {
+		cfg.PollInterval = *pollInterval
+	}
+	if cfg.HTTPTimeout == 0 {
+		cfg.HTTPTimeout = *httpTimeout
+	}
+	if cfg.MemoryBudget == 0 {
+		cfg.MemoryBudget = memoryBudget
+	}
+	if cfg.EvictionPolicy == "" {
+		cfg.EvictionPolicy = *evictionPolicyFlag
+	}
+	if cfg.HDFSReads == 0 {
+		cfg.HDFSReads = *hdfsReads
+	}
+	if cfg.Auth.Keytab == "" {
+		cfg.Auth.Keytab = *kerberosKeytab
+	}
+	if cfg.Auth.Principal == "" {
+		cfg.Auth.Principal = *kerberosPrincipal
+	}
+	if cfg.Auth.KerberosConfig == "" {
+		cfg.Auth.KerberosConfig = *kerberosConfig
+	}
+	if cfg.Auth.NamenodePrincipal == "" {
+		cfg.Auth.NamenodePrincipal = *namenodePrincipal
+	}
+	return cfg
+}
+
+// loadClusterConfig reads the clusters from a config file. JSON is valid
+// YAML, so either works.
+func loadClusterConfig(path string) ([]clusterConfig, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	file := struct {
+		Clusters []clusterConfig `yaml:"clusters"`
+	}{}
+	if err := yaml.UnmarshalStrict(b, &file); err != nil {
+		return nil, fmt.Errorf("couldn't parse %s: %s", path, err)
+	}
+
+	for i, cfg := range file.Clusters {
+		cfg = flagDefaults(cfg)
+		if cfg.PublicResourceManagerURL == "" && len(cfg.ResourceManagers) > 0 {
+			cfg.PublicResourceManagerURL = cfg.ResourceManagers[0]
+		}
+		if cfg.PublicHistoryServerURL == "" && len(cfg.HistoryServers) > 0 {
+			cfg.PublicHistoryServerURL = cfg.HistoryServers[0]
+		}
+		file.Clusters[i] = cfg
+	}
+
+	if err := validateClusterConfig(file.Clusters); err != nil {
+		return nil, fmt.Errorf("invalid %s: %s", path, err)
+	}
+	return file.Clusters, nil
+}
+
+// flagClusterConfig reads the clusters from the comma separated cluster
+// flags, which have to line up 1:1.
+func flagClusterConfig() ([]clusterConfig, error) {
+	var clusterNames = strings.Split(*clusterNames, ",")
+	var resourceManagerURLs = strings.Split(*resourceManagerURL, ",")
+	var historyServerURLs = strings.Split(*historyServerURL, ",")
+	var publicResourceManagerURLs = strings.Split(*publicResourceManagerURL, ",")
+	var publicHistoryServerURLs = strings.Split(*publicHistoryServerURL, ",")
+	var proxyServerURLs = strings.Split(*proxyServerURL, ",")
+	var namenodeAddresses = strings.Split(*namenodeAddress, ",")
+
+	if *publicResourceManagerURL == "" {
+		publicResourceManagerURLs = firstEndpoints(resourceManagerURLs)
+	}
+	if *publicHistoryServerURL == "" {
+		publicHistoryServerURLs = firstEndpoints(resourceManagerURLs)
+	}
+
+	if len(resourceManagerURLs) != len(historyServerURLs) {
+		return nil, fmt.Errorf("resource-manager-url and history-server-url are not 1:1")
+	}
+	if *proxyServerURL != "" && len(proxyServerURLs) != len(resourceManagerURLs) {
+		return nil, fmt.Errorf("proxy-server-url exists and is not 1:1 with resource-manager-url")
+	}
+	if len(resourceManagerURLs) != len(namenodeAddresses) {
+		return nil, fmt.Errorf("resource-manager-url and namenode-address are not 1:1")
+	}
+	if len(resourceManagerURLs) != len(clusterNames) {
+		return nil, fmt.Errorf("cluster-names and resource-manager-url are not 1:1")
+	}
+	if len(publicResourceManagerURLs) != len(resourceManagerURLs) || len(publicHistoryServerURLs) != len(resourceManagerURLs) {
+		return nil, fmt.Errorf("public-resource-manager-url and public-history-server-url are not 1:1 with resource-manager-url")
+	}
+
+	configs := make([]clusterConfig, len(clusterNames))
+	for i := range clusterNames {
+		configs[i] = flagDefaults(clusterConfig{
+			Name:                     clusterNames[i],
+			ResourceManagers:         splitEndpoints(resourceManagerURLs[i]),
+			HistoryServers:           splitEndpoints(historyServerURLs[i]),
+			Namenodes:                splitEndpoints(namenodeAddresses[i]),
+			PublicResourceManagerURL: publicResourceManagerURLs[i],
+			PublicHistoryServerURL:   publicHistoryServerURLs[i],
+		})
+		if *proxyServerURL != "" {
+			configs[i].Proxies = splitEndpoints(proxyServerURLs[i])
+		}
+	}
+	return configs, validateClusterConfig(configs)
+}
+
+func validateClusterConfig(configs []clusterConfig) error {
+	if len(configs) == 0 {
+		return fmt.Errorf("no clusters")
+	}
+
+	names := make(map[string]bool, len(configs))
+	for _, cfg := range configs {
+		if cfg.Name == "" {
+			return fmt.Errorf("every cluster needs a name")
+		}
+		if names[cfg.Name] {
+			return fmt.Errorf("cluster %s is defined twice", cfg.Name)
+		}
+		names[cfg.Name] = true
+
+		if cfg.ReplayDir == "" && (len(cfg.ResourceManagers) == 0 || len(cfg.HistoryServers) == 0 || len(cfg.Namenodes) == 0) {
+			return fmt.Errorf("cluster %s needs resource managers, history servers and namenodes", cfg.Name)
+		}
+		if cfg.PollInterval <= 0 || cfg.HTTPTimeout <= 0 || cfg.HDFSReads <= 0 {
+			return fmt.Errorf("cluster %s needs a positive pollInterval, httpTimeout and hdfsReads", cfg.Name)
+		}
+		if _, err := parseEvictionPolicy(cfg.EvictionPolicy); err != nil {
+			return fmt.Errorf("cluster %s: %s", cfg.Name, err)
+		}
+		if cfg.Auth.Keytab != "" && cfg.Auth.Principal == "" {
+			return fmt.Errorf("cluster %s has a keytab, but no principal", cfg.Name)
+		}
+	}
+	return nil
+}
+
+// newClusterTracker creates a tracker for a cluster, without starting it.
+func newClusterTracker(cfg clusterConfig) (*jobTracker, error) {
+	if cfg.ReplayDir != "" {
+		return newReplayTracker(cfg)
+	}
+
+	auth, err := newHadoopAuth(cfg.Auth, cfg.HTTPTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't set up auth for cluster %s: %s", cfg.Name, err)
+	}
+
+	log.Printf("Creating new JT %s: %v %v %v\n", cfg.Name, cfg.ResourceManagers, cfg.HistoryServers, cfg.Proxies)
+	client := newRecentJobClient(cfg.Name, cfg.ResourceManagers, cfg.HistoryServers, cfg.Proxies, cfg.Namenodes, auth)
+	jt := newJobTracker(
+		cfg.Name,
+		cfg.PublicResourceManagerURL,
+		cfg.PublicHistoryServerURL,
+		&instrumentedJobClient{
+			RecentJobClient: client,
+			cluster:         cfg.Name,
+		},
+		&hdfsJobHistoryClient{},
+	)
+	jt.config = cfg
+	jt.hdfs = newHDFSPool(client.getEndpoints().Namenode, cfg.HDFSReads)
+	jt.history = newHistorySource(cfg.HistoryDir, cfg.IntermediateHistoryDir, jt.hdfs)
+	return jt, nil
+}
+
+// The job trackers, by cluster name. The map is replaced, never modified,
+// when the config is reloaded.
+var jts map[string]*jobTracker
+var jtsLock sync.RWMutex
+
+// trackers returns the current job trackers.
+func trackers() map[string]*jobTracker {
+	jtsLock.RLock()
+	defer jtsLock.RUnlock()
+	return jts
+}
+
+// applyClusterConfig brings the job trackers in line with the config.
+// Clusters that are new get a tracker, and the ones that are gone have
+// theirs stopped. Clusters whose settings changed get a new tracker, which
+// takes over the jobs of the old one. If any cluster can't be set up,
+// nothing changes.
+func applyClusterConfig(configs []clusterConfig, sse *sse) error {
+	current := trackers()
+	next := make(map[string]*jobTracker, len(configs))
+	for _, cfg := range configs {
+		old := current[cfg.Name]
+		if old != nil && reflect.DeepEqual(old.config, cfg) {
+			next[cfg.Name] = old
+			continue
+		}
+
+		jt, err := newClusterTracker(cfg)
+		if err == nil && old == nil && *stateDir != "" {
+			if err = jt.loadState(*stateDir); err != nil {
+				err = fmt.Errorf("couldn't load saved jobs for cluster %s: %s", cfg.Name, err)
+			}
+		}
+		if err != nil {
+			// None of the trackers built so far have been started, or
+			// taken over any jobs, so they only need their connections and
+			// databases closed.
+			if jt != nil {
+				next[cfg.Name] = jt
+			}
+			for name, jt := range next {
+				if current[name] != jt {
+					jt.Stop()
+					if jt.state != nil {
+						jt.state.close()
+					}
+				}
+			}
+			return err
+		}
+		next[cfg.Name] = jt
+	}
+
+	// The old trackers keep serving requests until they're swapped out,
+	// but they have to stop updating their jobs first.
+	for name, old := range current {
+		if jt := next[name]; jt != old {
+			old.Stop()
+			if jt != nil {
+				log.Println("Reconfiguring cluster", name)
+				jt.inherit(old)
+			} else {
+				log.Println("Removing cluster", name)
+			}
+		}
+	}
+
+	jtsLock.Lock()
+	jts = next
+	jtsLock.Unlock()
+
+	for name, old := range current {
+		if next[name] == nil && old.state != nil {
+			old.state.close()
+		}
+	}
+	for name, jt := range next {
+		if current[name] != jt {
+			startTracker(jt, sse)
+		}
+	}
+	return nil
+}
+
+// inherit takes over the jobs of a stopped tracker for the same cluster.
+func (jt *jobTracker) inherit(old *jobTracker) {
+	jt.store = old.store
+	jt.details = old.details
+	jt.state = old.state
+	jt.backfilled = old.backfilled
+}
+
+// startTracker starts polling a cluster, and publishing its updates.
+func startTracker(jt *jobTracker, sse *sse) {
+	if _, none := persistedJobClient.(noneJobClient); *archiveJobs && persistedJobClient != nil && !none {
+		jt.archive = persistedJobClient
+	}
+
+	jt.Loop()
+	jt.start(func() { jt.sendUpdates(sse) })
+
+	if err := jt.testLogsDir(); err != nil {
+		log.Printf("WARNING: Could not read yarn logs directory for cluster %s. Error message: `%s`\n", jt.clusterName, err)
+		log.Println("\tYou can change the path with --yarn-logs-dir=HDFS_PATH, or logsDir in the config file.")
+		log.Println("\tTo talk to HDFS, Timberlake needs to be able to access the namenodes and datanodes.")
+	}
+}
+
+// reloadClusterConfig applies the config file again every time we get a
+// SIGHUP. If it's invalid, the clusters are left as they are.
+func reloadClusterConfig(path string, sse *sse) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	for range hup {
+		log.Println("Reloading cluster config from", path)
+		configs, err := loadClusterConfig(path)
+		if err == nil {
+			err = applyClusterConfig(configs, sse)
+		}
+		if err != nil {
+			log.Println("Could not reload cluster config:", err)
+			metrics.add(configReloadErrorsMetric, 1)
+		}
+	}
+}
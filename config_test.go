@@ -0,0 +1,218 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeConfig(t *testing.T, dir string, name string, contents string) string {
+	path := filepath.Join(dir, name)
+	require.NoError(t, ioutil.WriteFile(path, []byte(contents), 0644))
+	return path
+}
+
+func TestLoadClusterConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "timberlake-config")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	configs, err := loadClusterConfig(writeConfig(t, dir, "clusters.yaml", `
+clusters:
+  - name: prod
+    resourceManagers: [http://rm1:8088, http://rm2:8088]
+    historyServers: [http://hs:19888]
+    namenodes: [nn1:8020, nn2:8020]
+    historyDir: /history/done
+    pollInterval: 10s
+    memoryBudget: 512MB
+    evictionPolicy: pinned,state,age
+    hdfsReads: 4
+    auth:
+      namenodePrincipal: hdfs/_HOST@EXAMPLE.COM
+  - name: dev
+    resourceManagers: [http://dev-rm:8088]
+    historyServers: [http://dev-hs:19888]
+    proxies: [http://dev-proxy:8089]
+    namenodes: [dev-nn:8020]
+    publicResourceManagerUrl: https://rm.example.com
+`))
+	require.NoError(t, err)
+	require.Len(t, configs, 2)
+
+	prod := configs[0]
+	assert.Equal(t, "prod", prod.Name)
+	assert.Equal(t, []string{"http://rm1:8088", "http://rm2:8088"}, prod.ResourceManagers)
+	assert.Equal(t, "/history/done", prod.HistoryDir)
+	assert.Equal(t, 10*time.Second, prod.PollInterval)
+	assert.Equal(t, byteSize(512<<20), prod.MemoryBudget)
+	assert.Equal(t, "pinned,state,age", prod.EvictionPolicy)
+	assert.Equal(t, 4, prod.HDFSReads)
+	assert.Equal(t, "hdfs/_HOST@EXAMPLE.COM", prod.Auth.NamenodePrincipal)
+	assert.Equal(t, "http://rm1:8088", prod.PublicResourceManagerURL)
+	assert.Equal(t, "http://hs:19888", prod.PublicHistoryServerURL)
+
+	// Anything left out comes from the flags.
+	dev := configs[1]
+	assert.Equal(t, "https://rm.example.com", dev.PublicResourceManagerURL)
+	assert.Equal(t, []string{"http://dev-proxy:8089"}, dev.Proxies)
+	assert.Equal(t, *yarnHistoryDir, dev.HistoryDir)
+	assert.Equal(t, *yarnLogDir, dev.LogsDir)
+	assert.Equal(t, *pollInterval, dev.PollInterval)
+	assert.Equal(t, *httpTimeout, dev.HTTPTimeout)
+	assert.Equal(t, *hdfsReads, dev.HDFSReads)
+	assert.Equal(t, *namenodePrincipal, dev.Auth.NamenodePrincipal)
+
+	// JSON works too.
+	configs, err = loadClusterConfig(writeConfig(t, dir, "clusters.json", `{
+	"clusters": [
+		{
+			"name": "prod",
+			"resourceManagers": ["http://rm1:8088", "http://rm2:8088"],
+			"historyServers": ["http://hs:19888"],
+			"namenodes": ["nn1:8020", "nn2:8020"],
+			"historyDir": "/history/done",
+			"pollInterval": "10s",
+			"memoryBudget": "512MB",
+			"evictionPolicy": "pinned,state,age",
+			"hdfsReads": 4,
+			"auth": {"namenodePrincipal": "hdfs/_HOST@EXAMPLE.COM"}
+		}
+	]
+}`))
+	require.NoError(t, err)
+	assert.Equal(t, []clusterConfig{prod}, configs)
+
+	for name, invalid := range map[string]string{
+		"no clusters":     `clusters: []`,
+		"unknown setting": "clusters:\n  - name: a\n    resourceManager: [http://rm:8088]\n",
+		"no namenodes":    "clusters:\n  - name: a\n    resourceManagers: [http://rm:8088]\n    historyServers: [http://hs:19888]\n",
+		"duplicate name":  "clusters:\n  - {name: a, resourceManagers: [rm], historyServers: [hs], namenodes: [nn]}\n  - {name: a, resourceManagers: [rm], historyServers: [hs], namenodes: [nn]}\n",
+		"bad duration":    "clusters:\n  - {name: a, resourceManagers: [rm], historyServers: [hs], namenodes: [nn], pollInterval: often}\n",
+		"bad budget":      "clusters:\n  - {name: a, resourceManagers: [rm], historyServers: [hs], namenodes: [nn], memoryBudget: lots}\n",
+		"bad eviction":    "clusters:\n  - {name: a, resourceManagers: [rm], historyServers: [hs], namenodes: [nn], evictionPolicy: size}\n",
+		"bad hdfs reads":  "clusters:\n  - {name: a, resourceManagers: [rm], historyServers: [hs], namenodes: [nn], hdfsReads: -1}\n",
+	} {
+		_, err := loadClusterConfig(writeConfig(t, dir, "invalid.yaml", invalid))
+		assert.Error(t, err, name)
+	}
+}
+
+func TestApplyClusterConfig(t *testing.T) {
+	defer func(saved map[string]*jobTracker) { jts = saved }(jts)
+	jts = nil
+
+	// Nothing listens at these addresses, so the trackers' requests fail
+	// right away.
+	cluster := func(name string, poll time.Duration) clusterConfig {
+		return flagDefaults(clusterConfig{
+			Name:             name,
+			ResourceManagers: []string{"http://127.0.0.1:1"},
+			HistoryServers:   []string{"http://127.0.0.1:1"},
+			Namenodes:        []string{"127.0.0.1:1"},
+			PollInterval:     poll,
+		})
+	}
+	stopped := func(jt *jobTracker) bool {
+		select {
+		case <-jt.stop:
+			return true
+		default:
+			return false
+		}
+	}
+
+	s := newSSE()
+	require.NoError(t, applyClusterConfig([]clusterConfig{cluster("a", time.Hour), cluster("b", time.Hour)}, s))
+	a, b := trackers()["a"], trackers()["b"]
+	require.NotNil(t, a)
+	require.NotNil(t, b)
+	a.saveJob(&job{Details: jobDetail{ID: "job_1_0001"}, running: true})
+
+	require.NoError(t, applyClusterConfig([]clusterConfig{cluster("a", time.Minute), cluster("b", time.Hour), cluster("c", time.Hour)}, s))
+	current := trackers()
+	require.Len(t, current, 3)
+	assert.True(t, current["b"] == b, "unchanged clusters should keep their tracker")
+	assert.False(t, stopped(b))
+	assert.True(t, current["a"] != a, "reconfigured clusters should get a new tracker")
+	assert.True(t, stopped(a))
+	assert.Equal(t, time.Minute, current["a"].config.PollInterval)
+	assert.NotNil(t, current["a"].getJob("job_1_0001"), "reconfigured clusters should keep their jobs")
+
+	// A cluster that can't be set up leaves everything as it was.
+	broken := cluster("d", time.Hour)
+	broken.Auth.Keytab = "/nonexistent.keytab"
+	broken.Auth.Principal = "timberlake@EXAMPLE.COM"
+	assert.Error(t, applyClusterConfig([]clusterConfig{cluster("c", time.Hour), broken}, s))
+	assert.Equal(t, current, trackers())
+
+	require.NoError(t, applyClusterConfig([]clusterConfig{cluster("c", time.Hour)}, s))
+	assert.Len(t, trackers(), 1)
+	assert.True(t, stopped(current["a"]))
+	assert.True(t, stopped(b))
+	trackers()["c"].Stop()
+}
+
+func TestArchiveNeedsFlag(t *testing.T) {
+	defer func(saved map[string]*jobTracker) { jts = saved }(jts)
+	defer func(saved PersistedJobClient) { persistedJobClient = saved }(persistedJobClient)
+	defer func(saved bool) { *archiveJobs = saved }(*archiveJobs)
+	jts = nil
+	persistedJobClient = &mockPersistedJobClient{}
+
+	cluster := flagDefaults(clusterConfig{
+		Name:             "a",
+		ResourceManagers: []string{"http://127.0.0.1:1"},
+		HistoryServers:   []string{"http://127.0.0.1:1"},
+		Namenodes:        []string{"127.0.0.1:1"},
+		PollInterval:     time.Hour,
+	})
+	s := newSSE()
+
+	*archiveJobs = false
+	require.NoError(t, applyClusterConfig([]clusterConfig{cluster}, s))
+	assert.Nil(t, trackers()["a"].archive, "a store should only be read from without --archive")
+	trackers()["a"].Stop()
+
+	jts = nil
+	*archiveJobs = true
+	require.NoError(t, applyClusterConfig([]clusterConfig{cluster}, s))
+	assert.NotNil(t, trackers()["a"].archive)
+	trackers()["a"].Stop()
+}
+
+func TestApplyClusterConfigCleansUpAfterError(t *testing.T) {
+	defer func(saved map[string]*jobTracker) { jts = saved }(jts)
+	defer func(saved string) { *stateDir = saved }(*stateDir)
+	jts = nil
+	dir, err := ioutil.TempDir("", "timberlake-state")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	*stateDir = dir
+
+	valid := flagDefaults(clusterConfig{
+		Name:             "a",
+		ResourceManagers: []string{"http://127.0.0.1:1"},
+		HistoryServers:   []string{"http://127.0.0.1:1"},
+		Namenodes:        []string{"127.0.0.1:1"},
+		PollInterval:     time.Hour,
+	})
+	broken := valid
+	broken.Name = "b"
+	broken.Auth.Keytab = "/nonexistent.keytab"
+	broken.Auth.Principal = "timberlake@EXAMPLE.COM"
+
+	assert.Error(t, applyClusterConfig([]clusterConfig{valid, broken}, newSSE()))
+	assert.Nil(t, trackers())
+
+	// The first cluster's database should have been closed, rather than
+	// left locked by a tracker that was never started.
+	state, err := openJobState(dir, "a")
+	require.NoError(t, err)
+	state.close()
+}
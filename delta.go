@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+)
+
+// jobDelta is the payload of a job.delta event: the parts of a running job
+// that changed since the last version the client was sent. Counters only
+// ever get added or change while a job runs, so only those are sent.
+type jobDelta struct {
+	ID       string                   `json:"id"`
+	Cluster  string                   `json:"cluster"`
+	Details  map[string]interface{}   `json:"details,omitempty"`
+	Counters []counter                `json:"counters,omitempty"`
+	Maps     *taskWindow              `json:"maps,omitempty"`
+	Reduces  *taskWindow              `json:"reduces,omitempty"`
+	Errors   map[string][]taskAttempt `json:"errors,omitempty"`
+	FlowID   *string                  `json:"flowID,omitempty"`
+}
+
+// taskWindow replaces the tasks from Start onwards with Pairs. Tasks are
+// sorted by start time, so new and running ones are usually at the end.
+type taskWindow struct {
+	Start int       `json:"start"`
+	Pairs [][]int64 `json:"pairs"`
+}
+
+// snapshotJob copies the parts of a job that deltas are computed from, so
+// that later changes to the job don't change the copy.
+func snapshotJob(j *job) *job {
+	return &job{
+		Details:  j.Details,
+		Counters: append([]counter(nil), j.Counters...),
+		Tasks: tasks{
+			Map:    copyTaskPairs(j.Tasks.Map),
+			Reduce: copyTaskPairs(j.Tasks.Reduce),
+			Errors: j.Tasks.Errors,
+		},
+		Cluster: j.Cluster,
+		FlowID:  j.FlowID,
+	}
+}
+
+func copyTaskPairs(pairs [][]int64) [][]int64 {
+	copied := make([][]int64, len(pairs))
+	for i, pair := range pairs {
+		copied[i] = append([]int64(nil), pair...)
+	}
+	return copied
+}
+
+// diffJobs returns the changes between two versions of a job.
+func diffJobs(prev *job, cur *job) *jobDelta {
+	delta := &jobDelta{
+		ID:      cur.Details.ID,
+		Cluster: cur.Cluster,
+		Details: diffDetails(prev.Details, cur.Details),
+		Maps:    diffTasks(prev.Tasks.Map, cur.Tasks.Map),
+		Reduces: diffTasks(prev.Tasks.Reduce, cur.Tasks.Reduce),
+	}
+
+	prevCounters := make(map[string]counter, len(prev.Counters))
+	for _, c := range prev.Counters {
+		prevCounters[c.Name] = c
+	}
+	for _, c := range cur.Counters {
+		if p, ok := prevCounters[c.Name]; !ok || p != c {
+			delta.Counters = append(delta.Counters, c)
+		}
+	}
+
+	if !reflect.DeepEqual(prev.Tasks.Errors, cur.Tasks.Errors) {
+		delta.Errors = cur.Tasks.Errors
+	}
+	if cur.FlowID != nil && (prev.FlowID == nil || *prev.FlowID != *cur.FlowID) {
+		delta.FlowID = cur.FlowID
+	}
+	return delta
+}
+
+// diffDetails compares details by their JSON fields, and returns the ones
+// that changed.
+func diffDetails(prev jobDetail, cur jobDetail) map[string]interface{} {
+	prevFields, curFields := detailFields(prev), detailFields(cur)
+	changed := make(map[string]interface{})
+	for name, value := range curFields {
+		if prevFields[name] != value {
+			changed[name] = value
+		}
+	}
+	return changed
+}
+
+// detailFields flattens details into their JSON fields. Numbers are kept as
+// json.Number so that they can be compared and sent back out unchanged.
+func detailFields(d jobDetail) map[string]interface{} {
+	fields := make(map[string]interface{})
+	b, _ := json.Marshal(d)
+	decoder := json.NewDecoder(bytes.NewReader(b))
+	decoder.UseNumber()
+	decoder.Decode(&fields)
+	return fields
+}
+
+// diffTasks returns the window of tasks that changed, or nil if none did.
+func diffTasks(prev [][]int64, cur [][]int64) *taskWindow {
+	start := 0
+	for start < len(prev) && start < len(cur) && reflect.DeepEqual(prev[start], cur[start]) {
+		start++
+	}
+	if start == len(prev) && start == len(cur) {
+		return nil
+	}
+	return &taskWindow{Start: start, Pairs: append([][]int64{}, cur[start:]...)}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDiffJobs(t *testing.T) {
+	prev := &job{
+		Details:  jobDetail{ID: "job_1_0001", State: "RUNNING", MapsCompleted: 1, MapProgress: 10.5},
+		Counters: []counter{{Name: "MAP_INPUT_RECORDS", Total: 10, Map: 10}, {Name: "SPILLED_RECORDS", Total: 1}},
+		Tasks:    tasks{Map: [][]int64{{1, 2}, {3, 0}}, Reduce: [][]int64{{5, 0}}},
+		Cluster:  "a",
+	}
+	cur := snapshotJob(prev)
+	cur.Details.MapsCompleted = 2
+	cur.Details.MapProgress = 20.25
+	cur.Counters[0].Total = 20
+	cur.Counters = append(cur.Counters, counter{Name: "REDUCE_INPUT_RECORDS", Total: 5})
+	cur.Tasks.Map[1][1] = 4
+	cur.Tasks.Map = append(cur.Tasks.Map, []int64{4, 0})
+
+	assert.Equal(t, int64(0), prev.Tasks.Map[1][1], "snapshots shouldn't share tasks with the job")
+
+	b, err := json.Marshal(diffJobs(prev, cur))
+	require.NoError(t, err)
+	assert.JSONEq(t, `{
+		"id": "job_1_0001",
+		"cluster": "a",
+		"details": {"mapsCompleted": 2, "mapProgress": 20.25},
+		"counters": [
+			{"name": "MAP_INPUT_RECORDS", "total": 20, "map": 10, "reduce": 0},
+			{"name": "REDUCE_INPUT_RECORDS", "total": 5, "map": 0, "reduce": 0}
+		],
+		"maps": {"start": 1, "pairs": [[3, 4], [4, 0]]}
+	}`, string(b))
+
+	b, err = json.Marshal(diffJobs(cur, cur))
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"id": "job_1_0001", "cluster": "a"}`, string(b))
+}
+
+func TestSSEDeltas(t *testing.T) {
+	s := newSSE()
+	server := httptest.NewServer(s)
+	defer server.Close()
+
+	readEvents := func(url string, n int) []string {
+		resp, err := server.Client().Get(server.URL + url)
+		if !assert.NoError(t, err) {
+			return nil
+		}
+		defer resp.Body.Close()
+		reader := bufio.NewReader(resp.Body)
+
+		var types []string
+		for len(types) < n {
+			line, err := reader.ReadString('\n')
+			if !assert.NoError(t, err) {
+				break
+			}
+			if strings.HasPrefix(line, "event: ") {
+				types = append(types, strings.TrimSpace(line[len("event: "):]))
+			}
+		}
+		return types
+	}
+
+	deltas := make(chan []string)
+	full := make(chan []string)
+	go func() { deltas <- readEvents("/", 5) }()
+	go func() { full <- readEvents("/?format=full", 5) }()
+	for i := 0; i < 2; i++ {
+		s.add(<-s.addClient)
+	}
+	go s.Loop()
+
+	jt := newJobTracker("a", "", "", nil, nil)
+	go jt.sendUpdates(s)
+	running := func(maps int) *job {
+		return &job{Details: jobDetail{ID: "job_1_0001", State: "RUNNING", MapsCompleted: maps}, running: true}
+	}
+	jt.updates <- trackerEvent{typ: eventJobAdded, job: running(0)}
+	jt.updates <- trackerEvent{typ: eventJobUpdated, job: running(1)}
+	jt.updates <- trackerEvent{typ: eventJobUpdated, job: running(2)}
+	jt.updates <- trackerEvent{typ: eventJobFinished, job: &job{Details: jobDetail{ID: "job_1_0001", State: "SUCCEEDED"}}}
+	jt.updates <- trackerEvent{typ: eventJobUpdated, job: &job{Details: jobDetail{ID: "job_1_0001", State: "SUCCEEDED"}}}
+
+	assert.Equal(t, []string{eventJobAdded, eventJobDelta, eventJobDelta, eventJobFinished, eventJobUpdated}, <-deltas)
+	assert.Equal(t, []string{eventJobAdded, eventJobUpdated, eventJobUpdated, eventJobFinished, eventJobUpdated}, <-full)
+}
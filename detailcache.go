@@ -0,0 +1,96 @@
+package main
+
+import (
+	"container/list"
+	"flag"
+	"sync"
+
+	"golang.org/x/sync/singleflight"
+)
+
+var detailCacheSize = flag.Int("detail-cache-size", 100, "How many trimmed jobs per cluster to keep the full details of after they're loaded again to be viewed.")
+
+// detailCache keeps the full details of trimmed jobs after they've been
+// loaded from their history files, so that a job everyone is looking at only
+// costs one trip to HDFS. It's kept apart from the tracker's jobs, so that
+// cleanupLoop doesn't trim them again, and holds the most recently viewed
+// jobs up to a fixed number.
+type detailCache struct {
+	lock    sync.Mutex
+	size    int
+	entries map[jobID]*list.Element
+	order   *list.List
+
+	// Loads of the same job at the same time share one read.
+	loads singleflight.Group
+}
+
+type detailEntry struct {
+	id  jobID
+	job *job
+}
+
+func newDetailCache(size int) *detailCache {
+	return &detailCache{
+		size:    size,
+		entries: make(map[jobID]*list.Element),
+		order:   list.New(),
+	}
+}
+
+func (c *detailCache) get(id jobID) *job {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	e, ok := c.entries[id]
+	if !ok {
+		return nil
+	}
+	c.order.MoveToFront(e)
+	return e.Value.(*detailEntry).job
+}
+
+func (c *detailCache) add(id jobID, j *job) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if e, ok := c.entries[id]; ok {
+		e.Value.(*detailEntry).job = j
+		c.order.MoveToFront(e)
+		return
+	}
+	c.entries[id] = c.order.PushFront(&detailEntry{id: id, job: j})
+	for c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*detailEntry).id)
+	}
+}
+
+// load returns the cached details of a job, or loads them with f. It also
+// returns how they were found: hit if they were cached, shared if another
+// caller was loading them already, and miss if they had to be loaded.
+func (c *detailCache) load(id jobID, f func() (*job, error)) (*job, string, error) {
+	if j := c.get(id); j != nil {
+		return j, "hit", nil
+	}
+
+	loaded := false
+	v, err, _ := c.loads.Do(string(id), func() (interface{}, error) {
+		loaded = true
+		j, err := f()
+		if err != nil {
+			return nil, err
+		}
+		c.add(id, j)
+		return j, nil
+	})
+	result := "shared"
+	if loaded {
+		result = "miss"
+	}
+	if err != nil {
+		return nil, result, err
+	}
+	return v.(*job), result, nil
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// slowHistoryClient loads a counter into jobs once release is closed, and
+// counts how many times it's asked to.
+type slowHistoryClient struct {
+	hdfsJobHistoryClient
+	loads   int32
+	release chan struct{}
+}
+
+func (c *slowHistoryClient) updateFromHistoryFile(jt *jobTracker, j *job, full bool) error {
+	atomic.AddInt32(&c.loads, 1)
+	<-c.release
+	j.Counters = append(j.Counters, counter{Name: "loaded"})
+	j.partial = false
+	return nil
+}
+
+func TestDetailCacheLRU(t *testing.T) {
+	c := newDetailCache(2)
+	c.add("job_1_0001", &job{})
+	c.add("job_1_0002", &job{})
+	assert.NotNil(t, c.get("job_1_0001"))
+	c.add("job_1_0003", &job{})
+
+	assert.NotNil(t, c.get("job_1_0001"))
+	assert.Nil(t, c.get("job_1_0002"), "the least recently used job should be dropped")
+	assert.NotNil(t, c.get("job_1_0003"))
+}
+
+func TestReifyJobLoadsOnce(t *testing.T) {
+	history := &slowHistoryClient{release: make(chan struct{})}
+	jt := newJobTracker("detail", "", "", nil, history)
+	trimmed := &job{Details: jobDetail{ID: "job_1_0001", State: "SUCCEEDED"}, partial: true}
+	jt.saveJob(trimmed)
+
+	misses := metricValue(detailCacheRequestsMetric, "cluster", "detail", "result", "miss")
+	hits := metricValue(detailCacheRequestsMetric, "cluster", "detail", "result", "hit")
+
+	var wg sync.WaitGroup
+	reified := make([]*job, 5)
+	for i := range reified {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			reified[i] = jt.reifyJob(jt.getJob("job_1_0001"))
+		}(i)
+	}
+	for atomic.LoadInt32(&history.loads) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	close(history.release)
+	wg.Wait()
+
+	for _, j := range reified {
+		require.Len(t, j.Counters, 1)
+		assert.False(t, j.partial)
+		assert.Equal(t, "detail", j.Cluster)
+	}
+	assert.True(t, jt.getJob("job_1_0001") == trimmed, "the stored job should stay trimmed")
+	assert.Empty(t, trimmed.Counters)
+
+	// Later views use the cached details.
+	assert.Len(t, jt.reifyJob(trimmed).Counters, 1)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&history.loads), "concurrent views should share one load")
+	assert.Equal(t, misses+1, metricValue(detailCacheRequestsMetric, "cluster", "detail", "result", "miss"))
+	assert.True(t, metricValue(detailCacheRequestsMetric, "cluster", "detail", "result", "hit") > hits)
+}
+
+func metricValue(desc metricDesc, labels ...string) float64 {
+	metrics.lock.Lock()
+	defer metrics.lock.Unlock()
+	return metrics.values[desc.name][metricLabels(labels...)]
+}
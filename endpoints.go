@@ -0,0 +1,216 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/colinmarc/hdfs/v2"
+)
+
+// Separates the addresses of a service with high availability in flags,
+// since commas already separate clusters.
+const endpointSeparator = "|"
+
+// endpoints are the addresses of one of a cluster's services, like its
+// resource managers. Only one of them is active at a time: requests go to it,
+// and move on to the others when it fails.
+type endpoints struct {
+	cluster   string
+	service   string
+	addresses []string
+	auth      *hadoopAuth
+
+	// probe checks whether an address is up and active. If a request fails
+	// but the probe succeeds, the request itself was at fault and we don't
+	// fail over. Without a probe, any failure means the address is down.
+	probe func(client httpDoer, address string) error
+
+	lock   sync.Mutex
+	active int
+}
+
+// clusterEndpoints are all the services of a cluster.
+type clusterEndpoints struct {
+	ResourceManager *endpoints `json:"resourceManager"`
+	HistoryServer   *endpoints `json:"historyServer"`
+	Proxy           *endpoints `json:"proxy"`
+	Namenode        *endpoints `json:"namenode"`
+}
+
+func newEndpoints(cluster string, service string, addresses []string, auth *hadoopAuth, probe func(client httpDoer, address string) error) *endpoints {
+	e := &endpoints{
+		cluster:   cluster,
+		service:   service,
+		addresses: addresses,
+		auth:      auth,
+		probe:     probe,
+	}
+	for i, address := range e.addresses {
+		metrics.set(activeEndpointMetric, boolMetric(i == 0), "cluster", cluster, "service", service, "address", address)
+	}
+	return e
+}
+
+// splitEndpoints splits the addresses of a service given in a flag.
+func splitEndpoints(list string) []string {
+	return strings.Split(list, endpointSeparator)
+}
+
+// firstEndpoints takes the first address of each list, for the links we
+// show to users.
+func firstEndpoints(lists []string) []string {
+	first := make([]string, len(lists))
+	for i, list := range lists {
+		first[i] = splitEndpoints(list)[0]
+	}
+	return first
+}
+
+func boolMetric(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// get returns the active address.
+func (e *endpoints) get() string {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	return e.addresses[e.active]
+}
+
+func (e *endpoints) all() []string {
+	return e.addresses
+}
+
+// do calls f with the active address. If that fails, and the address looks
+// to be down, it fails over to the next address and tries again, until every
+// address has been tried.
+func (e *endpoints) do(f func(address string) error) error {
+	address := e.get()
+	err := f(address)
+	for tries := 1; err != nil && tries < len(e.addresses); tries++ {
+		if e.probe != nil && e.probe(e.auth.http, address) == nil {
+			return err
+		}
+		address = e.failover(address)
+		err = f(address)
+	}
+	return err
+}
+
+// failover moves on from a failed address to the first of the others that
+// passes the probe, or just the next one if none do. If another request has
+// already failed over, its choice is kept.
+func (e *endpoints) failover(failed string) string {
+	e.lock.Lock()
+	current := e.active
+	e.lock.Unlock()
+	if e.addresses[current] != failed {
+		return e.addresses[current]
+	}
+
+	next := (current + 1) % len(e.addresses)
+	if e.probe != nil {
+		for i := 1; i < len(e.addresses); i++ {
+			candidate := (current + i) % len(e.addresses)
+			if err := e.probe(e.auth.http, e.addresses[candidate]); err == nil {
+				next = candidate
+				break
+			}
+		}
+	}
+
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	if e.active != current {
+		return e.addresses[e.active]
+	}
+
+	log.Printf("Failing over %s in cluster %s from %s to %s\n", e.service, e.cluster, failed, e.addresses[next])
+	e.active = next
+	metrics.set(activeEndpointMetric, 0, "cluster", e.cluster, "service", e.service, "address", failed)
+	metrics.set(activeEndpointMetric, 1, "cluster", e.cluster, "service", e.service, "address", e.addresses[next])
+	return e.addresses[next]
+}
+
+func (e *endpoints) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Active    string   `json:"active"`
+		Addresses []string `json:"addresses"`
+	}{e.get(), e.addresses})
+}
+
+// probeResourceManager checks that a resource manager is the active one.
+// Standby resource managers still answer for their cluster info.
+func probeResourceManager(client httpDoer, address string) error {
+	info := &struct {
+		ClusterInfo struct {
+			HAState string `json:"haState"`
+		} `json:"clusterInfo"`
+	}{}
+	if _, err := getJSON(client, address+"/ws/v1/cluster/info", info); err != nil {
+		return err
+	}
+
+	// Resource managers without HA don't report a state.
+	if state := info.ClusterInfo.HAState; state != "" && state != "ACTIVE" {
+		return fmt.Errorf("resource manager %s is %s", address, state)
+	}
+	return nil
+}
+
+func probeHistoryServer(client httpDoer, address string) error {
+	info := &struct {
+		HistoryInfo struct {
+			StartedOn int64 `json:"startedOn"`
+		} `json:"historyInfo"`
+	}{}
+	_, err := getJSON(client, address+"/ws/v1/history/info", info)
+	return err
+}
+
+// probeHTTP checks that a server answers at all. The proxy forwards to
+// application masters, so any response at its root means it's up.
+func probeHTTP(client httpDoer, address string) error {
+	req, err := http.NewRequest("GET", address+"/", nil)
+	if err != nil {
+		return err
+	}
+
+	// Redirects count too, even though we don't follow them.
+	resp, err := client.Do(req)
+	if resp != nil {
+		resp.Body.Close()
+		return nil
+	}
+	return err
+}
+
+// connectNamenode connects to the active namenode.
+func connectNamenode(e *endpoints) (*hdfs.Client, error) {
+	var client *hdfs.Client
+	err := e.do(func(address string) error {
+		c, err := e.auth.connectHDFS(address)
+		if err != nil {
+			return err
+		}
+
+		// A standby namenode accepts connections, but refuses requests.
+		if len(e.addresses) > 1 {
+			if _, err := c.Stat("/"); err != nil {
+				c.Close()
+				return err
+			}
+		}
+
+		client = c
+		return nil
+	})
+	return client, err
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeResourceManager answers like a resource manager in the given HA state.
+// Standby resource managers redirect API requests to the active one.
+func fakeResourceManager(state *string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/ws/v1/cluster/info":
+			fmt.Fprintf(w, `{"clusterInfo": {"haState": %q}}`, *state)
+		case *state != "ACTIVE":
+			http.Redirect(w, r, "http://active/", 307)
+		case r.URL.Path == "/ws/v1/cluster/apps/":
+			fmt.Fprint(w, `{"apps": {"app": [{"id": "application_1_0001"}]}}`)
+		default:
+			w.WriteHeader(404)
+		}
+	}))
+}
+
+func TestResourceManagerFailover(t *testing.T) {
+	state1, state2 := "STANDBY", "ACTIVE"
+	rm1, rm2 := fakeResourceManager(&state1), fakeResourceManager(&state2)
+	defer rm1.Close()
+	defer rm2.Close()
+
+	auth := &hadoopAuth{http: newHTTPClient(time.Second)}
+	jc := newRecentJobClient("ha", []string{rm1.URL, rm2.URL}, []string{"http://hs"}, nil, []string{"nn1:8020", "nn2:8020"}, auth)
+	rm := jc.getEndpoints().ResourceManager
+	assert.Equal(t, rm, jc.getEndpoints().Proxy, "the proxy should default to the resource managers")
+	assert.Equal(t, []string{"nn1:8020", "nn2:8020"}, jc.getEndpoints().Namenode.all())
+
+	apps, err := jc.listJobs()
+	require.NoError(t, err, "requests should fail over to the active resource manager")
+	assert.Len(t, apps.Apps.App, 1)
+	assert.Equal(t, rm2.URL, rm.get())
+
+	// The active resource manager is fine, so a request it can't answer
+	// doesn't fail over.
+	_, err = jc.fetchAppDetails("application_1_0002")
+	assert.Error(t, err)
+	assert.Equal(t, rm2.URL, rm.get())
+
+	state1, state2 = "ACTIVE", "STANDBY"
+	_, err = jc.listJobs()
+	require.NoError(t, err, "requests should fail back when the resource managers switch")
+	assert.Equal(t, rm1.URL, rm.get())
+
+	var buf bytes.Buffer
+	metrics.writeTo(&buf)
+	assert.Contains(t, buf.String(), fmt.Sprintf(`timberlake_active_endpoint{cluster="ha",service="rm",address=%q} 1`, rm1.URL))
+	assert.Contains(t, buf.String(), fmt.Sprintf(`timberlake_active_endpoint{cluster="ha",service="rm",address=%q} 0`, rm2.URL))
+}
+
+func TestEndpointsWithoutProbe(t *testing.T) {
+	e := newEndpoints("noprobe", "namenode", []string{"nn1", "nn2", "nn3"}, nil, nil)
+
+	var tried []string
+	err := e.do(func(address string) error {
+		tried = append(tried, address)
+		if address == "nn3" {
+			return nil
+		}
+		return errors.New("down")
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"nn1", "nn2", "nn3"}, tried)
+	assert.Equal(t, "nn3", e.get())
+
+	tried = nil
+	err = e.do(func(address string) error {
+		tried = append(tried, address)
+		return errors.New("down")
+	})
+	assert.Error(t, err)
+	assert.Equal(t, []string{"nn3", "nn1", "nn2"}, tried, "every address should be tried once")
+}
@@ -0,0 +1,77 @@
+package main
+
+// The types of events sent to SSE clients. Each type has its own payload:
+//
+// job.added, job.updated and job.finished carry the job, in the same format as
+// /jobs/:id. A job is added the first time we see it, and finished when it
+// stops running.
+//
+// job.delta carries a jobDelta in place of a job.updated, to clients that
+// were sent the previous version of a running job. Clients that ask for
+// format=full never get them.
+//
+// job.removed carries a jobRef for a job we've stopped tracking, with the
+// reason why: "gone" if it disappeared from the resource manager without
+// reaching the history server, or "evicted" if it was dropped to stay under
+// the job limit.
+//
+// jobs.trimmed carries a trimmedJobs for the finished jobs in a cluster whose
+// tasks and counters were dropped from memory, all at once. They're loaded
+// again when a job is requested from /jobs/:id.
+//
+// cluster.status carries a clusterStatus when a poll of a resource manager
+// changes it. Its lastPoll doesn't count as a change.
+//
+// resync has an empty payload. It tells a reconnecting client that it missed
+// events that can't be replayed, so it has to reload the job list.
+const (
+	eventJobAdded      = "job.added"
+	eventJobUpdated    = "job.updated"
+	eventJobFinished   = "job.finished"
+	eventJobDelta      = "job.delta"
+	eventJobRemoved    = "job.removed"
+	eventJobsTrimmed   = "jobs.trimmed"
+	eventClusterStatus = "cluster.status"
+	eventResync        = "resync"
+)
+
+// Reasons for removing a job.
+const (
+	removedGone    = "gone"
+	removedEvicted = "evicted"
+)
+
+// trackerEvent is something that happened in a job tracker, on its way to
+// SSE clients.
+type trackerEvent struct {
+	typ     string
+	job     *job
+	reason  string
+	status  *clusterStatus
+	trimmed []string
+}
+
+type jobRef struct {
+	ID      string `json:"id"`
+	Cluster string `json:"cluster"`
+	Reason  string `json:"reason,omitempty"`
+}
+
+type trimmedJobs struct {
+	Cluster string   `json:"cluster"`
+	IDs     []string `json:"ids"`
+}
+
+type clusterStatus struct {
+	Cluster     string `json:"cluster"`
+	OK          bool   `json:"ok"`
+	Error       string `json:"error,omitempty"`
+	RunningJobs int    `json:"runningJobs"`
+	TrackedJobs int    `json:"trackedJobs"`
+
+	// When the resource manager was last polled successfully, in
+	// milliseconds.
+	LastPoll int64 `json:"lastPoll"`
+
+	HDFS *hdfsStatus `json:"hdfs,omitempty"`
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/colinmarc/hdfs/v2"
+)
+
+// jobFS is the handful of filesystem operations fsJobClient needs, so that
+// jobs can be kept on either a local filesystem or HDFS.
+type jobFS interface {
+	readFile(name string) ([]byte, error)
+	writeFile(name string, data []byte) error
+	readDir(name string) ([]os.FileInfo, error)
+}
+
+// fsJobClient keeps jobs in a directory tree with the same layout as the S3
+// bucket:
+//
+//	<root>/<jobsPrefix>/<jobid>.json
+//	<root>/<flowPrefix>/<flowid>/<jobid>.json
+type fsJobClient struct {
+	fs         jobFS
+	root       string
+	jobsPrefix string
+	flowPrefix string
+}
+
+func (client *fsJobClient) jobPath(id string) string {
+	return path.Join(client.root, client.jobsPrefix, id+".json")
+}
+
+func (client *fsJobClient) flowPath(flowID string) string {
+	return path.Join(client.root, client.flowPrefix, flowID)
+}
+
+func (client *fsJobClient) FetchJob(id string) (*job, error) {
+	jsonBytes, err := client.fs.readFile(client.jobPath(id))
+	if err != nil {
+		return nil, err
+	}
+
+	data := &S3JobDetail{}
+	if err := json.Unmarshal(jsonBytes, data); err != nil {
+		return nil, err
+	}
+
+	return s3responseToJob(data), nil
+}
+
+func (client *fsJobClient) FetchFlowJobIds(flowID string) ([]string, error) {
+	infos, err := client.fs.readDir(client.flowPath(flowID))
+	if os.IsNotExist(err) {
+		return []string{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	ids := make([]string, 0, len(infos))
+	for _, info := range infos {
+		if !info.IsDir() && strings.HasSuffix(info.Name(), ".json") {
+			ids = append(ids, parseJobIDFromKey(info.Name()))
+		}
+	}
+
+	return ids, nil
+}
+
+func (client *fsJobClient) StoreJob(job *job) error {
+	data := jobToS3Response(job)
+	jsonBytes, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+
+	if err := client.fs.writeFile(client.jobPath(data.ID), jsonBytes); err != nil {
+		return err
+	}
+
+	if flowID := data.Conf["cascading.flow.id"]; flowID != "" {
+		return client.fs.writeFile(path.Join(client.flowPath(flowID), data.ID+".json"), jsonBytes)
+	}
+	return nil
+}
+
+// localFS is a jobFS on the local filesystem.
+type localFS struct{}
+
+func (localFS) readFile(name string) ([]byte, error) {
+	return ioutil.ReadFile(filepath.FromSlash(name))
+}
+
+// writeFile writes to a temporary file first, so that readers never see a
+// partially written job.
+func (localFS) writeFile(name string, data []byte) error {
+	name = filepath.FromSlash(name)
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		return err
+	}
+
+	tmp := name + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, name)
+}
+
+func (localFS) readDir(name string) ([]os.FileInfo, error) {
+	return ioutil.ReadDir(filepath.FromSlash(name))
+}
+
+// hdfsFS is a jobFS on HDFS.
+type hdfsFS struct {
+	pool *hdfsPool
+}
+
+func (fs hdfsFS) readFile(name string) ([]byte, error) {
+	var data []byte
+	err := fs.pool.do(func(client *hdfs.Client) error {
+		var err error
+		data, err = client.ReadFile(name)
+		return err
+	})
+	return data, err
+}
+
+// writeFile writes to a temporary file first, so that readers never see a
+// partially written job. HDFS won't rename over an existing file, so any
+// previous version is removed first.
+func (fs hdfsFS) writeFile(name string, data []byte) error {
+	return fs.pool.do(func(client *hdfs.Client) error {
+		if err := client.MkdirAll(path.Dir(name), 0755); err != nil {
+			return err
+		}
+
+		tmp := name + ".tmp"
+		if err := client.Remove(tmp); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+
+		w, err := client.Create(tmp)
+		if err != nil {
+			return err
+		}
+		if _, err := w.Write(data); err != nil {
+			w.Close()
+			return err
+		}
+		if err := w.Close(); err != nil {
+			return err
+		}
+
+		if err := client.Remove(name); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return client.Rename(tmp, name)
+	})
+}
+
+func (fs hdfsFS) readDir(name string) ([]os.FileInfo, error) {
+	var infos []os.FileInfo
+	err := fs.pool.do(func(client *hdfs.Client) error {
+		var err error
+		infos, err = client.ReadDir(name)
+		return err
+	})
+	return infos, err
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"log"
+	"sync"
+
+	"github.com/colinmarc/hdfs/v2"
+)
+
+var hdfsReads = flag.Int("hdfs-reads", 8, "How many reads from each cluster's HDFS, like history files and logs, can run at once.")
+
+var errHDFSPoolClosed = errors.New("the cluster's HDFS connection was closed")
+var errNoHDFS = errors.New("the cluster has no HDFS")
+
+// hdfsPool shares a namenode connection between everything that reads a
+// cluster's HDFS, instead of connecting for each read. It connects when it's
+// first needed, and again whenever the connection breaks. The number of reads
+// going on at once is limited, so that a backfill can't swamp the namenode.
+type hdfsPool struct {
+	namenodes *endpoints
+	reads     chan struct{}
+
+	lock       sync.Mutex
+	client     *hdfs.Client
+	lastError  error
+	reconnects int
+	closed     bool
+}
+
+// hdfsStatus is how a cluster's HDFS connection is doing, for its
+// cluster.status events.
+type hdfsStatus struct {
+	Connected  bool   `json:"connected"`
+	Namenode   string `json:"namenode"`
+	Error      string `json:"error,omitempty"`
+	Reconnects int    `json:"reconnects"`
+	Reads      int    `json:"reads"`
+}
+
+func newHDFSPool(namenodes *endpoints, maxReads int) *hdfsPool {
+	return &hdfsPool{
+		namenodes: namenodes,
+		reads:     make(chan struct{}, maxReads),
+	}
+}
+
+// do calls f with the cluster's client, once there are few enough reads
+// going on. If f fails because the connection broke, it reconnects and calls
+// f again. A nil pool, for a cluster without HDFS, fails every read.
+func (p *hdfsPool) do(f func(client *hdfs.Client) error) error {
+	if p == nil {
+		return errNoHDFS
+	}
+	p.reads <- struct{}{}
+	defer func() { <-p.reads }()
+
+	client, err := p.get()
+	if err != nil {
+		return err
+	}
+	err = f(client)
+	if err == nil || healthy(client) {
+		return err
+	}
+
+	log.Printf("Reconnecting to HDFS in cluster %s after: %s\n", p.namenodes.cluster, err)
+	p.drop(client, err)
+	if client, err = p.get(); err != nil {
+		return err
+	}
+	err = f(client)
+	if err != nil && !healthy(client) {
+		p.drop(client, err)
+	}
+	return err
+}
+
+// get returns the current client, connecting first if there isn't one.
+func (p *hdfsPool) get() (*hdfs.Client, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.closed {
+		return nil, errHDFSPoolClosed
+	}
+	if p.client == nil {
+		client, err := connectNamenode(p.namenodes)
+		if err != nil {
+			p.lastError = err
+			return nil, err
+		}
+		p.client, p.lastError = client, nil
+	}
+	return p.client, nil
+}
+
+// healthy checks whether a request failed because of the request, or
+// because the connection did. The client closes its connection after any
+// error that doesn't come from the namenode, and a namenode that's gone into
+// standby refuses everything.
+func healthy(client *hdfs.Client) bool {
+	_, err := client.Stat("/")
+	return err == nil
+}
+
+// drop closes a broken client, unless it's already been replaced.
+func (p *hdfsPool) drop(client *hdfs.Client, err error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.client != client {
+		return
+	}
+	client.Close()
+	p.client = nil
+	p.lastError = err
+	p.reconnects++
+}
+
+func (p *hdfsPool) status() *hdfsStatus {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	status := &hdfsStatus{
+		Connected:  p.client != nil,
+		Namenode:   p.namenodes.get(),
+		Reconnects: p.reconnects,
+		Reads:      len(p.reads),
+	}
+	if p.lastError != nil {
+		status.Error = p.lastError.Error()
+	}
+	return status
+}
+
+// Close closes the connection, and fails any reads from then on.
+func (p *hdfsPool) Close() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.client != nil {
+		p.client.Close()
+		p.client = nil
+	}
+	p.closed = true
+}
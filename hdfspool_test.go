@@ -0,0 +1,89 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/colinmarc/hdfs/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeNamenode accepts connections, but hangs up on them as soon as the
+// client goes quiet after its handshake, without answering any requests.
+func fakeNamenode(t *testing.T) (net.Listener, *int32) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	var accepted int32
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&accepted, 1)
+			go func() {
+				conn.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+				io.Copy(ioutil.Discard, conn)
+				conn.Close()
+			}()
+		}
+	}()
+	return l, &accepted
+}
+
+func TestHDFSPoolReconnects(t *testing.T) {
+	l, accepted := fakeNamenode(t)
+	defer l.Close()
+	pool := newHDFSPool(newEndpoints("pool", "namenode", []string{l.Addr().String()}, &hadoopAuth{}, nil), 2)
+	defer pool.Close()
+
+	err := pool.do(func(client *hdfs.Client) error {
+		time.Sleep(100 * time.Millisecond)
+		_, err := client.Stat("/")
+		return err
+	})
+	assert.Error(t, err)
+	assert.Equal(t, int32(2), atomic.LoadInt32(accepted), "a broken connection should be replaced and the read tried again")
+
+	status := pool.status()
+	assert.False(t, status.Connected)
+	assert.Equal(t, l.Addr().String(), status.Namenode)
+	assert.Equal(t, 2, status.Reconnects)
+	assert.NotEmpty(t, status.Error)
+}
+
+func TestHDFSPoolLimitsReads(t *testing.T) {
+	l, accepted := fakeNamenode(t)
+	defer l.Close()
+	pool := newHDFSPool(newEndpoints("pool", "namenode", []string{l.Addr().String()}, &hadoopAuth{}, nil), 2)
+
+	var reading, most int32
+	var wg sync.WaitGroup
+	for i := 0; i < 6; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			pool.do(func(client *hdfs.Client) error {
+				n := atomic.AddInt32(&reading, 1)
+				for m := atomic.LoadInt32(&most); n > m && !atomic.CompareAndSwapInt32(&most, m, n); m = atomic.LoadInt32(&most) {
+				}
+				time.Sleep(10 * time.Millisecond)
+				atomic.AddInt32(&reading, -1)
+				return nil
+			})
+		}()
+	}
+	wg.Wait()
+	assert.True(t, atomic.LoadInt32(&most) <= 2, "at most two reads should run at once")
+	assert.Equal(t, int32(1), atomic.LoadInt32(accepted), "reads should share a connection")
+
+	pool.Close()
+	assert.Equal(t, errHDFSPoolClosed, pool.do(func(client *hdfs.Client) error { return nil }))
+}
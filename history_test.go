@@ -2,6 +2,8 @@ package main
 
 import (
 	"os"
+	"sort"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -52,3 +54,44 @@ func TestLoadHistory(t *testing.T) {
 	assert.Equal(t, 480, counters["FileSystemCounter.HDFS_BYTES_READ"].Map, "the FileSystemCounter.HDFS_BYTES_READ counter for maps should be correct")
 	assert.Equal(t, 0, counters["FileSystemCounter.HDFS_BYTES_READ"].Reduce, "the FileSystemCounter.HDFS_BYTES_READ counter for reduces should be correct")
 }
+
+func TestLoadBinaryHistory(t *testing.T) {
+	jsonJob := job{}
+	f, err := os.Open("test/sleepjob.jhist")
+	require.NoError(t, err, "test jhist file should load")
+	require.NoError(t, loadHistFile(f, &jsonJob, true), "loading from a json hist file should work")
+
+	binaryJob := job{}
+	f, err = os.Open("test/sleepjob-binary.jhist")
+	require.NoError(t, err, "binary test jhist file should load")
+	require.NoError(t, loadHistFile(f, &binaryJob, true), "loading from a binary hist file should work")
+
+	// Attempts are kept in a map, so their order isn't stable.
+	for _, j := range []*job{&jsonJob, &binaryJob} {
+		sort.Sort(countersByName(j.Counters))
+		sort.Sort(taskListByStartTime(j.Tasks.Map))
+		sort.Sort(taskListByStartTime(j.Tasks.Reduce))
+	}
+
+	assert.Equal(t, jsonJob, binaryJob, "both encodings should load the same job")
+}
+
+type countersByName []counter
+
+func (cs countersByName) Len() int {
+	return len(cs)
+}
+
+func (cs countersByName) Swap(i, j int) {
+	cs[i], cs[j] = cs[j], cs[i]
+}
+
+func (cs countersByName) Less(i, j int) bool {
+	return cs[i].Name < cs[j].Name
+}
+
+func TestLoadHistoryInvalidHeader(t *testing.T) {
+	job := job{}
+	err := loadHistFile(strings.NewReader("Avro-Yaml\n{}\n"), &job, true)
+	assert.Error(t, err, "unknown encodings should be rejected")
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"sync"
+	"time"
+)
+
+var (
+	// historyIndexTTL is how long a directory's listing is trusted before
+	// it's listed again.
+	historyIndexTTL = time.Minute
+
+	// historyIndexDays is how many days either side of a job's finish time
+	// are listed when it isn't in any of the likely directories.
+	historyIndexDays = 3
+
+	// historyRetryDelays are how long to wait before looking for a job's
+	// files again, when it finished within historyRetryWindow. The history
+	// server can take a while to write them, and then to move them, so the
+	// likely done directories are listed again for those jobs once their
+	// listing is historyRetryDelays[0] old.
+	historyRetryDelays = []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second}
+	historyRetryWindow = 15 * time.Minute
+)
+
+// dirReader lists directories. localFS and hdfsFS are both dirReaders.
+type dirReader interface {
+	readDir(name string) ([]os.FileInfo, error)
+}
+
+// historyLocator finds jobs' history files in a history server's
+// directories. The history server writes a job's files to
+// done_intermediate/<user> when it finishes, and moves them a few minutes
+// later to a done directory dated in its own timezone. So a job is looked for
+//
+//	in the done directories for its finish date, in local time and UTC, and
+//	the days either side;
+//	in done_intermediate/<user>;
+//	in the done directories for the days around those, which are indexed
+//	along with every other directory that's been listed.
+//
+// Jobs that only just finished are looked for again by the tracker, with
+// backoff.
+type historyLocator struct {
+	fs              dirReader
+	doneDir         string
+	intermediateDir string
+	index           *historyIndex
+}
+
+// newHistoryLocator looks for files under doneDir and intermediateDir.
+// Without an intermediateDir, it's the done directory's done_intermediate
+// sibling, which is where Hadoop keeps it by default.
+func newHistoryLocator(fs dirReader, doneDir, intermediateDir string) *historyLocator {
+	if intermediateDir == "" {
+		intermediateDir = path.Join(path.Dir(doneDir), "done_intermediate")
+	}
+	return &historyLocator{
+		fs:              fs,
+		doneDir:         doneDir,
+		intermediateDir: intermediateDir,
+		index:           newHistoryIndex(),
+	}
+}
+
+func (l *historyLocator) find(id jobID, user string, finishTime int64) (string, string, error) {
+	// A job that only just finished may have been moved since its likely
+	// directories were listed.
+	ttl := historyIndexTTL
+	if time.Since(time.Unix(finishTime/1000, 0)) < historyRetryWindow {
+		ttl = historyRetryDelays[0]
+	}
+
+	if confFile, histFile, ok := l.search(id, user, finishTime, ttl); ok {
+		return confFile, histFile, nil
+	}
+	return "", "", fmt.Errorf("no matching files found under %s or %s", l.doneDir, l.intermediateDir)
+}
+
+// search makes one pass over the places a job's files could be. The likely
+// done directories are listed again if the index's listing is ttl old.
+func (l *historyLocator) search(id jobID, user string, finishTime int64, ttl time.Duration) (string, string, bool) {
+	if files, ok := l.index.lookup(id); ok {
+		return files.conf, files.hist, true
+	}
+
+	for _, dir := range historyFileDirs(l.doneDir, id, finishTime, 1) {
+		l.list(dir, ttl)
+		if files, ok := l.index.lookup(id); ok {
+			return files.conf, files.hist, true
+		}
+	}
+
+	// Files only stay in done_intermediate for a few minutes, so it isn't
+	// indexed.
+	if user != "" {
+		dir := path.Join(l.intermediateDir, user)
+		if infos, err := l.fs.readDir(dir); err == nil {
+			if confFile, histFile, err := matchHistoryFiles(dir, id, infos); err == nil {
+				return confFile, histFile, true
+			}
+		} else if !os.IsNotExist(err) {
+			log.Printf("Couldn't list %s: %s\n", dir, err)
+		}
+	}
+
+	for _, dir := range historyFileDirs(l.doneDir, id, finishTime, historyIndexDays) {
+		l.list(dir, historyIndexTTL)
+		if files, ok := l.index.lookup(id); ok {
+			return files.conf, files.hist, true
+		}
+	}
+	return "", "", false
+}
+
+// list adds a directory's files to the index, unless it was listed within
+// ttl.
+func (l *historyLocator) list(dir string, ttl time.Duration) {
+	now := time.Now()
+	if l.index.fresh(dir, now, ttl) {
+		return
+	}
+
+	infos, err := l.fs.readDir(dir)
+	if err != nil && !os.IsNotExist(err) {
+		log.Printf("Couldn't list %s: %s\n", dir, err)
+		return
+	}
+	l.index.add(dir, infos, now)
+}
+
+// historyFiles are the paths of a job's conf and history files.
+type historyFiles struct {
+	conf string
+	hist string
+}
+
+// historyIndex remembers the history files in every done directory that's
+// been listed, so that a directory with a thousand jobs in it is listed once,
+// not once for each of them. A directory's files are forgotten when its
+// listing is historyIndexTTL old, so the index only holds the directories
+// that are being looked in.
+type historyIndex struct {
+	lock   sync.Mutex
+	listed map[string]time.Time
+	dirs   map[string][]jobID
+	jobs   map[jobID]historyFiles
+}
+
+func newHistoryIndex() *historyIndex {
+	return &historyIndex{
+		listed: make(map[string]time.Time),
+		dirs:   make(map[string][]jobID),
+		jobs:   make(map[jobID]historyFiles),
+	}
+}
+
+// lookup returns a job's files, if both have been seen.
+func (x *historyIndex) lookup(id jobID) (historyFiles, bool) {
+	x.lock.Lock()
+	defer x.lock.Unlock()
+
+	x.prune(time.Now())
+	files, ok := x.jobs[id]
+	return files, ok && files.conf != "" && files.hist != ""
+}
+
+// fresh is whether a directory was listed within ttl of now.
+func (x *historyIndex) fresh(dir string, now time.Time, ttl time.Duration) bool {
+	x.lock.Lock()
+	defer x.lock.Unlock()
+
+	listed, ok := x.listed[dir]
+	return ok && now.Sub(listed) < ttl
+}
+
+// add records a directory's listing, in place of any earlier one. A
+// directory that doesn't exist has no files.
+func (x *historyIndex) add(dir string, infos []os.FileInfo, now time.Time) {
+	x.lock.Lock()
+	defer x.lock.Unlock()
+
+	x.prune(now)
+	x.forget(dir)
+	x.listed[dir] = now
+	for _, info := range infos {
+		id, conf, ok := historyFileJob(info.Name())
+		if !ok {
+			continue
+		}
+
+		files := x.jobs[id]
+		if conf {
+			files.conf = path.Join(dir, info.Name())
+		} else {
+			files.hist = path.Join(dir, info.Name())
+		}
+		x.jobs[id] = files
+		x.dirs[dir] = append(x.dirs[dir], id)
+	}
+}
+
+// prune forgets the directories whose listings have expired. The caller has
+// to hold the lock.
+func (x *historyIndex) prune(now time.Time) {
+	for dir, listed := range x.listed {
+		if now.Sub(listed) >= historyIndexTTL {
+			x.forget(dir)
+		}
+	}
+}
+
+// forget drops a directory's listing, and the files in it. A job's other file
+// can be in another directory, if it was moved around midnight, and is kept.
+// The caller has to hold the lock.
+func (x *historyIndex) forget(dir string) {
+	for _, id := range x.dirs[dir] {
+		files := x.jobs[id]
+		if path.Dir(files.conf) == path.Clean(dir) {
+			files.conf = ""
+		}
+		if path.Dir(files.hist) == path.Clean(dir) {
+			files.hist = ""
+		}
+		if files.conf == "" && files.hist == "" {
+			delete(x.jobs, id)
+		} else {
+			x.jobs[id] = files
+		}
+	}
+	delete(x.dirs, dir)
+	delete(x.listed, dir)
+}
+
+// historyFileDirs returns the done directories a job's files could have been
+// moved to, most likely first: the ones for its finish date in local time and
+// in UTC, then the ones for up to days either side of it. The history server
+// dates them in its own timezone, which needn't be ours, and by when it moved
+// them, which can be after midnight.
+func historyFileDirs(doneDir string, id jobID, finishTime int64, days int) []string {
+	finished := time.Unix(finishTime/1000, 0)
+	seen := make(map[string]bool)
+	var dirs []string
+	for d := 0; d <= days; d++ {
+		for _, offset := range []int{d, -d} {
+			for _, loc := range []*time.Location{time.Local, time.UTC} {
+				dir := historyFileDir(doneDir, id, finished.AddDate(0, 0, offset).In(loc))
+				if !seen[dir] {
+					seen[dir] = true
+					dirs = append(dirs, dir)
+				}
+			}
+		}
+	}
+	return dirs
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+// countingFS is a local dirReader that counts how often each directory is
+// listed.
+type countingFS struct {
+	lock   sync.Mutex
+	counts map[string]int
+}
+
+func (fs *countingFS) readDir(name string) ([]os.FileInfo, error) {
+	fs.lock.Lock()
+	fs.counts[name]++
+	fs.lock.Unlock()
+
+	return (localFS{}).readDir(name)
+}
+
+func (fs *countingFS) count(name string) int {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	return fs.counts[name]
+}
+
+// touchHistoryFiles creates empty history files for a job.
+func touchHistoryFiles(t *testing.T, dir string, id jobID) {
+	require.NoError(t, os.MkdirAll(filepath.FromSlash(dir), 0755))
+	for _, name := range []string{string(id) + "_conf.xml", string(id) + "-1-user-job-2-1-0-SUCCEEDED-default.jhist"} {
+		require.NoError(t, ioutil.WriteFile(filepath.Join(filepath.FromSlash(dir), name), nil, 0644))
+	}
+}
+
+func TestHistoryFileDirs(t *testing.T) {
+	finished := time.Date(2020, 3, 1, 23, 30, 0, 0, time.UTC)
+	dirs := historyFileDirs("/done", "job_1_12345", finished.Unix()*1000, 1)
+
+	assert.Equal(t, historyFileDir("/done", "job_1_12345", finished.In(time.Local)), dirs[0])
+	assert.Contains(t, dirs[:2], "/done/2020/03/01/000012")
+	assert.Contains(t, dirs, "/done/2020/03/02/000012")
+	assert.Contains(t, dirs, "/done/2020/02/29/000012")
+	assert.True(t, len(dirs) <= 6)
+}
+
+func TestHistoryLocator(t *testing.T) {
+	root, err := ioutil.TempDir("", "timberlake-history")
+	require.NoError(t, err)
+	defer os.RemoveAll(root)
+
+	finished := time.Date(2020, 3, 1, 12, 0, 0, 0, time.UTC)
+	finishTime := finished.Unix() * 1000
+	done := path.Join(filepath.ToSlash(root), "done")
+	fs := &countingFS{counts: make(map[string]int)}
+	l := newHistoryLocator(fs, done, "")
+	assert.Equal(t, path.Join(filepath.ToSlash(root), "done_intermediate"), l.intermediateDir)
+
+	// Moved after midnight.
+	nextDay := historyFileDir(done, "job_1_0001", finished.AddDate(0, 0, 1).In(time.UTC))
+	touchHistoryFiles(t, nextDay, "job_1_0001")
+	touchHistoryFiles(t, nextDay, "job_1_0002")
+	confFile, histFile, err := l.find("job_1_0001", "alice", finishTime)
+	require.NoError(t, err)
+	assert.Equal(t, nextDay+"/job_1_0001_conf.xml", confFile)
+	assert.Contains(t, histFile, nextDay+"/job_1_0001-")
+
+	// Other jobs in a directory that's been listed come from the index.
+	listings := fs.count(nextDay)
+	_, _, err = l.find("job_1_0002", "alice", finishTime)
+	require.NoError(t, err)
+	assert.Equal(t, listings, fs.count(nextDay))
+
+	// Well away from its finish date.
+	later := historyFileDir(done, "job_1_0004", finished.AddDate(0, 0, 3).In(time.UTC))
+	touchHistoryFiles(t, later, "job_1_0004")
+	_, _, err = l.find("job_1_0004", "alice", finishTime)
+	assert.NoError(t, err)
+
+	// Not moved yet.
+	touchHistoryFiles(t, path.Join(done+"_intermediate", "alice"), "job_1_0003")
+	confFile, _, err = l.find("job_1_0003", "alice", finishTime)
+	require.NoError(t, err)
+	assert.Equal(t, done+"_intermediate/alice/job_1_0003_conf.xml", confFile)
+	_, _, err = l.find("job_1_0003", "", finishTime)
+	assert.Error(t, err, "done_intermediate needs the job's user")
+
+	start := time.Now()
+	_, _, err = l.find("job_1_0005", "alice", finishTime)
+	assert.Error(t, err)
+	assert.True(t, time.Since(start) < time.Second, "jobs that finished long ago shouldn't be looked for again")
+}
+
+func TestHistoryLocatorRecentJobs(t *testing.T) {
+	defer func(saved []time.Duration) { historyRetryDelays = saved }(historyRetryDelays)
+	historyRetryDelays = []time.Duration{10 * time.Millisecond}
+
+	root, err := ioutil.TempDir("", "timberlake-history")
+	require.NoError(t, err)
+	defer os.RemoveAll(root)
+
+	done := path.Join(filepath.ToSlash(root), "done")
+	fs := &countingFS{counts: make(map[string]int)}
+	l := newHistoryLocator(fs, done, "")
+
+	finished := time.Now()
+	dir := historyFileDir(done, "job_1_0001", finished)
+	_, _, err = l.find("job_1_0001", "alice", finished.Unix()*1000)
+	assert.Error(t, err, "files that haven't been moved yet shouldn't be found")
+
+	// Once they've been moved, the job's likely directories are listed
+	// again long before the index expires.
+	touchHistoryFiles(t, dir, "job_1_0001")
+	time.Sleep(historyRetryDelays[0])
+	confFile, _, err := l.find("job_1_0001", "alice", finished.Unix()*1000)
+	require.NoError(t, err)
+	assert.Equal(t, dir+"/job_1_0001_conf.xml", confFile)
+}
+
+func TestFinishedJobRetries(t *testing.T) {
+	defer func(saved []time.Duration) { historyRetryDelays = saved }(historyRetryDelays)
+	historyRetryDelays = []time.Duration{10 * time.Millisecond, time.Hour}
+
+	client := new(mockJobClient)
+	client.On("listFinishedJobs", mock.AnythingOfType("time.Time")).Return(&jobsResp{}, nil)
+	history := &recordingHistoryClient{failing: map[string]int{"job_1_0001": 100, "job_1_0002": 100, "job_1_0003": 100, "job_1_0004": 1}}
+	jt := newJobTracker("foo", "", "", client, history)
+	jt.config.PollInterval = time.Hour
+	jt.start(jt.finishedJobLoop)
+	defer jt.Stop()
+
+	// There are as many jobs whose files never turn up as workers, and
+	// their backoff shouldn't hold up the jobs after them.
+	finishTime := time.Now().Unix() * 1000
+	for _, id := range []string{"job_1_0001", "job_1_0002", "job_1_0003", "job_1_0004", "job_1_0005"} {
+		require.True(t, jt.queue(jt.finished, &job{Details: jobDetail{ID: id, State: "SUCCEEDED", FinishTime: finishTime}}))
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !(jt.hasJob("job_1_0004") && jt.hasJob("job_1_0005")) && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.True(t, jt.hasJob("job_1_0005"), "jobs should be loaded while others back off")
+	assert.True(t, jt.hasJob("job_1_0004"), "jobs that only just finished should be looked for again")
+	assert.False(t, jt.hasJob("job_1_0001"))
+}
+
+func TestHistoryIndexExpiry(t *testing.T) {
+	root, err := ioutil.TempDir("", "timberlake-history")
+	require.NoError(t, err)
+	defer os.RemoveAll(root)
+
+	dir := filepath.ToSlash(root)
+	touchHistoryFiles(t, dir, "job_1_0001")
+	infos, err := (localFS{}).readDir(dir)
+	require.NoError(t, err)
+
+	x := newHistoryIndex()
+	now := time.Now()
+	x.add(dir, infos, now)
+	_, ok := x.lookup("job_1_0001")
+	assert.True(t, ok)
+
+	x.add(dir+"/other", nil, now.Add(historyIndexTTL))
+	_, ok = x.lookup("job_1_0001")
+	assert.False(t, ok, "jobs should be forgotten along with their directory")
+	assert.Len(t, x.listed, 1)
+	assert.Len(t, x.dirs, 0)
+}
+
+func TestHistoryIndexSplitFiles(t *testing.T) {
+	root, err := ioutil.TempDir("", "timberlake-history")
+	require.NoError(t, err)
+	defer os.RemoveAll(root)
+
+	// The history file was moved into one day's directory, and the conf file
+	// into the next's.
+	before, after := filepath.ToSlash(root)+"/2020/03/01/000000", filepath.ToSlash(root)+"/2020/03/02/000000"
+	touchHistoryFiles(t, before, "job_1_0001")
+	touchHistoryFiles(t, after, "job_1_0002")
+	require.NoError(t, os.Rename(filepath.Join(filepath.FromSlash(before), "job_1_0001_conf.xml"), filepath.Join(filepath.FromSlash(after), "job_1_0001_conf.xml")))
+
+	x := newHistoryIndex()
+	now := time.Now()
+	for _, dir := range []string{before, after} {
+		infos, err := (localFS{}).readDir(dir)
+		require.NoError(t, err)
+		x.add(dir, infos, now)
+	}
+	files, ok := x.lookup("job_1_0001")
+	require.True(t, ok, "files split across directories should be paired up")
+	assert.Equal(t, after+"/job_1_0001_conf.xml", files.conf)
+
+	// Listing either directory again keeps the file from the other.
+	for _, dir := range []string{before, after} {
+		infos, err := (localFS{}).readDir(dir)
+		require.NoError(t, err)
+		x.add(dir, infos, now.Add(time.Second))
+		_, ok = x.lookup("job_1_0001")
+		assert.True(t, ok, "relisting %s shouldn't forget the other directory's file", dir)
+	}
+
+	// Expiring one directory only forgets its own file.
+	infos, err := (localFS{}).readDir(after)
+	require.NoError(t, err)
+	x.add(after, infos, now.Add(historyIndexTTL+time.Second))
+	files = x.jobs["job_1_0001"]
+	assert.Equal(t, historyFiles{conf: after + "/job_1_0001_conf.xml"}, files)
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/colinmarc/hdfs/v2"
+)
+
+// historySource is where finished jobs' .jhist and _conf.xml files are kept,
+// in the layout of the history server's done directory.
+type historySource interface {
+	// find returns the paths of a job's conf and history files. user is who
+	// ran the job, and finishTime is in milliseconds.
+	find(id jobID, user string, finishTime int64) (confFile string, histFile string, err error)
+
+	// read calls f with the contents of a file that find returned. f may be
+	// called again if reading fails partway through.
+	read(name string, f func(r io.Reader) error) error
+}
+
+// newHistorySource reads history files from the cluster's HDFS, or from a
+// local directory if historyDir is a file:// URL. intermediateDir is only
+// used for HDFS.
+func newHistorySource(historyDir, intermediateDir string, pool *hdfsPool) historySource {
+	if strings.HasPrefix(historyDir, "file://") {
+		return newLocalHistorySource(strings.TrimPrefix(historyDir, "file://"))
+	}
+	return hdfsHistorySource{pool: pool, historyLocator: newHistoryLocator(hdfsFS{pool: pool}, historyDir, intermediateDir)}
+}
+
+// historyFileDir returns the directory under the done directory that a job's
+// files are moved to if they're dated t: done/YYYY/MM/DD/serial, where the
+// serial is the job's sequence number over 1000.
+func historyFileDir(historyDir string, id jobID, t time.Time) string {
+	parts := strings.Split(string(id), "_")
+	sort, _ := strconv.ParseInt(parts[len(parts)-1], 10, 0)
+	return fmt.Sprintf("%s/%04d/%02d/%02d/%06d",
+		historyDir, t.Year(), t.Month(), t.Day(), sort/1000)
+}
+
+// historyFileJob returns the job a file in a done directory belongs to, and
+// whether it's the job's conf file or its history file. The history file's
+// name starts with the job ID and a dash, and the conf file is named after
+// the job.
+func historyFileJob(name string) (id jobID, conf bool, ok bool) {
+	if strings.HasSuffix(name, "_conf.xml") {
+		return jobID(strings.TrimSuffix(name, "_conf.xml")), true, true
+	} else if i := strings.Index(name, "-"); i > 0 && strings.HasSuffix(name, ".jhist") {
+		return jobID(name[:i]), false, true
+	}
+	return "", false, false
+}
+
+// matchHistoryFiles picks a job's conf and history files out of the files in
+// a directory.
+func matchHistoryFiles(dir string, id jobID, infos []os.FileInfo) (string, string, error) {
+	var confFile, histFile string
+	for _, info := range infos {
+		fileID, conf, ok := historyFileJob(info.Name())
+		if !ok || fileID != id {
+			continue
+		}
+
+		p := path.Join(dir, info.Name())
+		if conf {
+			confFile = p
+		} else {
+			histFile = p
+		}
+		if confFile != "" && histFile != "" {
+			return confFile, histFile, nil
+		}
+	}
+
+	return "", "", fmt.Errorf("no matching files found at %s", dir)
+}
+
+// hdfsHistorySource reads history files from a cluster's HDFS.
+type hdfsHistorySource struct {
+	pool *hdfsPool
+	*historyLocator
+}
+
+func (s hdfsHistorySource) read(name string, f func(r io.Reader) error) error {
+	return s.pool.do(func(client *hdfs.Client) error {
+		r, err := client.Open(name)
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+		return f(r)
+	})
+}
+
+// localHistorySource reads history files from a local directory, like a done
+// directory copied off a cluster. Files that aren't where the history server
+// would have put them are looked for everywhere else in the directory, so
+// the copy doesn't need to keep the layout. The whole directory is indexed
+// for that, at most once every historyIndexTTL.
+type localHistorySource struct {
+	dir   string
+	index *historyIndex
+
+	lock    sync.Mutex
+	indexed time.Time
+}
+
+func newLocalHistorySource(dir string) *localHistorySource {
+	return &localHistorySource{dir: dir, index: newHistoryIndex()}
+}
+
+func (s *localHistorySource) find(id jobID, user string, finishTime int64) (string, string, error) {
+	dir := historyFileDir(s.dir, id, time.Unix(finishTime/1000, 0))
+	if infos, err := (localFS{}).readDir(dir); err == nil {
+		if confFile, histFile, err := matchHistoryFiles(dir, id, infos); err == nil {
+			return confFile, histFile, nil
+		}
+	}
+
+	files, ok := s.index.lookup(id)
+	if !ok {
+		if err := s.reindex(); err != nil {
+			return "", "", err
+		}
+		files, ok = s.index.lookup(id)
+	}
+	if !ok {
+		return "", "", fmt.Errorf("no matching files found under %s", s.dir)
+	}
+	return files.conf, files.hist, nil
+}
+
+// reindex adds every file under the directory to the index, unless that was
+// done within historyIndexTTL.
+func (s *localHistorySource) reindex() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	now := time.Now()
+	if now.Sub(s.indexed) < historyIndexTTL {
+		return nil
+	}
+	s.indexed = now
+
+	listings := make(map[string][]os.FileInfo)
+	err := filepath.Walk(filepath.FromSlash(s.dir), func(p string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		dir := filepath.ToSlash(filepath.Dir(p))
+		listings[dir] = append(listings[dir], info)
+		return nil
+	})
+	for dir, infos := range listings {
+		s.index.add(dir, infos, now)
+	}
+	return err
+}
+
+func (s *localHistorySource) read(name string, f func(r io.Reader) error) error {
+	r, err := os.Open(filepath.FromSlash(name))
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	return f(r)
+}
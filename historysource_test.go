@@ -0,0 +1,72 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	testJobID         = jobID("job_1329348432655_0001")
+	testJobFinishTime = int64(1329348468601)
+)
+
+// copyHistoryFiles copies the test job's history files into dir, named the
+// way the history server names them.
+func copyHistoryFiles(t *testing.T, dir string) {
+	require.NoError(t, os.MkdirAll(dir, 0755))
+	for src, dst := range map[string]string{
+		"test/sleepjob.jhist": string(testJobID) + "-1329348448308-user-Sleep+job-1329348468601-10-1-SUCCEEDED-default.jhist",
+		"test/conf.xml":       string(testJobID) + "_conf.xml",
+	} {
+		data, err := ioutil.ReadFile(src)
+		require.NoError(t, err)
+		require.NoError(t, ioutil.WriteFile(filepath.Join(dir, dst), data, 0644))
+	}
+}
+
+func TestLocalHistorySource(t *testing.T) {
+	root, err := ioutil.TempDir("", "timberlake-history")
+	require.NoError(t, err)
+	defer os.RemoveAll(root)
+
+	done := filepath.ToSlash(filepath.Join(root, "done"))
+	copyHistoryFiles(t, filepath.FromSlash(historyFileDir(done, testJobID, time.Unix(testJobFinishTime/1000, 0))))
+	copyHistoryFiles(t, filepath.Join(root, "flat"))
+
+	// A later job whose ID starts with the test job's shouldn't be mistaken
+	// for it.
+	for _, name := range []string{string(testJobID) + "0-1329348448308-user-Other-1329348468601-1-0-SUCCEEDED-default.jhist", string(testJobID) + "0_conf.xml"} {
+		require.NoError(t, ioutil.WriteFile(filepath.Join(root, "flat", name), nil, 0644))
+	}
+
+	for _, dir := range []string{done, filepath.ToSlash(filepath.Join(root, "flat"))} {
+		source := newLocalHistorySource(dir)
+		confFile, histFile, err := source.find(testJobID, "user", testJobFinishTime)
+		require.NoError(t, err, dir)
+		assert.Equal(t, string(testJobID)+"_conf.xml", path.Base(confFile))
+		assert.Equal(t, string(testJobID)+"-1329348448308-user-Sleep+job-1329348468601-10-1-SUCCEEDED-default.jhist", path.Base(histFile))
+
+		_, _, err = source.find("job_1329348432655_0002", "user", testJobFinishTime)
+		assert.Error(t, err, "other jobs' files shouldn't match")
+	}
+
+	hdfsSource, ok := newHistorySource("/history/done", "", nil).(hdfsHistorySource)
+	require.True(t, ok)
+	assert.Equal(t, "/history/done_intermediate", hdfsSource.intermediateDir)
+	jt := newJobTracker("local", "", "", nil, &hdfsJobHistoryClient{})
+	jt.history = newHistorySource("file://"+done, "", nil)
+	j := &job{Details: jobDetail{ID: string(testJobID), FinishTime: testJobFinishTime}, partial: true}
+	require.NoError(t, jt.jobHistoryClient.updateFromHistoryFile(jt, j, true))
+	assert.Equal(t, "Sleep job", j.Details.Name)
+	assert.Equal(t, "SUCCEEDED", j.Details.State)
+	assert.Len(t, j.Tasks.Map, 11)
+	assert.Equal(t, "/input/dir", j.conf.Input)
+	assert.False(t, j.partial)
+}
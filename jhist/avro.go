@@ -0,0 +1,408 @@
+package jhist
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// This is a small decoder for the Avro binary encoding, just enough to read
+// jhist files written with mapreduce.jobhistory.jhist.format=binary. Rather
+// than decoding into go types, it translates each datum into Avro's JSON
+// encoding, so that binary files produce exactly the same events as the
+// Avro-Json ones.
+
+// avroSchema is a parsed Avro schema. The type is either a primitive type
+// name, or one of record, enum, array, map, union and fixed.
+type avroSchema struct {
+	typ      string
+	name     string
+	fields   []avroField
+	symbols  []string
+	items    *avroSchema
+	values   *avroSchema
+	branches []*avroSchema
+	size     int
+}
+
+type avroField struct {
+	name   string
+	schema *avroSchema
+}
+
+var avroPrimitives = map[string]bool{
+	"null": true, "boolean": true, "int": true, "long": true,
+	"float": true, "double": true, "bytes": true, "string": true,
+}
+
+// avroSchemaParser keeps track of named types, so that they can be
+// referenced after they've been defined.
+type avroSchemaParser struct {
+	named map[string]*avroSchema
+}
+
+func parseAvroSchema(b []byte) (*avroSchema, error) {
+	var raw interface{}
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return nil, err
+	}
+
+	p := &avroSchemaParser{named: make(map[string]*avroSchema)}
+	return p.parse(raw, "")
+}
+
+func (p *avroSchemaParser) parse(raw interface{}, namespace string) (*avroSchema, error) {
+	switch v := raw.(type) {
+	case string:
+		if avroPrimitives[v] {
+			return &avroSchema{typ: v}, nil
+		}
+		if s, ok := p.named[avroFullName(v, namespace)]; ok {
+			return s, nil
+		}
+		if s, ok := p.named[v]; ok {
+			return s, nil
+		}
+		return nil, fmt.Errorf("unknown avro type %q", v)
+	case []interface{}:
+		s := &avroSchema{typ: "union"}
+		for _, branch := range v {
+			b, err := p.parse(branch, namespace)
+			if err != nil {
+				return nil, err
+			}
+			s.branches = append(s.branches, b)
+		}
+		return s, nil
+	case map[string]interface{}:
+		return p.parseComplex(v, namespace)
+	}
+
+	return nil, fmt.Errorf("invalid avro schema: %v", raw)
+}
+
+func (p *avroSchemaParser) parseComplex(v map[string]interface{}, namespace string) (*avroSchema, error) {
+	typ, _ := v["type"].(string)
+	if typ == "" {
+		// The type itself can be a schema, like {"type": {"type": "array"...}}.
+		return p.parse(v["type"], namespace)
+	}
+
+	s := &avroSchema{typ: typ}
+	switch typ {
+	case "record", "error", "enum", "fixed":
+		name, _ := v["name"].(string)
+		if ns, ok := v["namespace"].(string); ok && !strings.Contains(name, ".") {
+			namespace = ns
+		}
+		s.name = avroFullName(name, namespace)
+		if i := strings.LastIndex(s.name, "."); i != -1 {
+			namespace = s.name[:i]
+		}
+		// Register the name before parsing fields, so that records can refer
+		// to themselves.
+		p.named[s.name] = s
+	}
+
+	switch typ {
+	case "record", "error":
+		s.typ = "record"
+		fields, _ := v["fields"].([]interface{})
+		for _, f := range fields {
+			field, _ := f.(map[string]interface{})
+			name, _ := field["name"].(string)
+			fieldSchema, err := p.parse(field["type"], namespace)
+			if err != nil {
+				return nil, fmt.Errorf("field %s: %s", name, err)
+			}
+			s.fields = append(s.fields, avroField{name: name, schema: fieldSchema})
+		}
+	case "enum":
+		symbols, _ := v["symbols"].([]interface{})
+		for _, symbol := range symbols {
+			str, _ := symbol.(string)
+			s.symbols = append(s.symbols, str)
+		}
+	case "fixed":
+		size, _ := v["size"].(float64)
+		s.size = int(size)
+	case "array":
+		items, err := p.parse(v["items"], namespace)
+		if err != nil {
+			return nil, err
+		}
+		s.items = items
+	case "map":
+		values, err := p.parse(v["values"], namespace)
+		if err != nil {
+			return nil, err
+		}
+		s.values = values
+	default:
+		if !avroPrimitives[typ] {
+			return p.parse(typ, namespace)
+		}
+	}
+
+	return s, nil
+}
+
+func avroFullName(name string, namespace string) string {
+	if strings.Contains(name, ".") || namespace == "" {
+		return name
+	}
+	return namespace + "." + name
+}
+
+// maxAvroLength bounds the bytes, strings and fixeds we'll read, so that a
+// corrupt length can't make us allocate an arbitrary amount of memory. Nothing
+// in a history event comes close.
+const maxAvroLength = 64 * 1024 * 1024
+
+type byteReader interface {
+	io.Reader
+	io.ByteReader
+}
+
+// avroDecoder translates binary encoded datums into Avro's JSON encoding.
+type avroDecoder struct {
+	r   byteReader
+	buf bytes.Buffer
+}
+
+// decodeJSON reads one datum of the given schema, and returns it in Avro's
+// JSON encoding. The returned slice is only valid until the next call.
+func (d *avroDecoder) decodeJSON(s *avroSchema) ([]byte, error) {
+	d.buf.Reset()
+	if err := d.decode(s); err != nil {
+		return nil, err
+	}
+	return d.buf.Bytes(), nil
+}
+
+func (d *avroDecoder) decode(s *avroSchema) error {
+	switch s.typ {
+	case "null":
+		d.buf.WriteString("null")
+	case "boolean":
+		b, err := d.r.ReadByte()
+		if err != nil {
+			return err
+		}
+		d.buf.WriteString(strconv.FormatBool(b != 0))
+	case "int", "long":
+		n, err := d.readLong()
+		if err != nil {
+			return err
+		}
+		d.buf.WriteString(strconv.FormatInt(n, 10))
+	case "float":
+		b, err := d.readFixed(4)
+		if err != nil {
+			return err
+		}
+		d.writeFloat(float64(math.Float32frombits(binary.LittleEndian.Uint32(b))), 32)
+	case "double":
+		b, err := d.readFixed(8)
+		if err != nil {
+			return err
+		}
+		d.writeFloat(math.Float64frombits(binary.LittleEndian.Uint64(b)), 64)
+	case "string":
+		b, err := d.readBytes()
+		if err != nil {
+			return err
+		}
+		d.writeString(string(b))
+	case "bytes":
+		b, err := d.readBytes()
+		if err != nil {
+			return err
+		}
+		d.writeByteString(b)
+	case "fixed":
+		b, err := d.readFixed(s.size)
+		if err != nil {
+			return err
+		}
+		d.writeByteString(b)
+	case "enum":
+		i, err := d.readLong()
+		if err != nil {
+			return err
+		}
+		if i < 0 || i >= int64(len(s.symbols)) {
+			return fmt.Errorf("invalid symbol %d for enum %s", i, s.name)
+		}
+		d.writeString(s.symbols[i])
+	case "record":
+		d.buf.WriteByte('{')
+		for i, field := range s.fields {
+			if i > 0 {
+				d.buf.WriteByte(',')
+			}
+			d.writeString(field.name)
+			d.buf.WriteByte(':')
+			if err := d.decode(field.schema); err != nil {
+				return err
+			}
+		}
+		d.buf.WriteByte('}')
+	case "array":
+		d.buf.WriteByte('[')
+		err := d.readBlocks(func(i int) error {
+			if i > 0 {
+				d.buf.WriteByte(',')
+			}
+			return d.decode(s.items)
+		})
+		if err != nil {
+			return err
+		}
+		d.buf.WriteByte(']')
+	case "map":
+		d.buf.WriteByte('{')
+		err := d.readBlocks(func(i int) error {
+			if i > 0 {
+				d.buf.WriteByte(',')
+			}
+			key, err := d.readBytes()
+			if err != nil {
+				return err
+			}
+			d.writeString(string(key))
+			d.buf.WriteByte(':')
+			return d.decode(s.values)
+		})
+		if err != nil {
+			return err
+		}
+		d.buf.WriteByte('}')
+	case "union":
+		i, err := d.readLong()
+		if err != nil {
+			return err
+		}
+		if i < 0 || i >= int64(len(s.branches)) {
+			return fmt.Errorf("invalid union branch %d", i)
+		}
+
+		// Non-null union values are wrapped in an object keyed by their type.
+		branch := s.branches[i]
+		if branch.typ == "null" {
+			d.buf.WriteString("null")
+			return nil
+		}
+		d.buf.WriteByte('{')
+		if branch.name != "" {
+			d.writeString(branch.name)
+		} else {
+			d.writeString(branch.typ)
+		}
+		d.buf.WriteByte(':')
+		if err := d.decode(branch); err != nil {
+			return err
+		}
+		d.buf.WriteByte('}')
+	default:
+		return fmt.Errorf("unsupported avro type %q", s.typ)
+	}
+
+	return nil
+}
+
+// readBlocks reads the blocks of an array or map, calling fn for each item.
+// Each block starts with its item count, which is negated when it's followed
+// by the block's size in bytes. A zero count ends the list.
+func (d *avroDecoder) readBlocks(fn func(i int) error) error {
+	i := 0
+	for {
+		count, err := d.readLong()
+		if err != nil {
+			return err
+		}
+		if count == 0 {
+			return nil
+		}
+		if count < 0 {
+			count = -count
+			if _, err := d.readLong(); err != nil {
+				return err
+			}
+		}
+
+		for ; count > 0; count-- {
+			if err := fn(i); err != nil {
+				return err
+			}
+			i++
+		}
+	}
+}
+
+// readLong reads a zig-zag encoded variable length integer.
+func (d *avroDecoder) readLong() (int64, error) {
+	n, err := binary.ReadUvarint(d.r)
+	if err != nil {
+		return 0, err
+	}
+	return int64(n>>1) ^ -int64(n&1), nil
+}
+
+func (d *avroDecoder) readBytes() ([]byte, error) {
+	length, err := d.readLong()
+	if err != nil {
+		return nil, err
+	}
+	if length < 0 {
+		return nil, errors.New("negative avro length")
+	} else if length > maxAvroLength {
+		return nil, fmt.Errorf("avro length %d is too long", length)
+	}
+	return d.readFixed(int(length))
+}
+
+func (d *avroDecoder) readFixed(n int) ([]byte, error) {
+	if n < 0 || n > maxAvroLength {
+		return nil, fmt.Errorf("invalid avro length %d", n)
+	}
+
+	b := make([]byte, n)
+	if _, err := io.ReadFull(d.r, b); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return b, nil
+}
+
+func (d *avroDecoder) writeString(s string) {
+	b, _ := json.Marshal(s)
+	d.buf.Write(b)
+}
+
+// writeByteString writes bytes the way Avro's JSON encoding does, as a string
+// with one code point per byte.
+func (d *avroDecoder) writeByteString(b []byte) {
+	runes := make([]rune, len(b))
+	for i, c := range b {
+		runes[i] = rune(c)
+	}
+	d.writeString(string(runes))
+}
+
+func (d *avroDecoder) writeFloat(f float64, bitSize int) {
+	// JSON has no representation for these.
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		d.buf.WriteString("null")
+		return
+	}
+	d.buf.WriteString(strconv.FormatFloat(f, 'g', -1, bitSize))
+}
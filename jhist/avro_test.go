@@ -0,0 +1,30 @@
+package jhist
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAvroDecodeString(t *testing.T) {
+	d := &avroDecoder{r: bufio.NewReader(bytes.NewReader([]byte{0x06, 'f', 'o', 'o'}))}
+	b, err := d.decodeJSON(&avroSchema{typ: "string"})
+	require.NoError(t, err)
+	assert.Equal(t, `"foo"`, string(b))
+}
+
+func TestAvroDecodeCorruptLength(t *testing.T) {
+	buf := make([]byte, binary.MaxVarintLen64)
+	n := binary.PutVarint(buf, 1<<40)
+	d := &avroDecoder{r: bufio.NewReader(bytes.NewReader(buf[:n]))}
+	_, err := d.decodeJSON(&avroSchema{typ: "bytes"})
+	assert.Error(t, err)
+
+	d = &avroDecoder{r: bufio.NewReader(bytes.NewReader(nil))}
+	_, err = d.decodeJSON(&avroSchema{typ: "fixed", size: -1})
+	assert.Error(t, err)
+}
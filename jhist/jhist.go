@@ -0,0 +1,475 @@
+// Package jhist reads the files the MapReduce history server keeps for each
+// finished job: the .jhist file of events the application master wrote, and
+// the _conf.xml file of the job's configuration.
+package jhist
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// The first line of a jhist file says how its events are encoded. The second
+// line is the Avro schema for the events.
+var (
+	jhistHeader       = []byte("Avro-Json")
+	jhistBinaryHeader = []byte("Avro-Binary")
+)
+
+// Job is what a jhist file says about a job. Attempts are counted by how
+// they ended, so a task that was tried twice counts twice.
+type Job struct {
+	ID         string
+	Name       string
+	User       string
+	State      string
+	StartTime  int64
+	FinishTime int64
+
+	MapsTotal     int
+	MapsCompleted int
+	MapsFailed    int
+	MapsKilled    int
+
+	ReducesTotal     int
+	ReducesCompleted int
+	ReducesFailed    int
+	ReducesKilled    int
+
+	// Attempts are the job's task attempts, in the order they started.
+	Attempts []Attempt
+}
+
+// Attempt is one attempt at running one of a job's tasks. Its Type is MAP or
+// REDUCE (or SETUP or CLEANUP), and its Status is empty until it's finished.
+// Attempts that haven't finished have no FinishTime.
+type Attempt struct {
+	ID         string   `json:"attemptId"`
+	Type       string   `json:"taskType"`
+	StartTime  int64    `json:"startTime"`
+	FinishTime int64    `json:"finishTime"`
+	Error      string   `json:"error"`
+	Hostname   string   `json:"hostname"`
+	Status     string   `json:"status"`
+	Counters   Counters `json:"counters"`
+}
+
+// Counters are the counters an attempt reported, by group.
+type Counters struct {
+	Groups []struct {
+		Name   string `json:"name"`
+		Counts []struct {
+			Name  string `json:"name"`
+			Value int    `json:"value"`
+		} `json:"counts"`
+	} `json:"groups"`
+}
+
+// Counter is a counter summed over a job's attempts. Its name is the short
+// name of its group and its own name, like FileSystemCounter.HDFS_BYTES_READ.
+type Counter struct {
+	Name   string `json:"name"`
+	Total  int    `json:"total"`
+	Map    int    `json:"map"`
+	Reduce int    `json:"reduce"`
+}
+
+// TaskAttempt identifies an attempt that failed.
+type TaskAttempt struct {
+	ID       string `json:"id"`
+	Hostname string `json:"hostname"`
+	Type     string `json:"type"`
+}
+
+type histEvent struct {
+	Type  string          `json:"type"`
+	Event json.RawMessage `json:"event"`
+}
+
+type jobSubmittedEvent struct {
+	Ev struct {
+		ID   string `json:"jobid"`
+		Name string `json:"jobName"`
+		User string `json:"userName"`
+	} `json:"org.apache.hadoop.mapreduce.jobhistory.JobSubmitted"`
+}
+
+type jobInitedEvent struct {
+	Ev struct {
+		ID           string `json:"jobid"`
+		LaunchTime   int64  `json:"launchTime"`
+		TotalMaps    int    `json:"totalMaps"`
+		TotalReduces int    `json:"totalReduces"`
+	} `json:"org.apache.hadoop.mapreduce.jobhistory.JobInited"`
+}
+
+type jobFinishedEvent struct {
+	Ev struct {
+		ID         string `json:"jobid"`
+		FinishTime int64  `json:"finishTime"`
+	} `json:"org.apache.hadoop.mapreduce.jobhistory.JobFinished"`
+}
+
+type jobFailedEvent struct {
+	Ev struct {
+		ID         string `json:"jobid"`
+		FinishTime int64  `json:"finishTime"`
+		Status     string `json:"jobStatus"`
+	} `json:"org.apache.hadoop.mapreduce.jobhistory.JobUnsuccessfulCompletion"`
+}
+
+type attemptStartedEvent struct {
+	Ev Attempt `json:"org.apache.hadoop.mapreduce.jobhistory.TaskAttemptStarted"`
+}
+
+type mapFinishedEvent struct {
+	Ev Attempt `json:"org.apache.hadoop.mapreduce.jobhistory.MapAttemptFinished"`
+}
+
+type reduceFinishedEvent struct {
+	Ev Attempt `json:"org.apache.hadoop.mapreduce.jobhistory.ReduceAttemptFinished"`
+}
+
+type taskFailedEvent struct {
+	Ev Attempt `json:"org.apache.hadoop.mapreduce.jobhistory.TaskAttemptUnsuccessfulCompletion"`
+}
+
+type jhistParser struct {
+	job *Job
+
+	events   histEventReader
+	attempts map[string]int
+}
+
+// histEventReader reads the events in a jhist file, whatever their encoding.
+// It returns io.EOF after the last event.
+type histEventReader interface {
+	next(ev *histEvent) error
+}
+
+// jsonHistEventReader reads events encoded as Avro-Json, one per line.
+type jsonHistEventReader struct {
+	scanner    *bufio.Scanner
+	lineNumber int
+}
+
+func (r *jsonHistEventReader) next(ev *histEvent) error {
+	for r.scanner.Scan() {
+		r.lineNumber++
+		line := bytes.TrimSpace(r.scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+
+		*ev = histEvent{}
+		if err := json.Unmarshal(line, ev); err != nil {
+			return fmt.Errorf("line %d: %s", r.lineNumber, err)
+		}
+		return nil
+	}
+
+	if r.scanner.Err() != nil {
+		return r.scanner.Err()
+	}
+	return io.EOF
+}
+
+// binaryHistEventReader reads events encoded as Avro binary, one after the
+// other with no separators.
+type binaryHistEventReader struct {
+	reader  *bufio.Reader
+	schema  *avroSchema
+	decoder *avroDecoder
+	events  int
+}
+
+func (r *binaryHistEventReader) next(ev *histEvent) error {
+	if _, err := r.reader.Peek(1); err != nil {
+		return err
+	}
+
+	r.events++
+	b, err := r.decoder.decodeJSON(r.schema)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return fmt.Errorf("event %d: %s", r.events, err)
+	}
+
+	*ev = histEvent{}
+	if err := json.Unmarshal(b, ev); err != nil {
+		return fmt.Errorf("event %d: %s", r.events, err)
+	}
+	return nil
+}
+
+// Load streams through the jhist file represented by r. Both the Avro-Json
+// and Avro-Binary encodings are supported.
+func Load(r io.Reader) (*Job, error) {
+	reader := bufio.NewReader(r)
+	header, err := reader.ReadBytes('\n')
+	if err != nil {
+		return nil, err
+	}
+
+	var events histEventReader
+	switch {
+	case bytes.Equal(bytes.TrimSpace(header), jhistHeader):
+		scanner := bufio.NewScanner(reader)
+		events = &jsonHistEventReader{scanner: scanner, lineNumber: 1}
+	case bytes.Equal(bytes.TrimSpace(header), jhistBinaryHeader):
+		rawSchema, err := reader.ReadBytes('\n')
+		if err != nil {
+			return nil, err
+		}
+		schema, err := parseAvroSchema(rawSchema)
+		if err != nil {
+			return nil, fmt.Errorf("invalid schema: %s", err)
+		}
+		events = &binaryHistEventReader{
+			reader:  reader,
+			schema:  schema,
+			decoder: &avroDecoder{r: reader},
+		}
+	default:
+		return nil, errors.New("invalid jhist header")
+	}
+
+	parser := &jhistParser{
+		job:      &Job{},
+		events:   events,
+		attempts: make(map[string]int),
+	}
+	if err := parser.parse(); err != nil {
+		return nil, err
+	}
+	return parser.job, nil
+}
+
+func (jp *jhistParser) parse() error {
+	wrapper := histEvent{}
+	for {
+		err := jp.events.next(&wrapper)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+
+		switch wrapper.Type {
+		case "JOB_SUBMITTED":
+			jp.parseJobSubmitted(wrapper.Event)
+		case "JOB_INITED":
+			jp.parseJobInited(wrapper.Event)
+		case "JOB_FINISHED":
+			jp.parseJobFinished(wrapper.Event)
+		case "JOB_FAILED":
+			jp.parseJobFailed(wrapper.Event)
+		case "MAP_ATTEMPT_STARTED":
+			jp.parseTaskStarted(wrapper.Event)
+		case "MAP_ATTEMPT_FINISHED":
+			jp.job.MapsCompleted++
+			jp.parseMapFinished(wrapper.Event)
+		case "MAP_ATTEMPT_FAILED":
+			jp.job.MapsFailed++
+			jp.parseTaskFailed(wrapper.Event)
+		case "MAP_ATTEMPT_KILLED":
+			jp.job.MapsKilled++
+			jp.parseTaskFailed(wrapper.Event)
+		case "REDUCE_ATTEMPT_STARTED":
+			jp.parseTaskStarted(wrapper.Event)
+		case "REDUCE_ATTEMPT_FINISHED":
+			jp.job.ReducesCompleted++
+			jp.parseReduceFinished(wrapper.Event)
+		case "REDUCE_ATTEMPT_FAILED":
+			jp.job.ReducesFailed++
+			jp.parseTaskFailed(wrapper.Event)
+		case "REDUCE_ATTEMPT_KILLED":
+			jp.job.ReducesKilled++
+			jp.parseTaskFailed(wrapper.Event)
+		}
+	}
+	return nil
+}
+
+func (jp *jhistParser) parseJobSubmitted(b []byte) {
+	ev := jobSubmittedEvent{}
+	json.Unmarshal(b, &ev)
+
+	jp.job.ID = ev.Ev.ID
+	jp.job.Name = ev.Ev.Name
+	jp.job.User = ev.Ev.User
+}
+
+func (jp *jhistParser) parseJobInited(b []byte) {
+	ev := jobInitedEvent{}
+	json.Unmarshal(b, &ev)
+
+	jp.job.ID = ev.Ev.ID
+	jp.job.StartTime = ev.Ev.LaunchTime
+	jp.job.MapsTotal = ev.Ev.TotalMaps
+	jp.job.ReducesTotal = ev.Ev.TotalReduces
+}
+
+func (jp *jhistParser) parseJobFinished(b []byte) {
+	ev := jobFinishedEvent{}
+	json.Unmarshal(b, &ev)
+
+	jp.job.ID = ev.Ev.ID
+	jp.job.FinishTime = ev.Ev.FinishTime
+	jp.job.State = "SUCCEEDED"
+}
+
+func (jp *jhistParser) parseJobFailed(b []byte) {
+	ev := jobFailedEvent{}
+	json.Unmarshal(b, &ev)
+
+	jp.job.ID = ev.Ev.ID
+	jp.job.FinishTime = ev.Ev.FinishTime
+	jp.job.State = ev.Ev.Status
+}
+
+func (jp *jhistParser) parseTaskStarted(b []byte) {
+	ev := attemptStartedEvent{}
+	json.Unmarshal(b, &ev)
+
+	jp.setAttempt(ev.Ev)
+}
+
+func (jp *jhistParser) parseMapFinished(b []byte) {
+	ev := mapFinishedEvent{}
+	json.Unmarshal(b, &ev)
+
+	jp.finishAttempt(ev.Ev)
+}
+
+func (jp *jhistParser) parseReduceFinished(b []byte) {
+	ev := reduceFinishedEvent{}
+	json.Unmarshal(b, &ev)
+
+	jp.finishAttempt(ev.Ev)
+}
+
+func (jp *jhistParser) parseTaskFailed(b []byte) {
+	ev := taskFailedEvent{}
+	json.Unmarshal(b, &ev)
+
+	jp.finishAttempt(ev.Ev)
+}
+
+// finishAttempt replaces an attempt with how it ended. The events for the end
+// of an attempt don't say when it started.
+func (jp *jhistParser) finishAttempt(attempt Attempt) {
+	if i, ok := jp.attempts[attempt.ID]; ok {
+		attempt.StartTime = jp.job.Attempts[i].StartTime
+	} else {
+		attempt.StartTime = 0
+	}
+	jp.setAttempt(attempt)
+}
+
+func (jp *jhistParser) setAttempt(attempt Attempt) {
+	if i, ok := jp.attempts[attempt.ID]; ok {
+		jp.job.Attempts[i] = attempt
+		return
+	}
+	jp.attempts[attempt.ID] = len(jp.job.Attempts)
+	jp.job.Attempts = append(jp.job.Attempts, attempt)
+}
+
+// TaskTimes returns the start and finish times of the job's map and reduce
+// attempts. We can't just look at the task events, because the history
+// server does the same misdirection - it sets the startTime for the task to
+// the startTime of the first attempt, for example.
+func (j *Job) TaskTimes() (maps [][]int64, reduces [][]int64) {
+	maps, reduces = make([][]int64, 0), make([][]int64, 0)
+	for _, attempt := range j.Attempts {
+		if attempt.Type == "MAP" {
+			maps = append(maps, []int64{attempt.StartTime, attempt.FinishTime})
+		} else if attempt.Type == "REDUCE" {
+			reduces = append(reduces, []int64{attempt.StartTime, attempt.FinishTime})
+		}
+	}
+	return maps, reduces
+}
+
+// Errors groups the attempts that failed with an error by the error.
+func (j *Job) Errors() map[string][]TaskAttempt {
+	errors := make(map[string][]TaskAttempt)
+	for _, attempt := range j.Attempts {
+		if attempt.Status == "FAILED" && attempt.Error != "" {
+			errors[attempt.Error] = append(errors[attempt.Error], TaskAttempt{
+				ID:       attempt.ID,
+				Hostname: attempt.Hostname,
+				Type:     attempt.Type,
+			})
+		}
+	}
+	return errors
+}
+
+// Counters sums the counters the job's attempts reported, sorted by name.
+func (j *Job) Counters() []Counter {
+	counters := make(map[string]Counter)
+	for _, attempt := range j.Attempts {
+		for _, group := range attempt.Counters.Groups {
+			groupName := group.Name[strings.LastIndex(group.Name, ".")+1:]
+			for _, count := range group.Counts {
+				counterName := fmt.Sprintf("%s.%s", groupName, count.Name)
+				counter := counters[counterName]
+				counter.Name = counterName
+				counter.Total += count.Value
+
+				if attempt.Type == "MAP" {
+					counter.Map += count.Value
+				} else if attempt.Type == "REDUCE" {
+					counter.Reduce += count.Value
+				}
+
+				counters[counterName] = counter
+			}
+		}
+	}
+
+	sorted := make([]Counter, 0, len(counters))
+	for _, counter := range counters {
+		sorted = append(sorted, counter)
+	}
+	sort.Slice(sorted, func(i, k int) bool { return sorted[i].Name < sorted[k].Name })
+	return sorted
+}
+
+type confProperty struct {
+	Name  string `xml:"name"`
+	Value string `xml:"value"`
+}
+
+type parsedJobConf struct {
+	XMLName    xml.Name       `xml:"configuration"`
+	Properties []confProperty `xml:"property"`
+}
+
+// LoadConf loads a job's hadoop conf from an xml file represented by r.
+func LoadConf(r io.Reader) (map[string]string, error) {
+	decoder := xml.NewDecoder(r)
+
+	parsed := parsedJobConf{}
+	err := decoder.Decode(&parsed)
+	if err != nil {
+		return nil, err
+	}
+
+	conf := make(map[string]string, len(parsed.Properties))
+	for _, prop := range parsed.Properties {
+		conf[prop.Name] = prop.Value
+	}
+
+	return conf, nil
+}
@@ -0,0 +1,40 @@
+package jhist
+
+import (
+	"os"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoad(t *testing.T) {
+	var jobs []*Job
+	for _, name := range []string{"../test/sleepjob.jhist", "../test/sleepjob-binary.jhist"} {
+		f, err := os.Open(name)
+		require.NoError(t, err)
+		job, err := Load(f)
+		f.Close()
+		require.NoError(t, err, name)
+		jobs = append(jobs, job)
+	}
+	assert.Equal(t, jobs[0], jobs[1], "both encodings should load the same job")
+
+	job := jobs[0]
+	assert.Equal(t, "job_1329348432655_0001", job.ID)
+	assert.Equal(t, "SUCCEEDED", job.State)
+	assert.Len(t, job.Attempts, 12)
+
+	maps, reduces := job.TaskTimes()
+	assert.Len(t, maps, 11)
+	assert.Len(t, reduces, 1)
+
+	assert.Equal(t, map[string][]TaskAttempt{
+		"This is an error.": {{ID: "attempt_1457998088753_7918_m_000014_0", Hostname: "bigdata33", Type: "MAP"}},
+	}, job.Errors())
+
+	counters := job.Counters()
+	assert.True(t, sort.SliceIsSorted(counters, func(i, j int) bool { return counters[i].Name < counters[j].Name }))
+	assert.Contains(t, counters, Counter{Name: "FileSystemCounter.HDFS_BYTES_READ", Total: 480, Map: 480})
+}
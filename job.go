@@ -1,6 +1,10 @@
 package main
 
-import "time"
+import (
+	"time"
+
+	"github.com/stripe/timberlake/jhist"
+)
 
 type jobConf struct {
 	Conf conf   `json:"conf"`
@@ -24,6 +28,15 @@ type job struct {
 
 	// http://docs.cascading.org/cascading/1.2/javadoc/cascading/flow/Flow.html
 	FlowID *string `json:"flowID"`
+
+	// attempts are every task attempt read by a full load, with their
+	// outcomes. They're only kept until the job is archived, and are never
+	// stored.
+	attempts []jhist.Attempt
+
+	// retries is how many times the job's history files have been looked for
+	// again.
+	retries int
 }
 
 type jobDetail struct {
@@ -51,6 +64,19 @@ type jobDetail struct {
 	ReducesFailed    int     `json:"failedReduceAttempts"`
 	ReducesKilled    int     `json:"killedReduceAttempts"`
 	ReducesTotalTime int64   `json:"reducesTotalTime"`
+
+	yarnApp
+}
+
+// yarnApp holds the details the resource manager reports for every
+// application, whatever framework it runs.
+type yarnApp struct {
+	Type            string  `json:"applicationType"`
+	Queue           string  `json:"queue"`
+	AllocatedMB     int     `json:"allocatedMB"`
+	AllocatedVCores int     `json:"allocatedVCores"`
+	Progress        float32 `json:"progress"`
+	Diagnostics     string  `json:"diagnostics"`
 }
 
 type jobDetails []jobDetail
@@ -67,21 +93,54 @@ func (ds jobDetails) Less(i, j int) bool {
 	return ds[i].FinishTime < ds[j].FinishTime
 }
 
-type counter struct {
-	Name   string `json:"name"`
-	Total  int    `json:"total"`
-	Map    int    `json:"map"`
-	Reduce int    `json:"reduce"`
+type counter = jhist.Counter
+
+// appDetail is an application as listed by the resource manager's cluster
+// apps API.
+type appDetail struct {
+	ID          string `json:"id"`
+	Name        string `json:"name"`
+	User        string `json:"user"`
+	State       string `json:"state"`
+	FinalStatus string `json:"finalStatus"`
+	StartTime   int64  `json:"startedTime"`
+	FinishTime  int64  `json:"finishedTime"`
+
+	yarnApp
+}
+
+// jobDetail translates the resource manager's view of an application into
+// the job details we track. The framework-specific fields are left for an
+// appEnricher to fill in.
+func (app appDetail) jobDetail() jobDetail {
+	state := app.State
+	if state == "FINISHED" && app.FinalStatus != "" {
+		state = app.FinalStatus
+	}
+
+	return jobDetail{
+		ID:         app.ID,
+		Name:       app.Name,
+		User:       app.User,
+		State:      state,
+		StartTime:  app.StartTime,
+		FinishTime: app.FinishTime,
+		yarnApp:    app.yarnApp,
+	}
 }
 
 type appsDetailList struct {
-	App []jobDetail `json:"app"`
+	App []appDetail `json:"app"`
 }
 
 type appsResp struct {
 	Apps appsDetailList `json:"apps"`
 }
 
+type appResp struct {
+	App appDetail `json:"app"`
+}
+
 type jobsDetailList struct {
 	Job []jobDetail `json:"job"`
 }
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var memoryBudget byteSize
+var evictionPolicyFlag = flag.String("eviction-policy", "pinned,age", "The order finished jobs are trimmed and evicted in when a cluster is over its memory budget or job limit: a comma separated list of pinned, state and age, most important first.")
+
+func init() {
+	flag.Var(&memoryBudget, "memory-budget", "Roughly how much memory each cluster's jobs can take up, like 512MB. Finished jobs are trimmed and then evicted to stay under it. Leave at 0 for no budget.")
+}
+
+// Rough sizes of the parts of a job that don't depend on its contents:
+// struct fields, slice and map headers, and map entries.
+const (
+	jobOverhead      = 600
+	counterOverhead  = 48
+	taskOverhead     = 24
+	mapEntryOverhead = 48
+	attemptOverhead  = 64
+)
+
+// jobSize estimates how much memory a job takes up. It counts the details,
+// counters, tasks and conf flags, which are most of it.
+func jobSize(j *job) int64 {
+	d := j.Details
+	size := jobOverhead + len(d.ID) + len(d.Name) + len(d.User) + len(d.State) + len(d.Type) + len(d.Queue) + len(d.Diagnostics)
+	size += len(j.Cluster) + len(j.ResourceManagerURL) + len(j.JobHistoryURL)
+	if j.FlowID != nil {
+		size += len(*j.FlowID)
+	}
+
+	for _, c := range j.Counters {
+		size += counterOverhead + len(c.Name)
+	}
+
+	size += len(j.conf.Input) + len(j.conf.Output) + len(j.conf.ScaldingSteps) + len(j.conf.name)
+	for k, v := range j.conf.Flags {
+		size += mapEntryOverhead + len(k) + len(v)
+	}
+
+	for _, list := range [][][]int64{j.Tasks.Map, j.Tasks.Reduce} {
+		for _, pair := range list {
+			size += taskOverhead + 8*len(pair)
+		}
+	}
+	for task, attempts := range j.Tasks.Errors {
+		size += mapEntryOverhead + len(task)
+		for _, a := range attempts {
+			size += attemptOverhead + len(a.ID) + len(a.Hostname) + len(a.Type)
+		}
+	}
+
+	return int64(size)
+}
+
+// byteSize is an amount of memory, which can be given with a unit, like
+// 512MB or 2GB.
+type byteSize int64
+
+var byteUnits = []struct {
+	suffix string
+	size   byteSize
+}{
+	{"GB", 1 << 30},
+	{"MB", 1 << 20},
+	{"KB", 1 << 10},
+	{"B", 1},
+}
+
+func parseByteSize(s string) (byteSize, error) {
+	s = strings.ToUpper(strings.TrimSpace(s))
+	unit := byteSize(1)
+	for _, u := range byteUnits {
+		if strings.HasSuffix(s, u.suffix) {
+			s, unit = strings.TrimSpace(strings.TrimSuffix(s, u.suffix)), u.size
+			break
+		}
+	}
+
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return byteSize(n) * unit, nil
+}
+
+func (b byteSize) String() string {
+	for _, u := range byteUnits {
+		if b != 0 && b%u.size == 0 {
+			return fmt.Sprintf("%d%s", b/u.size, u.suffix)
+		}
+	}
+	return "0"
+}
+
+func (b *byteSize) Set(s string) error {
+	size, err := parseByteSize(s)
+	if err != nil {
+		return err
+	}
+	*b = size
+	return nil
+}
+
+func (b *byteSize) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+	return b.Set(s)
+}
+
+// cacheEntry is a finished job that could be trimmed or evicted.
+type cacheEntry struct {
+	id     jobID
+	job    *job
+	size   int64
+	pinned bool
+}
+
+// evictionKey compares two jobs, returning a negative number if a should be
+// evicted before b, a positive one if after, and 0 if it doesn't care.
+type evictionKey func(a *cacheEntry, b *cacheEntry) int
+
+// How interesting each state is. Jobs in less interesting states go first.
+var stateRanks = map[string]int64{
+	"SUCCEEDED": 0,
+	"KILLED":    1,
+	"FAILED":    2,
+}
+
+var evictionKeys = map[string]evictionKey{
+	// Jobs that finished longest ago go first.
+	"age": func(a *cacheEntry, b *cacheEntry) int {
+		return compareInt64(a.job.Details.FinishTime, b.job.Details.FinishTime)
+	},
+	// Successful jobs go before killed ones, and killed before failed.
+	"state": func(a *cacheEntry, b *cacheEntry) int {
+		return compareInt64(stateRanks[a.job.Details.State], stateRanks[b.job.Details.State])
+	},
+	// Jobs that were pinned go last.
+	"pinned": func(a *cacheEntry, b *cacheEntry) int {
+		return compareInt64(boolRank(a.pinned), boolRank(b.pinned))
+	},
+}
+
+func boolRank(b bool) int64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// evictionPolicy orders jobs by each of its keys in turn. Ties are broken by
+// ID, so that the order is stable.
+type evictionPolicy []evictionKey
+
+func parseEvictionPolicy(s string) (evictionPolicy, error) {
+	var policy evictionPolicy
+	for _, name := range strings.Split(s, ",") {
+		key, ok := evictionKeys[strings.TrimSpace(name)]
+		if !ok {
+			return nil, fmt.Errorf("unknown eviction order %q", name)
+		}
+		policy = append(policy, key)
+	}
+	return policy, nil
+}
+
+func (p evictionPolicy) sort(entries []*cacheEntry) {
+	sort.Slice(entries, func(i, j int) bool {
+		for _, key := range p {
+			if c := key(entries[i], entries[j]); c != 0 {
+				return c < 0
+			}
+		}
+		return entries[i].id < entries[j].id
+	})
+}
+
+// shrinkCache keeps the jobs in memory under the cluster's memory budget and
+// job limit. Finished jobs lose their tasks and counters a day after they
+// finish, or sooner if we're over budget, and are evicted altogether if
+// trimming isn't enough. Running jobs are never touched.
+func (jt *jobTracker) shrinkCache(now time.Time) (evicted []*job, trimmed map[jobID]*job) {
+	jt.store.Sweep(func(jobs map[jobID]*job, pinned map[jobID]bool) bool {
+		evicted, trimmed = jt.shrinkJobs(jobs, pinned, now)
+		return len(evicted) > 0 || len(trimmed) > 0
+	})
+	return evicted, trimmed
+}
+
+func (jt *jobTracker) shrinkJobs(jobs map[jobID]*job, pinned map[jobID]bool, now time.Time) ([]*job, map[jobID]*job) {
+	policy, err := parseEvictionPolicy(jt.config.EvictionPolicy)
+	if err != nil {
+		log.Println("Evicting by age:", err)
+		policy = evictionPolicy{evictionKeys["age"]}
+	}
+
+	trimmed := make(map[jobID]*job)
+	trim := func(e *cacheEntry, reason string) int64 {
+		cleaned := &job{Details: e.job.Details, running: e.job.running, partial: true}
+		jobs[e.id] = cleaned
+		trimmed[e.id] = cleaned
+		metrics.add(jobCacheEvictionsMetric, 1, "cluster", jt.clusterName, "action", "trim", "reason", reason, "state", e.job.Details.State)
+
+		freed := e.size - jobSize(cleaned)
+		e.job, e.size = cleaned, e.size-freed
+		return freed
+	}
+
+	var total int64
+	var entries []*cacheEntry
+	cutoff := now.Add(-fullDataDuration).Unix()
+	for id, j := range jobs {
+		e := &cacheEntry{id: id, job: j, size: jobSize(j), pinned: pinned[id]}
+		if !j.running {
+			// Drop tasks and counters for old jobs since those are only
+			// visible in details pages (and unlikely to be viewed).
+			if !j.partial && j.Details.FinishTime/1000 < cutoff {
+				trim(e, "age")
+			}
+			entries = append(entries, e)
+		}
+		total += e.size
+	}
+	policy.sort(entries)
+
+	budget := int64(jt.config.MemoryBudget)
+	overBudget := func() bool {
+		return budget > 0 && total > budget
+	}
+
+	for _, e := range entries {
+		if !overBudget() {
+			break
+		}
+		if !e.job.partial {
+			total -= trim(e, "budget")
+		}
+	}
+
+	var evicted []*job
+	for i, e := range entries {
+		reason := "budget"
+		if len(entries)-i > jobLimit {
+			reason = "limit"
+		} else if !overBudget() {
+			break
+		}
+
+		delete(jobs, e.id)
+		delete(pinned, e.id)
+		delete(trimmed, e.id)
+		total -= e.size
+		evicted = append(evicted, e.job)
+		metrics.add(jobCacheEvictionsMetric, 1, "cluster", jt.clusterName, "action", "evict", "reason", reason, "state", e.job.Details.State)
+	}
+
+	metrics.set(jobCacheBytesMetric, float64(total), "cluster", jt.clusterName)
+	metrics.set(jobCacheBudgetMetric, float64(budget), "cluster", jt.clusterName)
+	return evicted, trimmed
+}
+
+// setPinned pins or unpins a job, and reports whether it's tracked at all.
+// Pinned jobs can be kept in memory longer than others, depending on the
+// eviction policy.
+func (jt *jobTracker) setPinned(id jobID, pinned bool) (bool, error) {
+	ok := jt.store.Pin(id, pinned)
+	if !ok || jt.state == nil {
+		return ok, nil
+	}
+	return ok, jt.state.setPinned(id, pinned)
+}
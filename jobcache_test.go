@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestJobSize(t *testing.T) {
+	j := &job{Details: jobDetail{ID: "job_1_0001", Name: "wordcount"}}
+	small := jobSize(j)
+
+	j.Counters = []counter{{Name: "TaskCounter.MAP_INPUT_RECORDS"}}
+	j.Tasks.Map = [][]int64{{1, 2}, {3, 4}}
+	j.conf.update(map[string]string{"mapreduce.job.queuename": "default"})
+	assert.Equal(t, small+counterOverhead+29+2*(taskOverhead+16)+mapEntryOverhead+23+7, jobSize(j))
+}
+
+func TestParseByteSize(t *testing.T) {
+	for s, expected := range map[string]byteSize{"0": 0, "100": 100, "2KB": 2048, "512MB": 512 << 20, "1gb": 1 << 30} {
+		size, err := parseByteSize(s)
+		require.NoError(t, err, s)
+		assert.Equal(t, expected, size, s)
+	}
+	for _, invalid := range []string{"", "MB", "-1MB", "1TB", "1.5GB"} {
+		_, err := parseByteSize(invalid)
+		assert.Error(t, err, invalid)
+	}
+	assert.Equal(t, "512MB", byteSize(512<<20).String())
+}
+
+func TestShrinkCache(t *testing.T) {
+	now := time.Now()
+	ms := func(d time.Duration) int64 {
+		return now.Add(-d).UnixNano() / int64(time.Millisecond)
+	}
+	full := func(id string, state string, finished time.Duration) *job {
+		return &job{
+			Details:  jobDetail{ID: id, State: state, FinishTime: ms(finished)},
+			Counters: make([]counter, 100),
+			Tasks:    tasks{Map: make([][]int64, 100)},
+		}
+	}
+
+	jt := newJobTracker("cache", "", "", nil, nil)
+	jt.saveJob(full("job_1_0001", "FAILED", 3*time.Hour))
+	jt.saveJob(full("job_1_0002", "SUCCEEDED", 2*time.Hour))
+	jt.saveJob(full("job_1_0003", "KILLED", time.Hour))
+	jt.saveJob(full("job_1_0004", "SUCCEEDED", 48*time.Hour))
+	jt.saveJob(&job{Details: jobDetail{ID: "job_1_0005", State: "RUNNING"}, Tasks: tasks{Map: make([][]int64, 1000)}, running: true})
+	jt.store.Pin("job_1_0001", true)
+
+	// Without a budget, only old jobs are trimmed.
+	evicted, trimmed := jt.shrinkCache(now)
+	assert.Empty(t, evicted)
+	assert.Equal(t, []jobID{"job_1_0004"}, keys(trimmed))
+
+	// Over budget, jobs are trimmed in the policy's order, and then evicted
+	// if that's not enough. Running jobs are left alone.
+	trimmedSize := jobSize(jt.getJob("job_1_0004"))
+	runningSize := jobSize(jt.getJob("job_1_0005"))
+	fullSize := jobSize(jt.getJob("job_1_0001"))
+	jt.config.EvictionPolicy = "pinned,state,age"
+	jt.config.MemoryBudget = byteSize(runningSize + 2*fullSize + 2*trimmedSize)
+	evicted, trimmed = jt.shrinkCache(now)
+	assert.Empty(t, evicted)
+	assert.Equal(t, []jobID{"job_1_0002"}, keys(trimmed), "the unpinned successful job should be trimmed first")
+
+	jt.config.MemoryBudget = byteSize(runningSize + 2*trimmedSize)
+	evicted, trimmed = jt.shrinkCache(now)
+	assert.Equal(t, []jobID{"job_1_0001", "job_1_0003"}, keys(trimmed))
+	require.Len(t, evicted, 2)
+	assert.Equal(t, "job_1_0004", evicted[0].Details.ID, "the oldest successful job should be evicted first")
+	assert.Equal(t, "job_1_0002", evicted[1].Details.ID)
+	assert.True(t, jt.hasJob("job_1_0001"))
+	assert.True(t, jt.hasJob("job_1_0003"))
+	assert.True(t, jt.hasJob("job_1_0005"))
+
+	var remaining int64
+	for _, j := range jt.store.List() {
+		remaining += jobSize(j)
+	}
+	var buf bytes.Buffer
+	metrics.writeTo(&buf)
+	assert.Contains(t, buf.String(), fmt.Sprintf("timberlake_job_cache_bytes{cluster=\"cache\"} %d\n", remaining))
+	assert.Contains(t, buf.String(), `timberlake_job_cache_evictions_total{cluster="cache",action="evict",reason="budget",state="SUCCEEDED"} 2`)
+	assert.Contains(t, buf.String(), `timberlake_job_cache_evictions_total{cluster="cache",action="trim",reason="age",state="SUCCEEDED"} 1`)
+}
+
+func TestShrinkCacheJobLimit(t *testing.T) {
+	jt := newJobTracker("limit", "", "", nil, nil)
+	for i := 0; i < jobLimit+10; i++ {
+		jt.saveJob(&job{Details: jobDetail{ID: fmt.Sprintf("job_1_%04d", i), State: "FAILED", FinishTime: int64(i)}, partial: true})
+	}
+	jt.store.Pin("job_1_0000", true)
+
+	evicted, _ := jt.shrinkCache(time.Now())
+	require.Len(t, evicted, 10, "failed jobs should count towards the job limit")
+	assert.Equal(t, "job_1_0001", evicted[0].Details.ID, "pinned jobs should be kept")
+	assert.Equal(t, "job_1_0010", evicted[9].Details.ID)
+}
+
+func keys(jobs map[jobID]*job) []jobID {
+	ids := make([]jobID, 0, len(jobs))
+	for id := range jobs {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// jobListing is the gzipped JSON that GET /jobs/ returns when it isn't
+// filtered, which is what every page load asks for. It's only rebuilt when
+// the jobs change.
+type jobListing struct {
+	lock    sync.Mutex
+	etag    string
+	gzipped []byte
+}
+
+var listing jobListing
+
+// listingETag identifies the jobs a query to GET /jobs/ returns, from the
+// version of each cluster's store. It's cheap enough to check before doing
+// anything else.
+func listingETag(jts map[string]*jobTracker, params url.Values) string {
+	names := make([]string, 0, len(jts))
+	for name := range jts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	h := fnv.New64a()
+	for _, name := range names {
+		fmt.Fprintf(h, "%s\x00%d\x00", name, jts[name].store.Version())
+	}
+	io.WriteString(h, params.Encode())
+	return fmt.Sprintf(`"%x"`, h.Sum64())
+}
+
+// etagMatches checks an If-None-Match header against an ETag.
+func etagMatches(header string, etag string) bool {
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+		if tag == etag || tag == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// listJobs returns the summaries of the jobs in the clusters a query asks
+// for. We only need the details for listing pages.
+func listJobs(jts map[string]*jobTracker, query *jobQuery) []*job {
+	var jobs []*job
+	for clusterName, tracker := range jts {
+		if query.clusters != nil && !query.clusters[clusterName] {
+			continue
+		}
+
+		for _, j := range tracker.store.List() {
+			jobs = append(jobs, jobSummary(tracker.clusterName, j))
+		}
+	}
+	return jobs
+}
+
+// serve writes the listing for etag, rebuilding it first if the jobs have
+// changed since it was built.
+func (l *jobListing) serve(w http.ResponseWriter, r *http.Request, jts map[string]*jobTracker, query *jobQuery, etag string) {
+	l.lock.Lock()
+	if l.etag != etag {
+		gzipped, err := gzipJobs(query, listJobs(jts, query))
+		if err != nil {
+			l.lock.Unlock()
+			log.Println("getJobs error:", err)
+			w.WriteHeader(500)
+			return
+		}
+		l.etag, l.gzipped = etag, gzipped
+	}
+	gzipped := l.gzipped
+	l.lock.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Vary", "Accept-Encoding")
+	if strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Write(gzipped)
+		return
+	}
+
+	reader, err := gzip.NewReader(bytes.NewReader(gzipped))
+	if err != nil {
+		log.Println("getJobs error:", err)
+		w.WriteHeader(500)
+		return
+	}
+	io.Copy(w, reader)
+}
+
+func gzipJobs(query *jobQuery, jobs []*job) ([]byte, error) {
+	jobs, _ = query.apply(jobs)
+
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	if err := json.NewEncoder(gz).Encode(jobs); err != nil {
+		return nil, err
+	}
+	if err := gz.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zenazn/goji/web"
+)
+
+func TestGetJobsETag(t *testing.T) {
+	defer func(saved map[string]*jobTracker) { jts = saved }(jts)
+	jt := newJobTracker("listing", "", "", nil, nil)
+	jts = map[string]*jobTracker{"listing": jt}
+	jt.saveJob(&job{Details: jobDetail{ID: "job_1_0001", User: "alice", StartTime: 1}})
+
+	get := func(url string, headers map[string]string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", url, nil)
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		getJobs(web.C{}, w, req)
+		return w
+	}
+	decode := func(w *httptest.ResponseRecorder) []*job {
+		gz, err := gzip.NewReader(w.Body)
+		require.NoError(t, err)
+		var jobs []*job
+		require.NoError(t, json.NewDecoder(gz).Decode(&jobs))
+		return jobs
+	}
+
+	w := get("/jobs/", map[string]string{"Accept-Encoding": "gzip"})
+	require.Equal(t, 200, w.Code)
+	assert.Equal(t, "gzip", w.Header().Get("Content-Encoding"))
+	etag := w.Header().Get("ETag")
+	require.NotEmpty(t, etag)
+	jobs := decode(w)
+	require.Len(t, jobs, 1)
+	assert.Equal(t, "job_1_0001", jobs[0].Details.ID)
+	snapshot := listing.gzipped
+
+	w = get("/jobs/", map[string]string{"If-None-Match": etag})
+	assert.Equal(t, 304, w.Code)
+	assert.Empty(t, w.Body.String())
+
+	// Clients that don't take gzip get the same listing, without building it
+	// again.
+	w = get("/jobs/", nil)
+	require.Equal(t, 200, w.Code)
+	assert.Empty(t, w.Header().Get("Content-Encoding"))
+	assert.Contains(t, w.Body.String(), `"job_1_0001"`)
+	assert.True(t, &listing.gzipped[0] == &snapshot[0], "the listing shouldn't be rebuilt until the jobs change")
+
+	jt.saveJob(&job{Details: jobDetail{ID: "job_1_0002", User: "bob", StartTime: 2}})
+	w = get("/jobs/", map[string]string{"Accept-Encoding": "gzip", "If-None-Match": etag})
+	require.Equal(t, 200, w.Code)
+	assert.NotEqual(t, etag, w.Header().Get("ETag"))
+	jobs = decode(w)
+	require.Len(t, jobs, 2)
+	assert.Equal(t, "job_1_0002", jobs[0].Details.ID, "the newest job should be first")
+
+	// Filtered listings get their own ETags.
+	w = get("/jobs/?user=alice", nil)
+	require.Equal(t, 200, w.Code)
+	filtered := w.Header().Get("ETag")
+	assert.NotEqual(t, etag, filtered)
+	assert.NotContains(t, w.Body.String(), "job_1_0002")
+	assert.Equal(t, 304, get("/jobs/?user=alice", map[string]string{"If-None-Match": `"other", ` + filtered}).Code)
+}
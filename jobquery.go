@@ -0,0 +1,309 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// jobQuery selects a page of jobs for the /jobs/ listing, or the updates sent
+// to an SSE client. The zero value matches every job.
+type jobQuery struct {
+	ids          map[jobID]bool
+	clusters     map[string]bool
+	users        map[string]bool
+	states       map[string]bool
+	name         *regexp.Regexp
+	since        int64
+	until        int64
+	inputPrefix  string
+	outputPrefix string
+	flowID       string
+
+	sort   string
+	desc   bool
+	limit  int
+	cursor *jobCursor
+}
+
+// jobSortKey returns the value a job is sorted by. Numeric fields use the
+// int, and the others the string.
+type jobSortKey func(j *job) (int64, string)
+
+var jobSortKeys = map[string]jobSortKey{
+	"startTime":  func(j *job) (int64, string) { return j.Details.StartTime, "" },
+	"finishTime": func(j *job) (int64, string) { return j.Details.FinishTime, "" },
+	"name":       func(j *job) (int64, string) { return 0, j.Details.Name },
+	"user":       func(j *job) (int64, string) { return 0, j.Details.User },
+	"state":      func(j *job) (int64, string) { return 0, j.Details.State },
+	"id":         func(j *job) (int64, string) { return 0, j.Details.ID },
+}
+
+const defaultJobSort = "-startTime"
+
+// jobCursor is the position of the last job on a page. It's handed to
+// clients as an opaque string, and the next page starts right after it.
+type jobCursor struct {
+	N       int64  `json:"n,omitempty"`
+	S       string `json:"s,omitempty"`
+	Cluster string `json:"c"`
+	ID      string `json:"i"`
+}
+
+func (c *jobCursor) String() string {
+	b, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func parseJobCursor(s string) (*jobCursor, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cursor")
+	}
+
+	c := &jobCursor{}
+	if err := json.Unmarshal(b, c); err != nil {
+		return nil, fmt.Errorf("invalid cursor")
+	}
+	return c, nil
+}
+
+// jobSummary copies the parts of a job that are needed for listing pages and
+// for matching queries.
+func jobSummary(cluster string, j *job) *job {
+	return &job{
+		Cluster: cluster,
+		Details: j.Details,
+		conf: conf{
+			Input:         j.conf.Input,
+			Output:        j.conf.Output,
+			ScaldingSteps: j.conf.ScaldingSteps,
+			name:          j.conf.name,
+		},
+		FlowID: j.FlowID,
+	}
+}
+
+// parseJobQuery reads a query from URL parameters. Parameters that take a
+// list of values can either be repeated or comma separated.
+func parseJobQuery(params url.Values) (*jobQuery, error) {
+	q := &jobQuery{
+		ids:          paramJobIDs(params["id"]),
+		clusters:     paramSet(params["cluster"], false),
+		users:        paramSet(params["user"], false),
+		states:       paramSet(params["state"], true),
+		inputPrefix:  params.Get("input"),
+		outputPrefix: params.Get("output"),
+		flowID:       params.Get("flowID"),
+	}
+
+	var err error
+	if name := params.Get("name"); name != "" {
+		if q.name, err = regexp.Compile(name); err != nil {
+			return nil, fmt.Errorf("invalid name regex: %s", err)
+		}
+	}
+	if q.since, err = parseQueryTime(params.Get("since")); err != nil {
+		return nil, fmt.Errorf("invalid since: %s", err)
+	}
+	if q.until, err = parseQueryTime(params.Get("until")); err != nil {
+		return nil, fmt.Errorf("invalid until: %s", err)
+	}
+
+	q.sort = params.Get("sort")
+	if q.sort == "" {
+		q.sort = defaultJobSort
+	}
+	if strings.HasPrefix(q.sort, "-") {
+		q.sort = q.sort[1:]
+		q.desc = true
+	}
+	if _, ok := jobSortKeys[q.sort]; !ok {
+		return nil, fmt.Errorf("can't sort by %q", q.sort)
+	}
+
+	if limit := params.Get("limit"); limit != "" {
+		if q.limit, err = strconv.Atoi(limit); err != nil || q.limit < 0 {
+			return nil, fmt.Errorf("invalid limit %q", limit)
+		}
+	}
+
+	if cursor := params.Get("cursor"); cursor != "" {
+		if q.cursor, err = parseJobCursor(cursor); err != nil {
+			return nil, err
+		}
+	}
+
+	return q, nil
+}
+
+// paramJobIDs reads job IDs, which can be given as either job or application
+// IDs.
+func paramJobIDs(values []string) map[jobID]bool {
+	set := paramSet(values, false)
+	if set == nil {
+		return nil
+	}
+
+	ids := make(map[jobID]bool, len(set))
+	for id := range set {
+		_, jobID := hadoopIDs(id)
+		ids[jobID] = true
+	}
+	return ids
+}
+
+func paramSet(values []string, upper bool) map[string]bool {
+	if len(values) == 0 {
+		return nil
+	}
+
+	set := make(map[string]bool)
+	for _, value := range values {
+		for _, v := range strings.Split(value, ",") {
+			if upper {
+				v = strings.ToUpper(v)
+			}
+			if v != "" {
+				set[v] = true
+			}
+		}
+	}
+	return set
+}
+
+// parseQueryTime reads a time as either milliseconds since the epoch, like
+// the times in job details, or RFC 3339.
+func parseQueryTime(s string) (int64, error) {
+	if s == "" {
+		return 0, nil
+	}
+	if ms, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return ms, nil
+	}
+
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return 0, err
+	}
+	return t.UnixNano() / int64(time.Millisecond), nil
+}
+
+// matches reports whether a job passes the query's filters. The time window
+// matches jobs that were running at any point during it.
+func (q *jobQuery) matches(j *job) bool {
+	if q.ids != nil {
+		if _, id := hadoopIDs(j.Details.ID); !q.ids[id] {
+			return false
+		}
+	}
+	if q.clusters != nil && !q.clusters[j.Cluster] {
+		return false
+	}
+	if q.users != nil && !q.users[j.Details.User] {
+		return false
+	}
+	if q.states != nil && !q.states[j.Details.State] {
+		return false
+	}
+	if q.name != nil && !q.name.MatchString(j.Details.Name) {
+		return false
+	}
+	if q.since != 0 && j.Details.FinishTime != 0 && j.Details.FinishTime < q.since {
+		return false
+	}
+	if q.until != 0 && j.Details.StartTime > q.until {
+		return false
+	}
+	if q.inputPrefix != "" && !anyPathHasPrefix(j.conf.Input, q.inputPrefix) {
+		return false
+	}
+	if q.outputPrefix != "" && !anyPathHasPrefix(j.conf.Output, q.outputPrefix) {
+		return false
+	}
+	if q.flowID != "" && (j.FlowID == nil || *j.FlowID != q.flowID) {
+		return false
+	}
+	return true
+}
+
+// anyPathHasPrefix checks each of a comma separated list of paths, the way
+// jobs list their inputs.
+func anyPathHasPrefix(paths string, prefix string) bool {
+	for _, p := range strings.Split(paths, ",") {
+		if strings.HasPrefix(p, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func (q *jobQuery) cursorFor(j *job) *jobCursor {
+	n, s := jobSortKeys[q.sort](j)
+	return &jobCursor{N: n, S: s, Cluster: j.Cluster, ID: j.Details.ID}
+}
+
+// compare orders two positions by the sort field, breaking ties by cluster
+// and ID so that pages don't skip or repeat jobs.
+func (q *jobQuery) compare(a *jobCursor, b *jobCursor) int {
+	c := 0
+	switch {
+	case a.N != b.N:
+		c = compareInt64(a.N, b.N)
+	case a.S != b.S:
+		c = strings.Compare(a.S, b.S)
+	case a.Cluster != b.Cluster:
+		return strings.Compare(a.Cluster, b.Cluster)
+	default:
+		return strings.Compare(a.ID, b.ID)
+	}
+
+	if q.desc {
+		return -c
+	}
+	return c
+}
+
+func compareInt64(a int64, b int64) int {
+	if a < b {
+		return -1
+	} else if a > b {
+		return 1
+	}
+	return 0
+}
+
+// apply filters, sorts and pages jobs. It returns the cursor for the next
+// page, or nil if this is the last one.
+func (q *jobQuery) apply(jobs []*job) ([]*job, *jobCursor) {
+	matched := make([]*job, 0, len(jobs))
+	positions := make(map[*job]*jobCursor)
+	for _, j := range jobs {
+		if !q.matches(j) {
+			continue
+		}
+
+		pos := q.cursorFor(j)
+		if q.cursor != nil && q.compare(pos, q.cursor) <= 0 {
+			continue
+		}
+		matched = append(matched, j)
+		positions[j] = pos
+	}
+
+	sort.Slice(matched, func(a, b int) bool {
+		return q.compare(positions[matched[a]], positions[matched[b]]) < 0
+	})
+
+	if q.limit == 0 || len(matched) <= q.limit {
+		return matched, nil
+	}
+	matched = matched[:q.limit]
+	return matched, positions[matched[q.limit-1]]
+}
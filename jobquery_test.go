@@ -0,0 +1,75 @@
+package main
+
+import (
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func queryJobs() []*job {
+	flowID := "flow1"
+	return []*job{
+		{Cluster: "a", Details: jobDetail{ID: "job_1_0001", Name: "etl/daily", User: "alice", State: "SUCCEEDED", StartTime: 100, FinishTime: 200}, conf: conf{Input: "/data/in,/data/other"}},
+		{Cluster: "a", Details: jobDetail{ID: "job_1_0002", Name: "etl/hourly", User: "bob", State: "RUNNING", StartTime: 300}, FlowID: &flowID},
+		{Cluster: "b", Details: jobDetail{ID: "job_2_0001", Name: "report", User: "alice", State: "FAILED", StartTime: 300, FinishTime: 400}, conf: conf{Output: "/out/report"}},
+		{Cluster: "b", Details: jobDetail{ID: "job_2_0002", Name: "etl/backfill", User: "carol", State: "KILLED", StartTime: 500, FinishTime: 600}},
+	}
+}
+
+func queryIDs(t *testing.T, rawQuery string) ([]string, *jobCursor) {
+	params, err := url.ParseQuery(rawQuery)
+	require.NoError(t, err)
+	q, err := parseJobQuery(params)
+	require.NoError(t, err)
+
+	jobs, next := q.apply(queryJobs())
+	ids := make([]string, len(jobs))
+	for i, j := range jobs {
+		ids[i] = j.Details.ID
+	}
+	return ids, next
+}
+
+func TestJobQueryFilters(t *testing.T) {
+	tests := map[string][]string{
+		"":                           {"job_2_0002", "job_1_0002", "job_2_0001", "job_1_0001"},
+		"cluster=a":                  {"job_1_0002", "job_1_0001"},
+		"user=alice,carol":           {"job_2_0002", "job_2_0001", "job_1_0001"},
+		"state=failed&state=killed":  {"job_2_0002", "job_2_0001"},
+		"name=^etl/":                 {"job_2_0002", "job_1_0002", "job_1_0001"},
+		"since=250&until=450":        {"job_1_0002", "job_2_0001"},
+		"input=/data/other":          {"job_1_0001"},
+		"output=/out":                {"job_2_0001"},
+		"flowID=flow1":               {"job_1_0002"},
+		"sort=name":                  {"job_2_0002", "job_1_0001", "job_1_0002", "job_2_0001"},
+		"sort=startTime&cluster=b":   {"job_2_0001", "job_2_0002"},
+		"since=1970-01-01T00:00:00Z": {"job_2_0002", "job_1_0002", "job_2_0001", "job_1_0001"},
+	}
+
+	for rawQuery, expected := range tests {
+		ids, next := queryIDs(t, rawQuery)
+		assert.Equal(t, expected, ids, rawQuery)
+		assert.Nil(t, next, rawQuery)
+	}
+}
+
+func TestJobQueryPages(t *testing.T) {
+	// Two jobs start at the same time, so the page boundary falls on a tie.
+	ids, next := queryIDs(t, "limit=2")
+	assert.Equal(t, []string{"job_2_0002", "job_1_0002"}, ids)
+	require.NotNil(t, next)
+
+	ids, next = queryIDs(t, "limit=2&cursor="+next.String())
+	assert.Equal(t, []string{"job_2_0001", "job_1_0001"}, ids)
+	assert.Nil(t, next)
+}
+
+func TestJobQueryInvalid(t *testing.T) {
+	for _, rawQuery := range []string{"name=(", "since=yesterday", "sort=size", "limit=-1", "cursor=nope"} {
+		params, _ := url.ParseQuery(rawQuery)
+		_, err := parseJobQuery(params)
+		assert.Error(t, err, rawQuery)
+	}
+}
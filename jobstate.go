@@ -0,0 +1,228 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var stateDir = flag.String("state-dir", "", "A local directory where tracked jobs are saved, so they don't have to be backfilled from the history server after a restart. Leave empty to keep jobs in memory only.")
+
+var jobsBucket = []byte("jobs")
+var pinsBucket = []byte("pins")
+var metaBucket = []byte("meta")
+
+// backfilledKey is where the time the last complete backfill listed jobs up
+// to is kept in metaBucket.
+var backfilledKey = []byte("backfilled")
+
+// jobState persists the jobs tracked for a cluster to a local bolt database.
+type jobState struct {
+	db *bolt.DB
+}
+
+// storedJob is the persisted form of a job. Unlike job, all of its fields are
+// exported, so that none of them are lost in serialization.
+type storedJob struct {
+	Details  jobDetail `json:"details"`
+	Counters []counter `json:"counters"`
+	Conf     conf      `json:"conf"`
+	ConfName string    `json:"confName"`
+	Tasks    tasks     `json:"tasks"`
+	Running  bool      `json:"running"`
+	Partial  bool      `json:"partial"`
+	Updated  time.Time `json:"updated"`
+	FlowID   *string   `json:"flowID"`
+}
+
+func newStoredJob(j *job) *storedJob {
+	return &storedJob{
+		Details:  j.Details,
+		Counters: j.Counters,
+		Conf:     j.conf,
+		ConfName: j.conf.name,
+		Tasks:    j.Tasks,
+		Running:  j.running,
+		Partial:  j.partial,
+		Updated:  j.updated,
+		FlowID:   j.FlowID,
+	}
+}
+
+// jobChanged reports whether j differs from prev in anything that's saved,
+// apart from when it was last polled. Running jobs are polled far more often
+// than they change, and there's no point writing the same job again.
+func jobChanged(prev *job, j *job) bool {
+	if prev == nil {
+		return true
+	}
+	a, b := newStoredJob(prev), newStoredJob(j)
+	a.Updated, b.Updated = time.Time{}, time.Time{}
+	return !reflect.DeepEqual(a, b)
+}
+
+func (s *storedJob) job() *job {
+	j := &job{
+		Details:  s.Details,
+		Counters: s.Counters,
+		conf:     s.Conf,
+		Tasks:    s.Tasks,
+		running:  s.Running,
+		partial:  s.Partial,
+		updated:  s.Updated,
+		FlowID:   s.FlowID,
+	}
+	j.conf.name = s.ConfName
+	return j
+}
+
+// unsafeFileChars matches anything we won't put in a database's file name.
+var unsafeFileChars = regexp.MustCompile(`[^A-Za-z0-9._-]`)
+
+// jobStateFile returns the path of a cluster's job database in dir. Cluster
+// names come from the config, so anything that could escape dir is replaced.
+func jobStateFile(dir string, clusterName string) string {
+	name := unsafeFileChars.ReplaceAllString(clusterName, "_")
+	if name == "" || name == "." || name == ".." {
+		name = "_" + name
+	}
+	return filepath.Join(dir, name+".db")
+}
+
+// openJobState opens (or creates) the job database for a cluster in dir.
+func openJobState(dir string, clusterName string) (*jobState, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	db, err := bolt.Open(jobStateFile(dir, clusterName), 0644, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{jobsBucket, pinsBucket, metaBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &jobState{db: db}, nil
+}
+
+// save writes jobs to the database, replacing any previous versions of them.
+// Concurrent saves are batched into a single transaction.
+func (s *jobState) save(jobs map[jobID]*job) error {
+	values := make(map[jobID][]byte, len(jobs))
+	for id, j := range jobs {
+		value, err := json.Marshal(newStoredJob(j))
+		if err != nil {
+			return err
+		}
+		values[id] = value
+	}
+
+	return s.db.Batch(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(jobsBucket)
+		for id, value := range values {
+			if err := bucket.Put([]byte(id), value); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// remove deletes jobs from the database, along with their pins.
+func (s *jobState) remove(ids ...jobID) error {
+	return s.db.Batch(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{jobsBucket, pinsBucket} {
+			bucket := tx.Bucket(name)
+			for _, id := range ids {
+				if err := bucket.Delete([]byte(id)); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+func (s *jobState) setPinned(id jobID, pinned bool) error {
+	return s.db.Batch(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(pinsBucket)
+		if pinned {
+			return bucket.Put([]byte(id), []byte{1})
+		}
+		return bucket.Delete([]byte(id))
+	})
+}
+
+func (s *jobState) loadPins() (map[jobID]bool, error) {
+	pins := make(map[jobID]bool)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(pinsBucket).ForEach(func(k, v []byte) error {
+			pins[jobID(k)] = true
+			return nil
+		})
+	})
+	return pins, err
+}
+
+// load reads every saved job. It also returns the time, in milliseconds, that
+// the last complete history server backfill listed jobs up to, so that the
+// next one can pick up from there.
+func (s *jobState) load() (map[jobID]*job, int64, error) {
+	jobs := make(map[jobID]*job)
+	var backfilled int64
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		if v := tx.Bucket(metaBucket).Get(backfilledKey); v != nil {
+			if err := json.Unmarshal(v, &backfilled); err != nil {
+				return err
+			}
+		}
+
+		return tx.Bucket(jobsBucket).ForEach(func(k, v []byte) error {
+			stored := &storedJob{}
+			if err := json.Unmarshal(v, stored); err != nil {
+				return err
+			}
+
+			jobs[jobID(k)] = stored.job()
+			return nil
+		})
+	})
+
+	return jobs, backfilled, err
+}
+
+// setBackfilled records that every job that finished before backfilled, in
+// milliseconds, has been loaded. Backfills load the newest jobs first, so the
+// saved jobs' finish times can't tell us that.
+func (s *jobState) setBackfilled(backfilled int64) error {
+	value, err := json.Marshal(backfilled)
+	if err != nil {
+		return err
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(metaBucket).Put(backfilledKey, value)
+	})
+}
+
+func (s *jobState) close() error {
+	return s.db.Close()
+}
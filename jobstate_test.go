@@ -0,0 +1,169 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestJobStateRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "timberlake-state")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	state, err := openJobState(dir, "foo")
+	require.NoError(t, err, "opening a new job database should work")
+
+	finished := &job{
+		Details:  jobDetail{ID: "job_1_0001", State: "SUCCEEDED", FinishTime: 2000, yarnApp: yarnApp{Queue: "default"}},
+		Counters: []counter{{Name: "TaskCounter.MAP_INPUT_RECORDS", Total: 10, Map: 10}},
+		Tasks:    tasks{Map: [][]int64{{1000, 2000}}, Reduce: [][]int64{}},
+	}
+	finished.conf.update(map[string]string{"cascading.app.name": "appname", "mapreduce.input.fileinputformat.inputdir": "/input"})
+	running := &job{Details: jobDetail{ID: "job_1_0002", State: "RUNNING"}, running: true}
+	old := &job{Details: jobDetail{ID: "job_1_0003", State: "FAILED", FinishTime: 1000}, partial: true}
+
+	require.NoError(t, state.save(map[jobID]*job{"job_1_0001": finished, "job_1_0002": running, "job_1_0003": old}))
+	require.NoError(t, state.remove("job_1_0003"))
+	require.NoError(t, state.setBackfilled(3000))
+	require.NoError(t, state.close())
+
+	state, err = openJobState(dir, "foo")
+	require.NoError(t, err, "reopening the job database should work")
+	defer state.close()
+
+	jobs, backfilled, err := state.load()
+	require.NoError(t, err, "loading saved jobs should work")
+
+	assert.Equal(t, 2, len(jobs), "removed jobs should not be loaded")
+	assert.Equal(t, int64(3000), backfilled, "the backfill's progress should be saved")
+	assert.Equal(t, finished, jobs["job_1_0001"], "all of a job's details should be saved")
+	assert.Equal(t, "appname", jobs["job_1_0001"].conf.name, "the conf name should be saved")
+	assert.True(t, jobs["job_1_0002"].running, "running jobs should stay running")
+}
+
+func TestJobTrackerLoadState(t *testing.T) {
+	dir, err := ioutil.TempDir("", "timberlake-state")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	jt := newJobTracker("foo", "", "", new(mockJobClient), &hdfsJobHistoryClient{})
+	require.NoError(t, jt.loadState(dir))
+	jt.saveJob(&job{Details: jobDetail{ID: "application_1_0001", State: "SUCCEEDED", FinishTime: 5000}})
+	ok, err := jt.setPinned("job_1_0001", true)
+	require.NoError(t, err)
+	assert.True(t, ok)
+	jt.state.close()
+
+	jt = newJobTracker("foo", "", "", new(mockJobClient), &hdfsJobHistoryClient{})
+	require.NoError(t, jt.loadState(dir))
+	defer jt.state.close()
+
+	assert.True(t, jt.hasJob("job_1_0001"), "saved jobs should be tracked after a restart")
+	assert.Equal(t, int64(0), jt.backfilled, "the saved jobs' finish times shouldn't count as backfilled")
+	assert.True(t, jt.store.Pinned("job_1_0001"), "pins should be saved")
+}
+
+// recordingHistoryClient fails to load the jobs in failing as many times as
+// it says, and records the ones it loads.
+type recordingHistoryClient struct {
+	sync.Mutex
+	failing map[string]int
+	loaded  []string
+}
+
+func (c *recordingHistoryClient) updateFromHistoryFile(jt *jobTracker, job *job, full bool) error {
+	c.Lock()
+	defer c.Unlock()
+	if c.failing[job.Details.ID] > 0 {
+		c.failing[job.Details.ID]--
+		return errors.New("no history file")
+	}
+	c.loaded = append(c.loaded, job.Details.ID)
+	return nil
+}
+
+func TestInterruptedBackfill(t *testing.T) {
+	dir, err := ioutil.TempDir("", "timberlake-state")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	finished := time.Now().Add(-48 * time.Hour)
+	listed := &jobsResp{Jobs: jobsDetailList{Job: []jobDetail{
+		{ID: "job_1_0001", State: "SUCCEEDED", StartTime: finished.Unix() * 1000, FinishTime: finished.Unix() * 1000},
+		{ID: "job_1_0002", State: "SUCCEEDED", StartTime: finished.Unix()*1000 + 1000, FinishTime: finished.Unix()*1000 + 1000},
+		{ID: "job_1_0003", State: "SUCCEEDED", StartTime: finished.Unix()*1000 + 2000, FinishTime: finished.Unix()*1000 + 2000},
+	}}}
+	fromStart := mock.MatchedBy(func(since time.Time) bool {
+		return since.Before(time.Now().Add(-jobHistoryDuration + time.Minute))
+	})
+
+	// The oldest job is backfilled last, and fails to load.
+	client := new(mockJobClient)
+	client.On("listFinishedJobs", fromStart).Return(listed, nil)
+	history := &recordingHistoryClient{failing: map[string]int{"job_1_0001": 1}}
+	jt := newJobTracker("foo", "", "", client, history)
+	jt.config.PollInterval = time.Hour
+	require.NoError(t, jt.loadState(dir))
+	jt.start(jt.finishedJobLoop)
+	deadline := time.Now().Add(5 * time.Second)
+	for !(jt.hasJob("job_1_0002") && jt.hasJob("job_1_0003")) && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	jt.Stop()
+	jt.state.close()
+
+	// After a restart, the backfill should start over rather than from the
+	// newest saved job, and only load the job it missed.
+	client = new(mockJobClient)
+	client.On("listFinishedJobs", fromStart).Return(listed, nil)
+	history = &recordingHistoryClient{}
+	jt = newJobTracker("foo", "", "", client, history)
+	jt.config.PollInterval = time.Hour
+	require.NoError(t, jt.loadState(dir))
+	assert.Equal(t, int64(0), jt.backfilled)
+	jt.start(jt.finishedJobLoop)
+	deadline = time.Now().Add(5 * time.Second)
+	for !jt.hasJob("job_1_0001") && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	jt.Stop()
+	client.AssertExpectations(t)
+	assert.Equal(t, []string{"job_1_0001"}, history.loaded, "jobs that were already backfilled should be skipped")
+	assert.NotZero(t, jt.backfilled, "a complete backfill should be saved")
+	jt.state.close()
+
+	// Once a backfill has completed, the next only lists jobs since then.
+	state, err := openJobState(dir, "foo")
+	require.NoError(t, err)
+	defer state.close()
+	_, backfilled, err := state.load()
+	require.NoError(t, err)
+	assert.Equal(t, jt.backfilled, backfilled)
+	assert.True(t, time.Now().Add(-time.Minute).Before(time.Unix(backfilled/1000, 0)))
+}
+
+func TestJobStateFile(t *testing.T) {
+	assert.Equal(t, "/state/foo.db", jobStateFile("/state", "foo"))
+	assert.Equal(t, "/state/.._.._etc_passwd.db", jobStateFile("/state", "../../etc/passwd"))
+	assert.Equal(t, "/state/_...db", jobStateFile("/state", ".."))
+}
+
+func TestJobChanged(t *testing.T) {
+	prev := &job{Details: jobDetail{ID: "job_1_0001", State: "RUNNING", MapProgress: 10}, running: true, updated: time.Now()}
+	polled := *prev
+	polled.updated = prev.updated.Add(5 * time.Second)
+	assert.False(t, jobChanged(prev, &polled), "polling a job without changes shouldn't count as a change")
+
+	progressed := polled
+	progressed.Details.MapProgress = 20
+	assert.True(t, jobChanged(prev, &progressed))
+	assert.True(t, jobChanged(nil, prev), "new jobs are always changes")
+}
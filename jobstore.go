@@ -0,0 +1,168 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// jobStoreVersions numbers the versions of every store, so that no two
+// versions of any store have the same number.
+var jobStoreVersions uint64
+
+// jobStore holds the jobs tracked for a cluster. The jobs in it are
+// immutable: instead of changing a job, callers store a new version of it,
+// and Update does that with a copy. That way the pollers, the HTTP handlers
+// and sendUpdates can all hold on to jobs they got from the store without
+// locking them.
+type jobStore struct {
+	lock    sync.RWMutex
+	jobs    map[jobID]*job
+	pinned  map[jobID]bool
+	version uint64
+}
+
+func newJobStore() *jobStore {
+	return &jobStore{
+		jobs:    make(map[jobID]*job),
+		pinned:  make(map[jobID]bool),
+		version: atomic.AddUint64(&jobStoreVersions, 1),
+	}
+}
+
+// Version changes whenever a job changes, or is deleted.
+func (s *jobStore) Version() uint64 {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.version
+}
+
+// changed bumps the version. The caller has to hold the write lock.
+func (s *jobStore) changed() {
+	s.version = atomic.AddUint64(&jobStoreVersions, 1)
+}
+
+// Get returns the current version of a job, or nil if it isn't tracked.
+func (s *jobStore) Get(id jobID) *job {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.jobs[id]
+}
+
+// List returns the current version of every job.
+func (s *jobStore) List() []*job {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	jobs := make([]*job, 0, len(s.jobs))
+	for _, j := range s.jobs {
+		jobs = append(jobs, j)
+	}
+	return jobs
+}
+
+func (s *jobStore) Len() int {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return len(s.jobs)
+}
+
+// Put stores a new version of a job, and returns the previous one if there
+// was one. The job mustn't be changed after it's stored. Running jobs are
+// stored after every poll, but the version only changes if the job did.
+func (s *jobStore) Put(j *job) *job {
+	_, id := hadoopIDs(j.Details.ID)
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	prev := s.jobs[id]
+	s.jobs[id] = j
+	if jobChanged(prev, j) {
+		s.changed()
+	}
+	return prev
+}
+
+// CompareAndSwap stores a new version of a job, but only if prev is still
+// the current one.
+func (s *jobStore) CompareAndSwap(prev *job, j *job) bool {
+	_, id := hadoopIDs(j.Details.ID)
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.jobs[id] != prev {
+		return false
+	}
+	s.jobs[id] = j
+	s.changed()
+	return true
+}
+
+// Update applies f to a copy of a job, and stores the copy. The copy shares
+// its counters, tasks and conf with the previous version, so f has to
+// replace them rather than change them. It returns the new version, or nil
+// if the job isn't tracked.
+func (s *jobStore) Update(id jobID, f func(j *job)) *job {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	prev := s.jobs[id]
+	if prev == nil {
+		return nil
+	}
+	next := *prev
+	f(&next)
+	s.jobs[id] = &next
+	s.changed()
+	return &next
+}
+
+// Delete stops tracking jobs, and returns the ones that were tracked.
+func (s *jobStore) Delete(ids ...jobID) []*job {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	var deleted []*job
+	for _, id := range ids {
+		if j, ok := s.jobs[id]; ok {
+			deleted = append(deleted, j)
+			delete(s.jobs, id)
+			delete(s.pinned, id)
+		}
+	}
+	if deleted != nil {
+		s.changed()
+	}
+	return deleted
+}
+
+// Pin pins or unpins a job, and reports whether it's tracked.
+func (s *jobStore) Pin(id jobID, pinned bool) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	_, ok := s.jobs[id]
+	if ok && pinned {
+		s.pinned[id] = true
+	} else {
+		delete(s.pinned, id)
+	}
+	return ok
+}
+
+func (s *jobStore) Pinned(id jobID) bool {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.pinned[id]
+}
+
+// Sweep calls f with the jobs and pins while nothing else can use them, for
+// changes that have to see every job at once. Like everywhere else, f can
+// replace and delete jobs, but not change them, and it reports whether it
+// did either.
+func (s *jobStore) Sweep(f func(jobs map[jobID]*job, pinned map[jobID]bool) bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if f(s.jobs, s.pinned) {
+		s.changed()
+	}
+}
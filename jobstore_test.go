@@ -0,0 +1,46 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestJobStore(t *testing.T) {
+	s := newJobStore()
+	first := &job{Details: jobDetail{ID: "application_1_0001", State: "RUNNING"}, Tasks: tasks{Map: [][]int64{{1, 0}}}, running: true}
+	assert.Nil(t, s.Put(first))
+	assert.True(t, s.Get("job_1_0001") == first, "jobs should be stored under their job ID")
+	assert.True(t, s.Pin("job_1_0001", true))
+	assert.False(t, s.Pin("job_1_0002", true), "only tracked jobs can be pinned")
+
+	killed := s.Update("job_1_0001", func(j *job) {
+		j.Details.State = "KILLED"
+		j.Tasks.Map = killTasks(j.Tasks.Map, 2)
+	})
+	require.NotNil(t, killed)
+	assert.Equal(t, "KILLED", s.Get("job_1_0001").Details.State)
+	assert.Equal(t, [][]int64{{1, 2}}, killed.Tasks.Map)
+	assert.Equal(t, "RUNNING", first.Details.State, "updates should copy the job")
+	assert.Equal(t, [][]int64{{1, 0}}, first.Tasks.Map)
+	assert.Nil(t, s.Update("job_1_0002", func(j *job) {}))
+
+	assert.False(t, s.CompareAndSwap(first, &job{Details: first.Details}), "stale versions shouldn't be swapped")
+	assert.True(t, s.Get("job_1_0001") == killed)
+
+	version := s.Version()
+	polled := *killed
+	polled.updated = time.Now()
+	assert.True(t, s.Put(&polled) == killed)
+	assert.True(t, s.Get("job_1_0001") == &polled, "polled jobs should still be stored")
+	assert.Equal(t, version, s.Version(), "storing an unchanged job shouldn't change the version")
+	s.Sweep(func(jobs map[jobID]*job, pinned map[jobID]bool) bool { return false })
+	assert.Equal(t, version, s.Version(), "sweeps that don't change anything shouldn't change the version")
+
+	assert.Len(t, s.List(), 1)
+	assert.Equal(t, []*job{&polled}, s.Delete("job_1_0001", "job_1_0002"))
+	assert.Equal(t, 0, s.Len())
+	assert.False(t, s.Pinned("job_1_0001"), "deleted jobs should be unpinned")
+}
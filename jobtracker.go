@@ -4,10 +4,12 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
+	"reflect"
 	"runtime"
 	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -19,9 +21,9 @@ const (
 	// primarily useful during the initial data backfill.
 	finishedJobWorkers = 3
 
-	// Maximum number of jobs to keep track of per cluster. All data is retained
-	// in memory on the server, and the details for each job are sent to the
-	// browser.
+	// Maximum number of finished jobs to keep track of per cluster. All data
+	// is retained in memory on the server, and the details for each job are
+	// sent to the browser.
 	jobLimit = 5000
 
 	// How many hours of history should we ask for from the job server?
@@ -52,8 +54,8 @@ type jobTracker struct {
 	clusterName              string
 	publicResourceManagerURL string
 	publicHistoryServerURL   string
-	jobs                     map[jobID]*job
-	jobsLock                 sync.Mutex
+	store                    *jobStore
+	details                  *detailCache
 	rm                       string
 	hs                       string
 	ps                       string
@@ -61,7 +63,34 @@ type jobTracker struct {
 	running                  chan *job
 	finished                 chan *job
 	backfill                 chan *job
-	updates                  chan *job
+	updates                  chan trackerEvent
+
+	// Where jobs are persisted across restarts, if anywhere, and the time, in
+	// milliseconds, that the last complete backfill saved to it got up to.
+	state      *jobState
+	backfilled int64
+
+	// The jobs queued by the backfill that haven't been loaded yet, and
+	// whether any of them failed to load.
+	backfillPending sync.WaitGroup
+	backfillFailed  int32
+
+	// Where fully loaded finished jobs are archived, if anywhere.
+	archive PersistedJobClient
+
+	// The connection to the cluster's HDFS, for history files and logs.
+	hdfs *hdfsPool
+
+	// Where finished jobs' history files are read from.
+	history historySource
+
+	// The cluster's settings, from the config file or the flags.
+	config clusterConfig
+
+	// Closed to stop the tracker's goroutines, when its cluster is removed
+	// or reconfigured.
+	stop    chan struct{}
+	stopped sync.WaitGroup
 }
 
 func newJobTracker(clusterName string, publicResourceManagerURL string, publicHistoryServerURL string, jobClient RecentJobClient, jobHistoryClient HdfsJobHistoryClient) *jobTracker {
@@ -72,141 +101,288 @@ func newJobTracker(clusterName string, publicResourceManagerURL string, publicHi
 		publicHistoryServerURL:   publicHistoryServerURL,
 
 		jobClient: jobClient,
-		jobs:      make(map[jobID]*job),
+		store:     newJobStore(),
+		details:   newDetailCache(*detailCacheSize),
 		running:   make(chan *job),
 		finished:  make(chan *job),
 		backfill:  make(chan *job),
-		updates:   make(chan *job),
+		updates:   make(chan trackerEvent),
+		config:    flagDefaults(clusterConfig{Name: clusterName}),
+		stop:      make(chan struct{}),
+	}
+}
+
+// loadState opens the cluster's job database in dir, and starts tracking the
+// jobs saved in it. Jobs are saved to it from then on.
+func (jt *jobTracker) loadState(dir string) error {
+	state, err := openJobState(dir, jt.clusterName)
+	if err != nil {
+		return err
+	}
+
+	jobs, backfilled, err := state.load()
+	if err != nil {
+		state.close()
+		return err
+	}
+	pins, err := state.loadPins()
+	if err != nil {
+		state.close()
+		return err
+	}
+
+	// Running jobs are only saved when they change, so the last time one was
+	// polled is lost. Give them until the usual timeout to show up again.
+	now := time.Now()
+	for _, job := range jobs {
+		if job.running {
+			job.updated = now
+		}
 	}
+
+	jt.store.Sweep(func(tracked map[jobID]*job, pinned map[jobID]bool) bool {
+		for id, job := range jobs {
+			tracked[id] = job
+		}
+		for id := range pins {
+			pinned[id] = true
+		}
+		return len(jobs) > 0
+	})
+
+	jt.state = state
+	jt.backfilled = backfilled
+	log.Printf("Loaded %d saved jobs for cluster %s\n", len(jobs), jt.clusterName)
+	return nil
 }
 
 func (jt *jobTracker) Loop() {
-	go jt.runningJobLoop()
-	go jt.finishedJobLoop()
-	go jt.cleanupLoop()
+	jt.start(jt.runningJobLoop)
+	jt.start(jt.finishedJobLoop)
+	jt.start(jt.cleanupLoop)
+}
+
+// start runs f in a goroutine that Stop waits for.
+func (jt *jobTracker) start(f func()) {
+	jt.stopped.Add(1)
+	go func() {
+		defer jt.stopped.Done()
+		f()
+	}()
+}
+
+// Stop stops polling, and waits for any requests in progress to finish.
+func (jt *jobTracker) Stop() {
+	close(jt.stop)
+	jt.stopped.Wait()
+	if jt.hdfs != nil {
+		jt.hdfs.Close()
+	}
+}
+
+func (jt *jobTracker) hdfsStatus() *hdfsStatus {
+	if jt.hdfs == nil {
+		return nil
+	}
+	return jt.hdfs.status()
+}
+
+// wait waits for the next tick, and returns false if the tracker is stopped
+// first.
+func (jt *jobTracker) wait(ticker *time.Ticker) bool {
+	select {
+	case <-ticker.C:
+		return true
+	case <-jt.stop:
+		return false
+	}
+}
+
+// queue hands a job to the workers, and returns false if the tracker is
+// stopped first.
+func (jt *jobTracker) queue(jobs chan *job, job *job) bool {
+	select {
+	case jobs <- job:
+		return true
+	case <-jt.stop:
+		return false
+	}
+}
+
+// publish hands an event to sendUpdates. It's dropped if the tracker is
+// stopped.
+func (jt *jobTracker) publish(event trackerEvent) {
+	select {
+	case jt.updates <- event:
+	case <-jt.stop:
+	}
 }
 
 func (jt *jobTracker) runningJobLoop() {
 	for x := 1; x <= runningJobWorkers; x++ {
-		go func() {
-			for job := range jt.running {
-				err := jt.updateJob(job)
-				if err != nil {
-					log.Println("An error occurred updating the job", job.Details.ID, err)
-					// If a job is brand new we won't be able to fetch details from
-					// the RM, so we'll get an error and end up here. If the job
-					// doesn't exist in the jobs map then we'll assume that's
-					// why we're here and let the mostly-empty job data
-					// propagate anyways.
-					if jt.hasJob(job.Details.ID) {
-						continue
-					}
+		jt.start(func() {
+			for {
+				var job *job
+				select {
+				case job = <-jt.running:
+				case <-jt.stop:
+					return
 				}
 
-				jt.saveJob(job)
-				jt.updates <- job
+				jt.updateRunningJob(job)
 			}
-		}()
+		})
 	}
 
-	for range time.Tick(*pollInterval) {
+	ticker := time.NewTicker(jt.config.PollInterval)
+	defer ticker.Stop()
+
+	// Clients are only sent the cluster's status when it changes, rather than
+	// after every poll.
+	var lastStatus *clusterStatus
+	sendStatus := func(status *clusterStatus) {
+		unpolled := *status
+		unpolled.LastPoll = 0
+		if lastStatus != nil && reflect.DeepEqual(*lastStatus, unpolled) {
+			return
+		}
+		lastStatus = &unpolled
+		jt.publish(trackerEvent{typ: eventClusterStatus, status: status})
+	}
+
+	var lastPoll time.Time
+	for jt.wait(ticker) {
 		log.Printf("Listing running jobs in cluster %s on resource manager %s\n", jt.clusterName, jt.rm)
 		running, err := jt.jobClient.listJobs()
 		if err != nil {
 			log.Println("Error listing running jobs:", err)
+			sendStatus(&clusterStatus{
+				Cluster:  jt.clusterName,
+				Error:    err.Error(),
+				LastPoll: lastPoll.UnixNano() / int64(time.Millisecond),
+				HDFS:     jt.hdfsStatus(),
+			})
 			continue
 		}
+		lastPoll = time.Now()
+		metrics.set(lastPollMetric, float64(lastPoll.Unix()), "cluster", jt.clusterName)
 
-		jt.jobsLock.Lock()
 		log.Printf("Running jobs in cluster %s: %d\n", jt.clusterName, len(running.Apps.App))
-		log.Println("Jobs in cache:", len(jt.jobs))
+		log.Println("Jobs in cache:", jt.store.Len())
 		log.Println("Goroutines:", runtime.NumGoroutine())
 
 		// We rely on jobs moving from the RM to the History Server when they
 		// stop running. This doesn't always happen. If we detect a job that's
-		// disappeared, mark it as GONE and forget about it. The frontend
-		// doesn't know what GONE means so it ignores the job.
-		for jobID, job := range jt.jobs {
-			if job.running && time.Now().Sub(job.updated).Seconds() > 30*pollInterval.Seconds() {
-				log.Printf("%s in cluster %s has not been updated in thirty ticks. Removing.\n", jobID, jt.clusterName)
-				job.Details.State = "GONE"
-				jt.updates <- job
-				_, jobID := hadoopIDs(job.Details.ID)
-				delete(jt.jobs, jobID)
+		// disappeared, forget about it.
+		var gone []*job
+		var goneIDs []jobID
+		var tracked int
+		jt.store.Sweep(func(jobs map[jobID]*job, pinned map[jobID]bool) bool {
+			for jobID, job := range jobs {
+				if job.running && time.Now().Sub(job.updated).Seconds() > 30*jt.config.PollInterval.Seconds() {
+					log.Printf("%s in cluster %s has not been updated in thirty ticks. Removing.\n", jobID, jt.clusterName)
+					delete(jobs, jobID)
+					delete(pinned, jobID)
+					gone = append(gone, job)
+					goneIDs = append(goneIDs, jobID)
+				}
 			}
-		}
-		jt.jobsLock.Unlock()
+			tracked = len(jobs)
+			return len(gone) > 0
+		})
+		jt.forgetJobs(goneIDs...)
 
+		for _, job := range gone {
+			jt.publish(trackerEvent{typ: eventJobRemoved, job: job, reason: removedGone})
+		}
+		sendStatus(&clusterStatus{
+			Cluster:     jt.clusterName,
+			OK:          true,
+			RunningJobs: len(running.Apps.App),
+			TrackedJobs: tracked,
+			LastPoll:    lastPoll.UnixNano() / int64(time.Millisecond),
+			HDFS:        jt.hdfsStatus(),
+		})
+
+		listed := make(map[jobID]bool, len(running.Apps.App))
 		for i := range running.Apps.App {
-			job := &job{Details: running.Apps.App[i], running: true, updated: time.Now()}
-			jt.running <- job
+			job := &job{Details: running.Apps.App[i].jobDetail(), running: true, updated: time.Now()}
+			_, id := hadoopIDs(job.Details.ID)
+			listed[id] = true
+			if !jt.queue(jt.running, job) {
+				return
+			}
 		}
+
+		jt.finishApps(listed)
 	}
 
 }
 
+// updateRunningJob fills in a job listed by the resource manager with its
+// framework's details, and saves it.
+func (jt *jobTracker) updateRunningJob(job *job) {
+	err := jt.updateJob(job)
+	if err != nil {
+		log.Println("An error occurred updating the job", job.Details.ID, err)
+		// If a job is brand new we won't be able to fetch details from
+		// the RM, so we'll get an error and end up here. If the job
+		// doesn't exist in the jobs map then we'll assume that's
+		// why we're here and let the mostly-empty job data
+		// propagate anyways.
+		prev := jt.getJob(job.Details.ID)
+		if prev != nil {
+			if job.isMapReduce() {
+				return
+			}
+			// Other apps' details all come from the resource manager's
+			// listing, which is still good, so keep them polled with the
+			// last stages or vertices we saw.
+			job.keepEnrichment(prev)
+		}
+	}
+
+	jt.publish(trackerEvent{typ: jt.saveJob(job), job: job})
+}
+
 func (jt *jobTracker) finishedJobLoop() {
 	for x := 1; x <= finishedJobWorkers; x++ {
-		go func() {
+		jt.start(func() {
 			for {
 				var job *job
+				var backfilled bool
 
 				select {
 				case job = <-jt.finished:
 				case job = <-jt.backfill:
+					backfilled = true
+				case <-jt.stop:
+					return
 				}
 
-				full := job.Details.FinishTime/1000 > time.Now().Add(-fullDataDuration).Unix()
-				err := jt.jobHistoryClient.updateFromHistoryFile(jt, job, full)
+				err := jt.loadFinishedJob(job)
 				if err != nil {
-					log.Println("An error occurred updating from history file", job.Details.ID, err)
-					continue
+					jt.retryFinishedJob(job)
+				}
+				if backfilled {
+					if err != nil {
+						atomic.StoreInt32(&jt.backfillFailed, 1)
+					}
+					jt.backfillPending.Done()
 				}
-
-				job.updated = time.Now()
-				jt.saveJob(job)
-				jt.updates <- job
 			}
-		}()
+		})
 	}
 
-	go func() {
-		var backfill *jobsResp
-		var err error
-		for {
-			backfill, err = jt.jobClient.listFinishedJobs(time.Now().Add(-jobHistoryDuration))
-			if err != nil {
-				log.Println("Error listing backfill jobs:", err)
-				time.Sleep(time.Second * 5)
-			} else {
-				break
-			}
-		}
-
-		// This sorts in reverse order of start time so that we'll fill in the
-		// details for the newest jobs first.
-		sort.Sort(sort.Reverse(jobDetails(backfill.Jobs.Job)))
-		total := len(backfill.Jobs.Job)
-		log.Println("Jobs to backfill:", total)
-		for i := range backfill.Jobs.Job {
-			if i > jobLimit {
-				break
-			}
-
-			if i%100 == 0 {
-				log.Printf("Backfilled %d/%d jobs", i, total)
-			}
-
-			jt.backfill <- &job{Details: backfill.Jobs.Job[i], running: false}
-		}
+	jt.start(jt.backfillJobs)
 
-		log.Println("Finished backfilling jobs.")
-	}()
+	ticker := time.NewTicker(jt.config.PollInterval)
+	defer ticker.Stop()
 
-	for range time.Tick(*pollInterval) {
+	for jt.wait(ticker) {
 		dur := 1 * time.Minute
-		if dur < (*pollInterval * 2) {
-			dur = *pollInterval * 2
+		if dur < (jt.config.PollInterval * 2) {
+			dur = jt.config.PollInterval * 2
 		}
 
 		finished, err := jt.jobClient.listFinishedJobs(time.Now().Add(-dur))
@@ -226,148 +402,364 @@ func (jt *jobTracker) finishedJobLoop() {
 				}
 			}
 
-			jt.finished <- &job{Details: finished.Jobs.Job[i], running: false}
+			if !jt.queue(jt.finished, &job{Details: finished.Jobs.Job[i], running: false}) {
+				return
+			}
 		}
 	}
 }
 
-func (jt *jobTracker) cleanupLoop() {
-	for range time.Tick(time.Second * 60) {
-		jt.jobsLock.Lock()
+// loadFinishedJob fills in a finished job from its history file, saves it, and
+// archives it if it was fully loaded.
+func (jt *jobTracker) loadFinishedJob(job *job) error {
+	full := job.Details.FinishTime/1000 > time.Now().Add(-fullDataDuration).Unix()
+	start := time.Now()
+	err := jt.jobHistoryClient.updateFromHistoryFile(jt, job, full)
+	observeRequest(jt.clusterName, "hdfs", "historyFile", start, err)
+	if err != nil {
+		log.Println("An error occurred updating from history file", job.Details.ID, err)
+		return err
+	}
 
-		details := make(jobDetails, 0)
-		for _, job := range jt.jobs {
-			if job.Details.State == "SUCCEEDED" {
-				details = append(details, job.Details)
-			}
+	archived := *job
+	job.attempts = nil
+	job.updated = time.Now()
+	typ := jt.saveJob(job)
+	if full && jt.archive != nil {
+		if err := jt.archive.StoreJob(&archived); err != nil {
+			log.Println("An error occurred archiving job", job.Details.ID, err)
+			metrics.add(archiveErrorsMetric, 1, "cluster", jt.clusterName)
 		}
+	}
+	jt.publish(trackerEvent{typ: typ, job: job})
+	return nil
+}
+
+// retryFinishedJob queues a job that couldn't be loaded again after a while,
+// if it only just finished. The history server can take a while to write its
+// files, and then to move them. The workers get on with other jobs in the
+// meantime.
+func (jt *jobTracker) retryFinishedJob(job *job) {
+	if job.retries >= len(historyRetryDelays) || time.Since(time.Unix(job.Details.FinishTime/1000, 0)) >= historyRetryWindow {
+		return
+	}
+
+	delay := historyRetryDelays[job.retries]
+	job.retries++
+	time.AfterFunc(delay, func() {
+		jt.queue(jt.finished, job)
+	})
+}
 
-		// Enforce the job limit.
-		before := len(jt.jobs)
-		if len(details) > jobLimit {
-			sort.Sort(sort.Reverse(details))
-			for _, d := range details[jobLimit:] {
-				_, jobID := hadoopIDs(d.ID)
-				delete(jt.jobs, jobID)
+// backfillJobs loads the jobs that finished while we weren't running from the
+// history server, newest first. Once they've all been loaded, the time they
+// were listed at is saved, and the next backfill only lists jobs since then.
+// An interrupted backfill saves nothing, so the next one starts over, and
+// skips the jobs this one saved.
+func (jt *jobTracker) backfillJobs() {
+	since := time.Now().Add(-jobHistoryDuration)
+	if saved := time.Unix(jt.backfilled/1000, 0); saved.After(since) {
+		since = saved
+	}
+
+	var backfill *jobsResp
+	var err error
+	listed := time.Now()
+	for {
+		backfill, err = jt.jobClient.listFinishedJobs(since)
+		if err != nil {
+			log.Println("Error listing backfill jobs:", err)
+			select {
+			case <-time.After(time.Second * 5):
+			case <-jt.stop:
+				return
 			}
+			listed = time.Now()
+		} else {
+			break
 		}
+	}
 
-		log.Printf("Forgot about %d jobs to stay near the limit.\n", len(jt.jobs)-before)
+	// This sorts in reverse order of start time so that we'll fill in the
+	// details for the newest jobs first.
+	sort.Sort(sort.Reverse(jobDetails(backfill.Jobs.Job)))
+	total := len(backfill.Jobs.Job)
+	log.Println("Jobs to backfill:", total)
+	metrics.set(backfillJobsMetric, float64(total), "cluster", jt.clusterName)
+	for i := range backfill.Jobs.Job {
+		if i > jobLimit {
+			break
+		}
 
-		// Drop tasks and counters for old jobs since those are only visible in
-		// details pages (and unlikely to be viewed).
+		if i%100 == 0 {
+			log.Printf("Backfilled %d/%d jobs", i, total)
+		}
+		metrics.set(backfillJobsQueuedMetric, float64(i+1), "cluster", jt.clusterName)
 
-		counter := 0
-		for jobID, j := range jt.jobs {
-			if j.running || j.partial {
-				continue
-			}
+		details := backfill.Jobs.Job[i]
+		if j := jt.getJob(details.ID); j != nil && j.Details.State == details.State {
+			continue
+		}
 
-			cutoff := time.Now().Add(-fullDataDuration).Unix()
-			if j.Details.FinishTime/1000 < cutoff {
-				cleaned := &job{Details: j.Details, running: j.running, partial: true}
-				jt.jobs[jobID] = cleaned
-				counter++
-			}
+		jt.backfillPending.Add(1)
+		if !jt.queue(jt.backfill, &job{Details: details, running: false}) {
+			jt.backfillPending.Done()
+			return
+		}
+	}
+
+	jt.backfillPending.Wait()
+	if atomic.LoadInt32(&jt.backfillFailed) != 0 {
+		log.Println("Some jobs couldn't be backfilled. They'll be tried again after a restart.")
+		return
+	}
+	log.Println("Finished backfilling jobs.")
+
+	if jt.state != nil {
+		backfilled := listed.UnixNano() / int64(time.Millisecond)
+		if err := jt.state.setBackfilled(backfilled); err != nil {
+			log.Println("Error saving backfill progress:", err)
+			return
+		}
+		jt.backfilled = backfilled
+	}
+}
+
+func (jt *jobTracker) cleanupLoop() {
+	ticker := time.NewTicker(time.Second * 60)
+	defer ticker.Stop()
+
+	for jt.wait(ticker) {
+		evicted, cleanedJobs := jt.shrinkCache(time.Now())
+		log.Printf("Forgot about %d jobs to stay near the limit.\n", len(evicted))
+		log.Printf("Dropped full data for %d older jobs.\n", len(cleanedJobs))
+
+		forgotten := make([]jobID, len(evicted))
+		for i, job := range evicted {
+			_, forgotten[i] = hadoopIDs(job.Details.ID)
 		}
+		jt.forgetJobs(forgotten...)
+		jt.persistJobs(cleanedJobs)
 
-		jt.jobsLock.Unlock()
-		log.Printf("Dropped full data for %d older jobs.\n", counter)
+		for _, job := range evicted {
+			jt.publish(trackerEvent{typ: eventJobRemoved, job: job, reason: removedEvicted})
+		}
+		// Trimming can touch thousands of jobs at once, which would crowd
+		// everything else out of the event buffers one event at a time.
+		if len(cleanedJobs) > 0 {
+			trimmed := make([]string, 0, len(cleanedJobs))
+			for _, job := range cleanedJobs {
+				trimmed = append(trimmed, job.Details.ID)
+			}
+			sort.Strings(trimmed)
+			jt.publish(trackerEvent{typ: eventJobsTrimmed, trimmed: trimmed})
+		}
 	}
 }
 
 func (jt *jobTracker) hasJob(id string) bool {
 	_, jobID := hadoopIDs(id)
 
-	jt.jobsLock.Lock()
-	defer jt.jobsLock.Unlock()
-
-	_, exists := jt.jobs[jobID]
-	return exists
+	return jt.store.Get(jobID) != nil
 }
 
 func (jt *jobTracker) getJob(id string) *job {
 	_, jobID := hadoopIDs(id)
 
-	jt.jobsLock.Lock()
-	defer jt.jobsLock.Unlock()
-
-	return jt.jobs[jobID]
+	return jt.store.Get(jobID)
 }
 
-func (jt *jobTracker) reifyJob(job *job) {
-	if !job.running && job.partial {
-		err := jt.jobHistoryClient.updateFromHistoryFile(jt, job, true)
+// reifyJob returns a copy of a job with its URLs filled in, and its full
+// details loaded if they were dropped.
+func (jt *jobTracker) reifyJob(j *job) *job {
+	reified := *j
+	if !j.running && j.partial {
+		_, id := hadoopIDs(j.Details.ID)
+		full, result, err := jt.details.load(id, func() (*job, error) {
+			return jt.loadFullJob(j)
+		})
+		metrics.add(detailCacheRequestsMetric, 1, "cluster", jt.clusterName, "result", result)
 		if err != nil {
 			log.Println("Error loading full details for job:", err)
+		} else {
+			reified = *full
 		}
 	}
 
-	appID, _jobID := hadoopIDs(job.Details.ID)
+	appID, _jobID := hadoopIDs(reified.Details.ID)
+
+	reified.Cluster = jt.clusterName
+	reified.ResourceManagerURL = fmt.Sprintf("%s/cluster/app/%s", jt.publicResourceManagerURL, appID)
+	reified.JobHistoryURL = fmt.Sprintf("%s/jobhistory/job/%s", jt.publicHistoryServerURL, _jobID)
+	return &reified
+}
 
-	job.Cluster = jt.clusterName
-	job.ResourceManagerURL = fmt.Sprintf("%s/cluster/app/%s", jt.publicResourceManagerURL, appID)
-	job.JobHistoryURL = fmt.Sprintf("%s/jobhistory/job/%s", jt.publicHistoryServerURL, _jobID)
+// loadFullJob returns a copy of a trimmed job with its tasks, counters and
+// conf loaded from its history file.
+func (jt *jobTracker) loadFullJob(j *job) (*job, error) {
+	// Loading the history file appends to the counters and sets conf flags,
+	// which the stored job mustn't see.
+	full := *j
+	full.Counters = append([]counter(nil), j.Counters...)
+	full.conf.Flags = nil
+	full.conf.update(j.conf.Flags)
+
+	if err := jt.jobHistoryClient.updateFromHistoryFile(jt, &full, true); err != nil {
+		return nil, err
+	}
+	full.attempts = nil
+	return &full, nil
 }
 
-func (jt *jobTracker) saveJob(job *job) {
-	_, jobID := hadoopIDs(job.Details.ID)
+// saveJob stores the latest version of a job, and returns the type of event
+// that clients should be sent about it.
+func (jt *jobTracker) saveJob(j *job) string {
+	_, id := hadoopIDs(j.Details.ID)
 
-	jt.jobsLock.Lock()
-	defer jt.jobsLock.Unlock()
+	prev := jt.store.Put(j)
+	if jobChanged(prev, j) {
+		jt.persistJobs(map[jobID]*job{id: j})
+	}
 
-	jt.jobs[jobID] = job
+	if prev == nil {
+		return eventJobAdded
+	} else if prev.running && !j.running {
+		return eventJobFinished
+	}
+	return eventJobUpdated
 }
 
-// updateJob reads the latest state from the resourcemanager.
-func (jt *jobTracker) updateJob(job *job) error {
-	details, err := jt.jobClient.fetchJobDetails(job.Details.ID)
-	if err != nil {
-		log.Println("An error occurred fetching job details", job.Details.ID, err)
-		return err
+// persistJobs writes jobs through to the cluster's job database, if there is
+// one.
+func (jt *jobTracker) persistJobs(jobs map[jobID]*job) {
+	if jt.state == nil || len(jobs) == 0 {
+		return
 	}
-	job.Details = details
 
-	conf, err := jt.jobClient.fetchConf(job.Details.ID)
-	if err != nil {
-		log.Println("An error occurred fetching job conf", job.Details.ID, err)
-		return err
+	if err := jt.state.save(jobs); err != nil {
+		log.Println("Error saving jobs", err)
 	}
-	job.conf.update(conf)
+}
 
-	// This is a hack because Brushfire isn't setting the job name properly.
-	if strings.Index(job.Details.Name, "null/") != -1 && job.conf.name != "" {
-		job.Details.Name = strings.Replace(job.Details.Name, "null/", job.conf.name+"/", 1)
+// forgetJobs removes jobs from the cluster's job database, if there is one.
+func (jt *jobTracker) forgetJobs(ids ...jobID) {
+	if jt.state == nil || len(ids) == 0 {
+		return
 	}
 
-	counters, err := jt.jobClient.listCounters(job.Details.ID)
-	if err != nil {
-		log.Println("An error occurred fetching job counters", job.Details.ID, err)
-		return err
+	if err := jt.state.remove(ids...); err != nil {
+		log.Println("Error removing saved jobs", err)
 	}
-	job.Counters = counters
+}
 
-	tasks, err := jt.jobClient.fetchTasks(job.Details.ID)
-	if err != nil {
-		log.Println("An error occurred fetching job tasks", job.Details.ID, err)
-		return err
+// updateJob fills in the details of a running job beyond what the
+// resourcemanager's listing provides, using the enricher for its application
+// type.
+func (jt *jobTracker) updateJob(job *job) error {
+	enricher, ok := appEnrichers[job.Details.Type]
+	if !ok {
+		return nil
 	}
-	job.Details.MapsTotalTime = sumTimes(tasks.Map)
-	job.Details.ReducesTotalTime = sumTimes(tasks.Reduce)
-	job.Tasks.Map = trimTasks(tasks.Map)
-	job.Tasks.Reduce = trimTasks(tasks.Reduce)
+	return enricher.enrich(jt.jobClient, job)
+}
 
-	return nil
+// finishApps looks up the final state of running jobs that are no longer
+// listed by the resource manager. The history server only picks up MapReduce
+// jobs, so other application types would otherwise be stuck running until
+// they're removed.
+func (jt *jobTracker) finishApps(listed map[jobID]bool) {
+	var gone []*job
+	for _, job := range jt.store.List() {
+		_, id := hadoopIDs(job.Details.ID)
+		if job.running && !job.isMapReduce() && !listed[id] {
+			gone = append(gone, job)
+		}
+	}
+
+	for _, j := range gone {
+		details, err := jt.jobClient.fetchAppDetails(j.Details.ID)
+		if err != nil {
+			log.Println("An error occurred fetching final app details", j.Details.ID, err)
+			continue
+		}
+
+		finished := &job{
+			Details:  details,
+			Counters: j.Counters,
+			conf:     j.conf,
+			Tasks:    j.Tasks,
+			running:  details.FinishTime == 0,
+			updated:  time.Now(),
+		}
+		finished.Details.MapsTotal = j.Details.MapsTotal
+		finished.Details.MapsCompleted = j.Details.MapsCompleted
+		finished.Details.MapsFailed = j.Details.MapsFailed
+		finished.Details.MapsKilled = j.Details.MapsKilled
+		finished.Details.MapsTotalTime = j.Details.MapsTotalTime
+		finished.Details.MapProgress = j.Details.MapProgress
+
+		jt.publish(trackerEvent{typ: jt.saveJob(finished), job: finished})
+	}
 }
 
+// sendUpdates serializes each event's payload, and publishes it to SSE
+// clients. Updates to running jobs also carry a delta against the last
+// version published, for clients that already have it.
 func (jt *jobTracker) sendUpdates(sse *sse) {
-	for job := range jt.updates {
-		jt.reifyJob(job)
-		jsonBytes, err := json.Marshal(job)
+	sent := make(map[jobID]*job)
+	for {
+		var event trackerEvent
+		select {
+		case event = <-jt.updates:
+		case <-jt.stop:
+			return
+		}
+
+		var id jobID
+		if event.job != nil {
+			_, id = hadoopIDs(event.job.Details.ID)
+		}
+
+		var payload interface{}
+		var delta *jobDelta
+		published := sseEvent{typ: event.typ, cluster: jt.clusterName}
+		switch event.typ {
+		case eventClusterStatus:
+			payload = event.status
+		case eventJobsTrimmed:
+			payload = trimmedJobs{Cluster: jt.clusterName, IDs: event.trimmed}
+		case eventJobRemoved:
+			payload = jobRef{ID: event.job.Details.ID, Cluster: jt.clusterName, Reason: event.reason}
+			published.job = jobSummary(jt.clusterName, event.job)
+		default:
+			event.job = jt.reifyJob(event.job)
+			payload = event.job
+			published.job = jobSummary(jt.clusterName, event.job)
+			if prev := sent[id]; prev != nil && event.typ == eventJobUpdated {
+				delta = diffJobs(prev, event.job)
+			}
+			published.diffable = (event.typ == eventJobAdded || event.typ == eventJobUpdated) && event.job.running
+		}
+
+		var err error
+		if published.data, err = json.Marshal(payload); err == nil && delta != nil {
+			published.delta, err = json.Marshal(delta)
+		}
 		if err != nil {
 			log.Println("json error: ", err)
-		} else {
-			sse.events <- jsonBytes
+			metrics.add(droppedUpdatesMetric, 1, "cluster", jt.clusterName)
+			continue
+		} else if !sse.publish(published) {
+			log.Println("Dropped", event.typ, "event")
+			metrics.add(droppedUpdatesMetric, 1, "cluster", jt.clusterName)
+			continue
+		}
+
+		// Only the last version that was published can be diffed against.
+		if published.diffable {
+			sent[id] = snapshotJob(event.job)
+		} else if event.job != nil {
+			delete(sent, id)
 		}
 	}
 }
@@ -40,6 +40,11 @@ class App extends React.Component {
       this.updates[job.id] = job;
     });
 
+    Store.on('jobRemoved', (id) => {
+      delete this.updates[id];
+      this.setState(({jobs}) => ({jobs: _.omit(jobs, id)}));
+    });
+
     Store.on('jobs', (jobs) => {
       // We may have more specific info this.state.jobs already, so merge that
       // into what we're getting from /jobs.
@@ -62,7 +67,7 @@ class App extends React.Component {
   flushUpdates() {
     // Merge the updates into the list of jobs. Updates are merged into the existing map
     // since they contain more specific & more recent information than the existing list.
-    const jobs = _.extend(this.state.jobs, this.updates);
+    const jobs = _.extend({}, this.state.jobs, this.updates);
 
     // Drop mapper, reducer & config info of jobs that are not viewed on the detail page.
     Object.keys(jobs).forEach((key) => {
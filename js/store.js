@@ -1,7 +1,7 @@
 import {cleanJobName} from './utils/utils';
 import {MRJob} from './mr';
 
-const {$} = window;
+const {$, _} = window;
 
 class JobConfStore {
   constructor() {
@@ -40,6 +40,33 @@ class JobConfStore {
 
 export const ConfStore = new JobConfStore();
 
+function applyTaskWindow(pairs, window) {
+  return window ? (pairs || []).slice(0, window.start).concat(window.pairs) : pairs;
+}
+
+// applyDelta updates a job's data in place with the changes in a job.delta
+// event.
+function applyDelta(data, delta) {
+  _.extend(data.details, delta.details);
+  if (delta.counters) {
+    const counters = _.object((data.counters || []).map((c) => [c.name, c]));
+    delta.counters.forEach((c) => {
+      counters[c.name] = c;
+    });
+    data.counters = _.values(counters);
+  }
+  data.tasks = data.tasks || {};
+  const {tasks} = data;
+  tasks.maps = applyTaskWindow(tasks.maps, delta.maps);
+  tasks.reduces = applyTaskWindow(tasks.reduces, delta.reduces);
+  if (delta.errors) {
+    tasks.errors = delta.errors;
+  }
+  if (delta.flowID) {
+    data.flowID = delta.flowID;
+  }
+}
+
 class JobStore {
   constructor() {
     this.pipes = {};
@@ -85,9 +112,39 @@ class JobStore {
 
   startSSE() {
     const sse = new EventSource('/sse');
-    sse.onmessage = (e) => {
-      this.trigger('job', new MRJob(JSON.parse(e.data)));
-    };
+    // Updates to running jobs are sent as deltas against the last version
+    // we got, so keep those around until the job finishes.
+    const running = {};
+    ['job.added', 'job.updated', 'job.finished'].forEach((type) => {
+      sse.addEventListener(type, (e) => {
+        const data = JSON.parse(e.data);
+        const job = new MRJob(data);
+        if (type === 'job.finished') {
+          delete running[job.id];
+        } else {
+          running[job.id] = data;
+        }
+        this.trigger('job', job);
+      });
+    });
+    sse.addEventListener('job.delta', (e) => {
+      const delta = JSON.parse(e.data);
+      const id = delta.id.replace('application_', 'job_');
+      const data = running[id];
+      if (!data) {
+        return;
+      }
+      applyDelta(data, delta);
+      this.trigger('job', new MRJob(data));
+    });
+    sse.addEventListener('job.removed', (e) => {
+      const id = JSON.parse(e.data).id.replace('application_', 'job_');
+      delete running[id];
+      this.trigger('jobRemoved', id);
+    });
+    // The browser replays missed updates when it reconnects, unless we've
+    // been gone too long for the server to have kept them all.
+    sse.addEventListener('resync', () => this.getJobs());
   }
 
   trigger(key, data) {
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/user"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/colinmarc/hdfs/v2"
+	krb "github.com/jcmturner/gokrb5/v8/client"
+	"github.com/jcmturner/gokrb5/v8/config"
+	"github.com/jcmturner/gokrb5/v8/keytab"
+	"github.com/jcmturner/gokrb5/v8/spnego"
+)
+
+var kerberosKeytab = flag.String("kerberos-keytab", "", "The keytab to log in to Kerberos with, for clusters that don't set their own. Setting this turns on SPNEGO for the YARN APIs and Kerberos for HDFS.")
+var kerberosPrincipal = flag.String("kerberos-principal", "", "The principal to log in to Kerberos as, like timberlake/host.example.com@EXAMPLE.COM.")
+var kerberosConfig = flag.String("kerberos-config", "/etc/krb5.conf", "The krb5.conf describing the Kerberos realms.")
+var kerberosRenewInterval = flag.Duration("kerberos-renew-interval", time.Hour, "How often to log in to Kerberos again, to get a fresh ticket. Pass values like: 1h")
+var namenodePrincipal = flag.String("namenode-principal", "nn/_HOST", "The namenode's Kerberos principal, as in dfs.namenode.kerberos.principal. _HOST is replaced with the namenode's hostname.")
+
+// httpDoer is what the YARN APIs are called with: either a plain HTTP client,
+// or a SPNEGO client wrapping one.
+type httpDoer interface {
+	Do(req *http.Request) (*http.Response, error)
+}
+
+// hadoopAuth is how we talk to a cluster's services: the HTTP client for the
+// YARN APIs, and the Kerberos login for HDFS, if it has one.
+type hadoopAuth struct {
+	http              httpDoer
+	kerberos          *krb.Client
+	namenodePrincipal string
+}
+
+// newHTTPClient creates a client for the YARN APIs. Redirects are banned for
+// two reasons:
+//  1. When a job is in the accepted state the JSON API redirects to an HTML page.
+//  2. When a job is finished The RM redirects to the history server over an
+//     address we may not be able to follow.
+func newHTTPClient(timeout time.Duration) *http.Client {
+	return &http.Client{
+		Timeout: timeout,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return fmt.Errorf("no redirects allowed. Blocked redirect to %s", req.URL)
+		},
+	}
+}
+
+// newHadoopAuth sets up the clients for a cluster. Without a keytab, requests
+// aren't authenticated.
+func newHadoopAuth(cfg authConfig, timeout time.Duration) (*hadoopAuth, error) {
+	client := newHTTPClient(timeout)
+	auth := &hadoopAuth{http: client, namenodePrincipal: cfg.NamenodePrincipal}
+	if cfg.Keytab == "" {
+		return auth, nil
+	}
+
+	login, err := kerberosLogin(cfg.Keytab, cfg.Principal, cfg.KerberosConfig)
+	if err != nil {
+		return nil, err
+	}
+	auth.kerberos = login
+	auth.http = spnego.NewClient(login, client, "")
+	return auth, nil
+}
+
+// Kerberos logins, keyed by keytab, principal and krb5.conf, so that clusters
+// with the same credentials share one ticket.
+var kerberosLogins = make(map[string]*krb.Client)
+var kerberosLoginsLock sync.Mutex
+
+// kerberosLogin logs in with a keytab, or returns the existing login for it.
+func kerberosLogin(keytabPath string, principal string, configPath string) (*krb.Client, error) {
+	key := keytabPath + "\x00" + principal + "\x00" + configPath
+	kerberosLoginsLock.Lock()
+	defer kerberosLoginsLock.Unlock()
+	if client, ok := kerberosLogins[key]; ok {
+		return client, nil
+	}
+
+	kt, err := keytab.Load(keytabPath)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't load keytab: %s", err)
+	}
+
+	cfg, err := config.Load(configPath)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't load %s: %s", configPath, err)
+	}
+
+	at := strings.LastIndex(principal, "@")
+	if at == -1 {
+		return nil, fmt.Errorf("principal %q has no realm", principal)
+	}
+
+	client := krb.NewWithKeytab(principal[:at], principal[at+1:], kt, cfg, krb.DisablePAFXFAST(true))
+	if err := client.Login(); err != nil {
+		return nil, fmt.Errorf("couldn't log in as %s: %s", principal, err)
+	}
+
+	kerberosLogins[key] = client
+	return client, nil
+}
+
+// renewKerberos logs in again periodically, so that we never get close to
+// our tickets expiring. If logging in fails, the old ticket is kept and we try
+// again at the next interval.
+func renewKerberos(interval time.Duration) {
+	for range time.Tick(interval) {
+		kerberosLoginsLock.Lock()
+		logins := make([]*krb.Client, 0, len(kerberosLogins))
+		for _, client := range kerberosLogins {
+			logins = append(logins, client)
+		}
+		kerberosLoginsLock.Unlock()
+
+		for _, client := range logins {
+			if err := client.Login(); err != nil {
+				log.Println("Error renewing Kerberos ticket:", err)
+				metrics.add(kerberosLoginErrorsMetric, 1)
+			}
+		}
+	}
+}
+
+// hdfsDialer is what HDFS connections are made with. It gives up on hosts
+// that don't answer quickly, so that a dead namenode or datanode doesn't hold
+// up a request.
+var hdfsDialer = &net.Dialer{Timeout: time.Second}
+
+// connectHDFS connects to a namenode, with Kerberos if the cluster uses it.
+// Otherwise, it acts as HADOOP_USER_NAME, or the user we're running as, like
+// the hadoop command does.
+func (a *hadoopAuth) connectHDFS(address string) (*hdfs.Client, error) {
+	options := hdfs.ClientOptions{
+		Addresses:        []string{address},
+		NamenodeDialFunc: hdfsDialer.DialContext,
+		DatanodeDialFunc: hdfsDialer.DialContext,
+	}
+
+	if a.kerberos == nil {
+		user, err := hadoopUser()
+		if err != nil {
+			return nil, err
+		}
+		options.User = user
+	} else {
+		// The realm is the client's, so it can be left out.
+		options.KerberosClient = a.kerberos
+		options.KerberosServicePrincipleName = strings.SplitN(a.namenodePrincipal, "@", 2)[0]
+	}
+
+	return hdfs.NewClient(options)
+}
+
+func hadoopUser() (string, error) {
+	if name := os.Getenv("HADOOP_USER_NAME"); name != "" {
+		return name, nil
+	}
+
+	current, err := user.Current()
+	if err != nil {
+		return "", err
+	}
+	return current.Username, nil
+}
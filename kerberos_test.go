@@ -0,0 +1,46 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/jcmturner/gokrb5/v8/iana/etypeID"
+	"github.com/jcmturner/gokrb5/v8/keytab"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSetupKerberosErrors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "timberlake-kerberos")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	kt := keytab.New()
+	require.NoError(t, kt.AddEntry("timberlake", "EXAMPLE.COM", "secret", time.Now(), 1, etypeID.AES256_CTS_HMAC_SHA1_96))
+	b, err := kt.Marshal()
+	require.NoError(t, err)
+	keytabPath := filepath.Join(dir, "timberlake.keytab")
+	require.NoError(t, ioutil.WriteFile(keytabPath, b, 0600))
+
+	configPath := filepath.Join(dir, "krb5.conf")
+	require.NoError(t, ioutil.WriteFile(configPath, []byte("[libdefaults]\n  default_realm = EXAMPLE.COM\n"), 0644))
+
+	for _, auth := range []authConfig{
+		{Keytab: filepath.Join(dir, "missing.keytab"), Principal: "timberlake@EXAMPLE.COM", KerberosConfig: configPath},
+		{Keytab: keytabPath, Principal: "timberlake@EXAMPLE.COM", KerberosConfig: filepath.Join(dir, "missing.conf")},
+		{Keytab: keytabPath, Principal: "timberlake", KerberosConfig: configPath},
+	} {
+		_, err := newHadoopAuth(auth, time.Second)
+		assert.Error(t, err, "missing keytabs and krb5.confs, and principals without a realm, should fail")
+	}
+	assert.Empty(t, kerberosLogins, "failed logins shouldn't be kept")
+
+	auth, err := newHadoopAuth(authConfig{}, time.Second)
+	require.NoError(t, err)
+	assert.Nil(t, auth.kerberos, "Kerberos should be off without a keytab")
+	assert.IsType(t, &http.Client{}, auth.http)
+}
@@ -9,7 +9,11 @@ import (
 )
 
 func (jt *jobTracker) killJob(id string, user string) error {
-	url := fmt.Sprintf("%s/ws/v1/cluster/apps/%s/state?user.name=%s", jt.jobClient.getRMAddress(), id, user)
+	rm := jt.jobClient.getEndpoints().ResourceManager
+	if rm == nil {
+		return fmt.Errorf("cluster %s has no resource manager", jt.clusterName)
+	}
+	url := fmt.Sprintf("%s/ws/v1/cluster/apps/%s/state?user.name=%s", rm.get(), id, user)
 	payload := strings.NewReader(`{"state":"KILLED"}`) //cheating
 	req, err := http.NewRequest("PUT", url, payload)
 	if err != nil {
@@ -18,7 +22,11 @@ func (jt *jobTracker) killJob(id string, user string) error {
 	req.Header.Set("Content-Type", "application/json")
 	log.Println("Killing", id, req)
 
-	res, err := http.DefaultClient.Do(req)
+	res, err := rm.auth.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
 	log.Println("Kill status:", res.Status)
 
 	if res.StatusCode == 202 {
@@ -26,29 +34,34 @@ func (jt *jobTracker) killJob(id string, user string) error {
 		// history server using this API. :\
 		log.Println("Setting", id, "to KILLED")
 		_, jobID := hadoopIDs(id)
-		job := jt.jobs[jobID]
 
 		killTime := time.Now().Unix() * 1000
-		job.Details.State = "KILLED"
-		job.Details.FinishTime = killTime
-		job.Details.MapsKilled += job.Details.MapsRunning
-		job.Details.MapsRunning = 0
-		job.Details.ReducesKilled += job.Details.ReducesRunning
-		job.Details.ReducesRunning = 0
+		job := jt.store.Update(jobID, func(job *job) {
+			job.Details.State = "KILLED"
+			job.Details.FinishTime = killTime
+			job.Details.MapsKilled += job.Details.MapsRunning
+			job.Details.MapsRunning = 0
+			job.Details.ReducesKilled += job.Details.ReducesRunning
+			job.Details.ReducesRunning = 0
 
-		for _, task := range job.Tasks.Map {
-			if task[1] == 0 {
-				task[1] = killTime
-			}
+			job.Tasks.Map = killTasks(job.Tasks.Map, killTime)
+			job.Tasks.Reduce = killTasks(job.Tasks.Reduce, killTime)
+		})
+		if job != nil {
+			jt.publish(trackerEvent{typ: eventJobFinished, job: job})
 		}
+	}
+	return nil
+}
 
-		for _, task := range job.Tasks.Reduce {
-			if task[1] == 0 {
-				task[1] = killTime
-			}
+// killTasks returns a copy of tasks with the ones that haven't finished
+// ending at killTime.
+func killTasks(tasks [][]int64, killTime int64) [][]int64 {
+	killed := copyTaskPairs(tasks)
+	for _, task := range killed {
+		if task[1] == 0 {
+			task[1] = killTime
 		}
-
-		jt.updates <- job
 	}
-	return err
+	return killed
 }
@@ -1,16 +1,299 @@
 package main
 
 import (
-	"github.com/colinmarc/hdfs"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/colinmarc/hdfs/v2"
+)
+
+var yarnLogDirSuffix = flag.String("yarn-logs-dir-suffix", "logs", "The directory under each user's directory in --yarn-logs-dir where YARN stores logs. This is controlled by the hadoop property yarn.nodemanager.remote-app-log-dir-suffix.")
+
+const (
+	// How many bytes of a container log to return when no limit is requested.
+	defaultLogLimit = 64 * 1024
+
+	// The largest page of a container log we'll return at once.
+	maxLogLimit = 1024 * 1024
 )
 
+// Keys in an aggregated log file that hold metadata, not container logs.
+var reservedLogKeys = map[string]bool{
+	"APPLICATION_ACL":   true,
+	"APPLICATION_OWNER": true,
+	"VERSION":           true,
+}
+
+var errContainerNotFound = errors.New("container not found")
+
+// errLogsNotFound means a job has no log directory, because its logs haven't
+// been aggregated yet or have already been cleaned up.
+var errLogsNotFound = errors.New("logs not found")
+
+// errStopScan can be returned while scanning an app's logs to skip the rest.
+var errStopScan = errors.New("stop scanning")
+
+// containerLogs describes the logs for one container, as aggregated to HDFS by
+// the nodemanager that ran it.
+type containerLogs struct {
+	Container string    `json:"container"`
+	Node      string    `json:"node"`
+	Logs      []logFile `json:"logs"`
+}
+
+// logFile is one of the logs written by a container (stdout, stderr,
+// syslog...). Data holds the requested range of the log, starting at Offset.
+type logFile struct {
+	Type   string `json:"type"`
+	Length int64  `json:"length"`
+	Offset int64  `json:"offset,omitempty"`
+	Data   string `json:"data,omitempty"`
+}
+
+// logRange is a byte range to read from each container log. A negative offset
+// is relative to the end of the log.
+type logRange struct {
+	logType string
+	offset  int64
+	limit   int64
+}
+
 func (jt *jobTracker) testLogsDir() error {
-	client, err := hdfs.New(jt.namenodeAddress)
+	return jt.hdfs.do(func(client *hdfs.Client) error {
+		_, err := client.ReadDir(jt.config.LogsDir)
+		return err
+	})
+}
+
+// appLogsDir returns the HDFS directory holding the aggregated logs for a job.
+func (jt *jobTracker) appLogsDir(job *job) string {
+	appID, _ := hadoopIDs(job.Details.ID)
+	return path.Join(jt.config.LogsDir, job.Details.User, jt.config.LogsDirSuffix, appID)
+}
+
+// listContainerLogs lists the containers that ran for a job and the logs
+// each of them wrote, without any log contents.
+func (jt *jobTracker) listContainerLogs(job *job) ([]containerLogs, error) {
+	containers := make([]containerLogs, 0)
+	err := jt.scanAppLogs(job, func(node string, container string, logs io.Reader) error {
+		c := containerLogs{Container: container, Node: node, Logs: make([]logFile, 0)}
+		err := readContainerLogs(logs, func(logType string, length int64, body io.Reader) error {
+			c.Logs = append(c.Logs, logFile{Type: logType, Length: length})
+			return nil
+		})
+		containers = append(containers, c)
+		return err
+	})
+
+	return containers, err
+}
+
+// fetchContainerLogs reads the requested range of a single container's logs.
+func (jt *jobTracker) fetchContainerLogs(job *job, container string, r logRange) (*containerLogs, error) {
+	var found *containerLogs
+	err := jt.scanAppLogs(job, func(node string, c string, logs io.Reader) error {
+		if c != container {
+			return nil
+		}
+
+		found = &containerLogs{Container: container, Node: node, Logs: make([]logFile, 0)}
+		err := readContainerLogs(logs, func(logType string, length int64, body io.Reader) error {
+			if r.logType != "" && r.logType != logType {
+				return nil
+			}
+
+			f, err := readLogRange(logType, length, body, r)
+			if err != nil {
+				return err
+			}
+			found.Logs = append(found.Logs, f)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		return errStopScan
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if found == nil {
+		return nil, errContainerNotFound
+	}
+	return found, nil
+}
+
+// scanAppLogs calls fn with the logs for each container of a job. Each
+// nodemanager writes a TFile named after itself into the app's log directory,
+// which holds the logs of every container that ran on that node. Each file is
+// read with its own HDFS read slot, so that a job with logs on many nodes
+// doesn't keep one for the whole scan.
+func (jt *jobTracker) scanAppLogs(job *job, fn func(node string, container string, logs io.Reader) error) (err error) {
+	defer func(start time.Time) {
+		observeRequest(jt.clusterName, "hdfs", "containerLogs", start, err)
+	}(time.Now())
+
+	dir := jt.appLogsDir(job)
+	var infos []os.FileInfo
+	err = jt.hdfs.do(func(client *hdfs.Client) error {
+		var err error
+		infos, err = client.ReadDir(dir)
+		if os.IsNotExist(err) {
+			return errLogsNotFound
+		} else if err != nil {
+			return fmt.Errorf("couldn't list logs at %s: %s", dir, err)
+		}
+		return nil
+	})
 	if err != nil {
 		return err
 	}
-	defer client.Close()
 
-	_, err = client.ReadDir(*yarnLogDir)
-	return err
+	for _, info := range infos {
+		// Nodemanagers write to a temporary file while they're still
+		// aggregating.
+		if info.IsDir() || strings.HasSuffix(info.Name(), ".tmp") {
+			continue
+		}
+
+		// Errors reading a file are only logged, so a retry never sends fn
+		// the same logs twice.
+		var scanErr error
+		p := path.Join(dir, info.Name())
+		err := jt.hdfs.do(func(client *hdfs.Client) error {
+			scanErr = scanNodeLogs(client, p, info.Size(), func(container string, logs io.Reader) error {
+				return fn(info.Name(), container, logs)
+			})
+			return nil
+		})
+		if err != nil {
+			return err
+		} else if scanErr == errStopScan {
+			return nil
+		} else if scanErr != nil {
+			log.Printf("Error reading aggregated logs at %s: %s\n", p, scanErr)
+		}
+	}
+
+	return nil
+}
+
+func scanNodeLogs(client *hdfs.Client, p string, size int64, fn func(container string, logs io.Reader) error) error {
+	f, err := client.Open(p)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return readAggregatedLogs(f, size, fn)
+}
+
+// readAggregatedLogs calls fn with the logs of each container in an
+// aggregated log file. Keys in the file are container IDs, and values are the
+// container's log files one after another.
+func readAggregatedLogs(r io.ReaderAt, size int64, fn func(container string, logs io.Reader) error) error {
+	t, err := openTFile(r, size)
+	if err != nil {
+		return err
+	}
+
+	return t.scan(func(key []byte, value io.Reader) error {
+		container, err := readUTF(bytes.NewReader(key))
+		if err != nil {
+			return err
+		}
+
+		if reservedLogKeys[container] {
+			return nil
+		}
+		return fn(container, value)
+	})
+}
+
+// readContainerLogs calls fn with each of a container's log files. Each file
+// is prefixed by its type and its length, the latter written as a string.
+func readContainerLogs(r io.Reader, fn func(logType string, length int64, body io.Reader) error) error {
+	for {
+		logType, err := readUTF(r)
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		rawLength, err := readUTF(r)
+		if err != nil {
+			return err
+		}
+		length, err := strconv.ParseInt(rawLength, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid length for %s log: %s", logType, err)
+		}
+
+		body := io.LimitReader(r, length)
+		if err := fn(logType, length, body); err != nil {
+			return err
+		}
+		if _, err := io.Copy(ioutil.Discard, body); err != nil {
+			return err
+		}
+	}
+}
+
+// readLogRange reads up to r.limit bytes of a log, starting at r.offset.
+func readLogRange(logType string, length int64, body io.Reader, r logRange) (logFile, error) {
+	offset := r.offset
+	if offset < 0 {
+		offset += length
+	}
+	if offset < 0 {
+		offset = 0
+	} else if offset > length {
+		offset = length
+	}
+
+	limit := r.limit
+	if limit <= 0 {
+		limit = defaultLogLimit
+	} else if limit > maxLogLimit {
+		limit = maxLogLimit
+	}
+
+	if _, err := io.CopyN(ioutil.Discard, body, offset); err != nil {
+		return logFile{}, err
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(body, limit))
+	if err != nil {
+		return logFile{}, err
+	}
+
+	return logFile{Type: logType, Length: length, Offset: offset, Data: string(data)}, nil
+}
+
+// readUTF reads a string written by java's DataOutput.writeUTF, which is
+// prefixed by its length as an unsigned short. Log types and container IDs
+// are plain ASCII, so we don't bother decoding java's modified UTF-8.
+func readUTF(r io.Reader) (string, error) {
+	var length uint16
+	if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+		return "", err
+	}
+
+	b := make([]byte, length)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return "", err
+	}
+	return string(b), nil
 }
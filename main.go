@@ -11,29 +11,30 @@ import (
 	"net/http/pprof"
 	"os"
 	"path/filepath"
-	"reflect"
-	"strings"
+	"strconv"
 	"time"
 )
 
 var clusterNames = flag.String("cluster-name", "default", "The user-visible names for the clusters")
-var resourceManagerURL = flag.String("resource-manager-url", "http://localhost:8088", "The HTTP URL to access the resource manager.")
-var historyServerURL = flag.String("history-server-url", "http://localhost:19888", "The HTTP URL to access the history server.")
+var resourceManagerURL = flag.String("resource-manager-url", "http://localhost:8088", "The HTTP URL to access the resource manager. Separate the URLs of HA resource managers with |.")
+var historyServerURL = flag.String("history-server-url", "http://localhost:19888", "The HTTP URL to access the history server. Separate several URLs with |.")
 var publicResourceManagerURL = flag.String("public-resource-manager-url", "", "The HTTP URL to access the resource manager.")
 var publicHistoryServerURL = flag.String("public-history-server-url", "", "The HTTP URL to access the history server.")
-var proxyServerURL = flag.String("proxy-server-url", "", "The HTTP URL to access the proxy server, if separate from the resource manager.")
-var namenodeAddress = flag.String("namenode-address", "localhost:9000", "The host:port to access the Namenode metadata service.")
+var proxyServerURL = flag.String("proxy-server-url", "", "The HTTP URL to access the proxy server, if separate from the resource manager. Separate several URLs with |.")
+var namenodeAddress = flag.String("namenode-address", "localhost:9000", "The host:port to access the Namenode metadata service. Separate the addresses of HA namenodes with |.")
 var yarnLogDir = flag.String("yarn-logs-dir", "/tmp/logs", "The HDFS path where YARN stores logs. This is the controlled by the hadoop property yarn.nodemanager.remote-app-log-dir.")
 var yarnHistoryDir = flag.String("yarn-history-dir", "/tmp/staging/history/done", "The HDFS path where YARN stores finished job history files. This is the controlled by the hadoop property mapreduce.jobhistory.done-dir.")
+var yarnIntermediateHistoryDir = flag.String("yarn-intermediate-history-dir", "", "The HDFS path where YARN keeps job history files until they're moved to --yarn-history-dir, with a directory for each user. This is controlled by the hadoop property mapreduce.jobhistory.intermediate-done-dir, and defaults to done_intermediate next to --yarn-history-dir.")
 var httpTimeout = flag.Duration("http-timeout", time.Second*2, "The timeout used for connecting to YARN API. Pass values like: 2s")
 var pollInterval = flag.Duration("poll-interval", time.Second*5, "How often should we poll the job APIs. Pass values like: 2s")
 var enableDebug = flag.Bool("pprof", false, "Enable pprof debugging tools at /debug.")
-var s3BucketName = flag.String("s3-bucket", "", "S3 bucket to fetch old jobs from")
+var persistedStore = flag.String("persisted-store", "", "Where to fetch old jobs from, and archive finished jobs to with --archive. One of s3://BUCKET, file:///PATH, hdfs://[NAMENODE]/PATH or none. Defaults to --s3-bucket if that's set, and none otherwise.")
+var s3BucketName = flag.String("s3-bucket", "", "S3 bucket to fetch old jobs from, and archive finished jobs to with --archive. Same as --persisted-store=s3://BUCKET.")
+var archiveJobs = flag.Bool("archive", false, "Archive finished jobs to the persisted store. Without it, the store is only read from.")
 var s3Region = flag.String("s3-region", "", "AWS region for the job storage S3 bucket")
-var s3JobsPrefix = flag.String("s3-jobs-prefix", "", "S3 key prefix (\"folder\") where jobs are stored")
-var s3FlowPrefix = flag.String("s3-flow-prefix", "", "S3 key prefix (\"folder\") where cascading flows are stored")
+var s3JobsPrefix = flag.String("s3-jobs-prefix", "", "Key prefix (\"folder\") where jobs are stored in the persisted store")
+var s3FlowPrefix = flag.String("s3-flow-prefix", "", "Key prefix (\"folder\") where cascading flows are stored in the persisted store")
 
-var jts map[string]*jobTracker
 var persistedJobClient PersistedJobClient
 
 var rootPath, staticPath string
@@ -54,22 +55,30 @@ func index(c web.C, w http.ResponseWriter, r *http.Request) {
 }
 
 func getJobs(c web.C, w http.ResponseWriter, r *http.Request) {
-	// We only need the details for listing pages.
-	var jobs []*job
-	for clusterName, tracker := range jts {
-		for _, j := range tracker.jobs {
-			jobs = append(jobs, &job{
-				Cluster: tracker.clusterName,
-				Details: j.Details,
-				conf: conf{
-					Input:         j.conf.Input,
-					Output:        j.conf.Output,
-					ScaldingSteps: j.conf.ScaldingSteps,
-					name:          j.conf.name,
-				},
-			})
-		}
-		log.Printf("Appending %d jobs for Cluster %s: %s %s\n", len(jobs), clusterName, tracker.hs, tracker.rm)
+	params := r.URL.Query()
+	query, err := parseJobQuery(params)
+	if err != nil {
+		w.WriteHeader(400)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	jts := trackers()
+	etag := listingETag(jts, params)
+	w.Header().Set("ETag", etag)
+	if etagMatches(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(304)
+		return
+	}
+
+	if len(params) == 0 {
+		listing.serve(w, r, jts, query, etag)
+		return
+	}
+
+	jobs, next := query.apply(listJobs(jts, query))
+	if next != nil {
+		w.Header().Set("X-Next-Cursor", next.String())
 	}
 
 	jsonBytes, err := json.Marshal(jobs)
@@ -83,7 +92,7 @@ func getJobs(c web.C, w http.ResponseWriter, r *http.Request) {
 }
 
 func getNumClusters(c web.C, w http.ResponseWriter, r *http.Request) {
-	jsonBytes, err := json.Marshal(len(jts))
+	jsonBytes, err := json.Marshal(len(trackers()))
 	if err != nil {
 		log.Println("getNumbClusters error:", err)
 		w.WriteHeader(500)
@@ -92,6 +101,24 @@ func getNumClusters(c web.C, w http.ResponseWriter, r *http.Request) {
 	w.Write(jsonBytes)
 }
 
+// getClusters lists the addresses of each cluster's services, and which are
+// active.
+func getClusters(c web.C, w http.ResponseWriter, r *http.Request) {
+	jts := trackers()
+	clusters := make(map[string]*clusterEndpoints, len(jts))
+	for name, jt := range jts {
+		clusters[name] = jt.jobClient.getEndpoints()
+	}
+
+	jsonBytes, err := json.Marshal(clusters)
+	if err != nil {
+		log.Println("getClusters error:", err)
+		w.WriteHeader(500)
+		return
+	}
+	w.Write(jsonBytes)
+}
+
 func getConf(c web.C, w http.ResponseWriter, r *http.Request) {
 	id := c.URLParams["id"]
 	log.Printf("Getting job conf for %s", id)
@@ -118,11 +145,9 @@ func getConf(c web.C, w http.ResponseWriter, r *http.Request) {
 
 func getJob(rawJobID string) *job {
 	// check if we have it in memory
-	for _, jt := range jts {
-		if _, ok := jt.jobs[jobID(rawJobID)]; ok {
-			job := jt.getJob(rawJobID)
-			jt.reifyJob(job)
-			return job
+	for _, jt := range trackers() {
+		if job := jt.store.Get(jobID(rawJobID)); job != nil {
+			return jt.reifyJob(job)
 		}
 	}
 
@@ -171,9 +196,9 @@ func killJob(c web.C, w http.ResponseWriter, r *http.Request) {
 	id := c.URLParams["id"]
 	app, jobID := hadoopIDs(id)
 
-	for _, jt := range jts {
-		if _, ok := jt.jobs[jobID]; ok {
-			err := jt.killJob(app, jt.jobs[jobID].Details.User)
+	for _, jt := range trackers() {
+		if job := jt.store.Get(jobID); job != nil {
+			err := jt.killJob(app, job.Details.User)
 			if err != nil {
 				log.Println("killJob error: ", err)
 				w.WriteHeader(500)
@@ -187,6 +212,109 @@ func killJob(c web.C, w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(404)
 }
 
+// pinJob pins a job, so that it's kept in memory longer than others if the
+// eviction policy puts pinned jobs last. DELETE unpins it.
+func pinJob(c web.C, w http.ResponseWriter, r *http.Request) {
+	_, id := hadoopIDs(c.URLParams["id"])
+	for _, jt := range trackers() {
+		ok, err := jt.setPinned(id, r.Method != "DELETE")
+		if err != nil {
+			log.Println("setPinned error:", err)
+			w.WriteHeader(500)
+			return
+		} else if ok {
+			w.WriteHeader(204)
+			return
+		}
+	}
+
+	w.WriteHeader(404)
+}
+
+// findJob looks up a job in memory, along with the tracker for its cluster.
+func findJob(rawJobID string) (*jobTracker, *job) {
+	for _, jt := range trackers() {
+		if job := jt.getJob(rawJobID); job != nil {
+			return jt, job
+		}
+	}
+	return nil, nil
+}
+
+func getJobLogs(c web.C, w http.ResponseWriter, r *http.Request) {
+	jt, job := findJob(c.URLParams["id"])
+	if job == nil {
+		w.WriteHeader(404)
+		return
+	}
+
+	containers, err := jt.listContainerLogs(job)
+	if err == errLogsNotFound {
+		w.WriteHeader(404)
+		return
+	} else if err != nil {
+		log.Println("listContainerLogs error:", err)
+		w.WriteHeader(500)
+		return
+	}
+
+	jsonBytes, err := json.Marshal(containers)
+	if err != nil {
+		log.Println("JSON marshal error:", err)
+		w.WriteHeader(500)
+		return
+	}
+
+	w.Write(jsonBytes)
+}
+
+// getContainerLogs returns a page of each of a container's logs. The page is
+// set with the offset and limit query parameters, and a negative offset counts
+// back from the end of each log. The type parameter restricts the response to
+// a single log, like stderr.
+func getContainerLogs(c web.C, w http.ResponseWriter, r *http.Request) {
+	jt, job := findJob(c.URLParams["id"])
+	if job == nil {
+		w.WriteHeader(404)
+		return
+	}
+
+	query := r.URL.Query()
+	logRange := logRange{logType: query.Get("type")}
+	var err error
+	if v := query.Get("offset"); v != "" {
+		if logRange.offset, err = strconv.ParseInt(v, 10, 64); err != nil {
+			w.WriteHeader(400)
+			return
+		}
+	}
+	if v := query.Get("limit"); v != "" {
+		if logRange.limit, err = strconv.ParseInt(v, 10, 64); err != nil {
+			w.WriteHeader(400)
+			return
+		}
+	}
+
+	logs, err := jt.fetchContainerLogs(job, c.URLParams["container"], logRange)
+	if err == errContainerNotFound || err == errLogsNotFound {
+		w.WriteHeader(404)
+		return
+	} else if err != nil {
+		log.Println("fetchContainerLogs error:", err)
+		w.WriteHeader(500)
+		return
+	}
+
+	jsonBytes, err := json.Marshal(logs)
+	if err != nil {
+		log.Println("JSON marshal error:", err)
+		w.WriteHeader(500)
+		return
+	}
+
+	w.Write(jsonBytes)
+}
+
 func init() {
 	binPath, err := filepath.Abs(filepath.Dir(os.Args[0]))
 	if err != nil {
@@ -200,72 +328,55 @@ func init() {
 func main() {
 	flag.Parse()
 
-	var clusterNames = strings.Split(*clusterNames, ",")
-	var resourceManagerURLs = strings.Split(*resourceManagerURL, ",")
-	var historyServerURLs = strings.Split(*historyServerURL, ",")
-	var publicResourceManagerURLs = strings.Split(*publicResourceManagerURL, ",")
-	var publicHistoryServerURLs = strings.Split(*publicHistoryServerURL, ",")
-	var proxyServerURLs = strings.Split(*proxyServerURL, ",")
-	var namenodeAddresses = strings.Split(*namenodeAddress, ",")
-
-	if *publicResourceManagerURL == "" {
-		publicResourceManagerURLs = resourceManagerURLs
+	var configs []clusterConfig
+	var err error
+	if *replayDir != "" {
+		configs = replayClusterConfig()
+	} else if *configFile != "" {
+		configs, err = loadClusterConfig(*configFile)
+	} else {
+		configs, err = flagClusterConfig()
 	}
-	if *publicHistoryServerURL == "" {
-		publicHistoryServerURLs = resourceManagerURLs
+	if err != nil {
+		log.Fatal(err)
 	}
 
-	if len(resourceManagerURLs) != len(historyServerURLs) {
-		log.Fatal("resource-manager-url and history-server-url are not 1:1")
-	}
-	if !reflect.DeepEqual(proxyServerURLs, []string{""}) && len(proxyServerURLs) != len(resourceManagerURLs) {
-		log.Fatal("proxy-server-url exists and is not 1:1 with resource-manager-url")
-	}
-	if len(resourceManagerURLs) != len(namenodeAddresses) {
-		log.Fatal("resource-manager-url and namenode-address are not 1:1")
-	}
-	if len(resourceManagerURLs) != len(clusterNames) {
-		log.Fatal("cluster-names and resource-manager-url are not 1:1")
+	go renewKerberos(*kerberosRenewInterval)
+
+	store := *persistedStore
+	if *replayDir != "" && (store != "" || *s3BucketName != "") {
+		// Replayed jobs mustn't be archived alongside real ones, and there are
+		// no namenodes to find an hdfs:// store on.
+		log.Fatal("--persisted-store and --s3-bucket can't be used with --replay-dir")
+	} else if store == "" && *s3BucketName != "" {
+		store = "s3://" + *s3BucketName
+	} else if store == "" {
+		store = "none"
 	}
 
-	persistedJobClient = NewS3JobClient(*s3Region, *s3BucketName, *s3JobsPrefix, *s3FlowPrefix)
-	jts = make(map[string]*jobTracker)
-	for i := range resourceManagerURLs {
-		var proxyServerURL string
-		if reflect.DeepEqual(proxyServerURLs, []string{""}) {
-			proxyServerURL = resourceManagerURLs[i]
-		} else {
-			proxyServerURL = proxyServerURLs[i]
-		}
-		log.Printf("Creating new JT [%d]: %s %s %s\n", i, resourceManagerURLs[i], historyServerURLs[i], proxyServerURL)
-		jts[clusterNames[i]] = newJobTracker(
-			clusterNames[i],
-			publicResourceManagerURLs[i],
-			publicHistoryServerURLs[i],
-			newRecentJobClient(
-				resourceManagerURLs[i],
-				historyServerURLs[i],
-				proxyServerURL,
-				namenodeAddresses[i],
-			),
-			&hdfsJobHistoryClient{},
-		)
+	// The persisted store uses the first cluster's namenodes by default. It
+	// isn't changed when the config is reloaded.
+	defaultAuth, err := newHadoopAuth(configs[0].Auth, configs[0].HTTPTimeout)
+	if err != nil {
+		log.Fatalf("Could not set up auth for cluster %s: %s", configs[0].Name, err)
 	}
-
-	log.Println("initiating JT loop")
-
-	for clusterName, jt := range jts {
-		go jt.Loop()
-		if err := jt.testLogsDir(); err != nil {
-			log.Printf("WARNING: Could not read yarn logs directory for cluster %s. Error message: `%s`\n", clusterName, err)
-			log.Println("\tYou can change the path with --yarn-logs-dir=HDFS_PATH.")
-			log.Println("\tTo talk to HDFS, Timberlake needs to be able to access the namenode (--namenode-address) and datanodes.")
-		}
+	defaultNamenodes := newEndpoints(configs[0].Name, "namenode", configs[0].Namenodes, defaultAuth, nil)
+	persistedJobClient, err = newPersistedJobClient(store, *s3Region, *s3JobsPrefix, *s3FlowPrefix, defaultNamenodes)
+	if err != nil {
+		log.Fatalf("Invalid --persisted-store: %s", err)
 	}
 
 	sse := newSSE()
 	go sse.Loop()
 
+	log.Println("initiating JT loop")
+	if err := applyClusterConfig(configs, sse); err != nil {
+		log.Fatal(err)
+	}
+	if *configFile != "" {
+		go reloadClusterConfig(*configFile, sse)
+	}
+
 	static := http.StripPrefix("/static/", http.FileServer(http.Dir(staticPath)))
 	log.Println("serving static files from", staticPath)
 
@@ -273,11 +384,17 @@ func main() {
 	mux.Get("/", index)
 	mux.Get("/jobs/", getJobs)
 	mux.Get("/numClusters/", getNumClusters)
+	mux.Get("/clusters/", getClusters)
 	mux.Get("/sse", sse)
 	mux.Get("/jobIds/:flowID", getJobIdsAPIHandler)
 	mux.Get("/jobs/:id", getJobAPIHandler)
 	mux.Get("/jobs/:id/conf", getConf)
+	mux.Get("/jobs/:id/logs", getJobLogs)
+	mux.Get("/jobs/:id/logs/:container", getContainerLogs)
 	mux.Post("/jobs/:id/kill", killJob)
+	mux.Put("/jobs/:id/pin", pinJob)
+	mux.Delete("/jobs/:id/pin", pinJob)
+	mux.Get("/metrics", getMetrics)
 
 	if *enableDebug {
 		mux.Get("/debug/pprof/*", pprof.Index)
@@ -287,9 +404,5 @@ func main() {
 		mux.Get("/debug/pprof/trace", pprof.Trace)
 	}
 
-	for _, jt := range jts {
-		go jt.sendUpdates(sse)
-	}
-
 	http.Serve(bind.Default(), mux)
 }
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/zenazn/goji/web"
+)
+
+// metricDesc describes one of the metrics exported at /metrics.
+type metricDesc struct {
+	name string
+	typ  string
+	help string
+}
+
+var (
+	jobsMetric                = metricDesc{"timberlake_jobs", "gauge", "Jobs tracked, by cluster and state."}
+	upstreamDurationMetric    = metricDesc{"timberlake_upstream_request_duration_seconds", "histogram", "Latency of requests to the resource manager (rm), history server (hs), application proxy (proxy) and HDFS."}
+	upstreamErrorsMetric      = metricDesc{"timberlake_upstream_request_errors_total", "counter", "Failed requests to the resource manager, history server, application proxy and HDFS."}
+	lastPollMetric            = metricDesc{"timberlake_last_successful_poll_timestamp_seconds", "gauge", "When the resource manager last listed running jobs successfully."}
+	backfillJobsMetric        = metricDesc{"timberlake_backfill_jobs", "gauge", "Finished jobs to backfill from the history server at startup."}
+	backfillJobsQueuedMetric  = metricDesc{"timberlake_backfill_jobs_queued", "gauge", "Backfill jobs queued for loading so far."}
+	sseClientsMetric          = metricDesc{"timberlake_sse_clients", "gauge", "Connected server-sent event clients."}
+	sseEvictionsMetric        = metricDesc{"timberlake_sse_evicted_clients_total", "counter", "Server-sent event clients disconnected for falling behind."}
+	droppedUpdatesMetric      = metricDesc{"timberlake_dropped_updates_total", "counter", "Job updates that couldn't be broadcast to server-sent event clients."}
+	archiveErrorsMetric       = metricDesc{"timberlake_archive_errors_total", "counter", "Finished jobs that couldn't be archived to the persisted store."}
+	kerberosLoginErrorsMetric = metricDesc{"timberlake_kerberos_login_errors_total", "counter", "Failed attempts to renew the Kerberos ticket."}
+	activeEndpointMetric      = metricDesc{"timberlake_active_endpoint", "gauge", "Whether each address of a cluster's services is the one in use (1) or not (0)."}
+	configReloadErrorsMetric  = metricDesc{"timberlake_config_reload_errors_total", "counter", "Reloads of the cluster config file that failed, leaving the clusters as they were."}
+	jobCacheBytesMetric       = metricDesc{"timberlake_job_cache_bytes", "gauge", "Estimated memory taken up by each cluster's jobs."}
+	jobCacheBudgetMetric      = metricDesc{"timberlake_job_cache_budget_bytes", "gauge", "Memory budget for each cluster's jobs, or 0 for none."}
+	jobCacheEvictionsMetric   = metricDesc{"timberlake_job_cache_evictions_total", "counter", "Finished jobs trimmed to their details (trim) or dropped (evict), by the reason why: age, limit or budget."}
+	detailCacheRequestsMetric = metricDesc{"timberlake_detail_cache_requests_total", "counter", "Views of trimmed jobs, by whether their full details were cached (hit), being loaded already (shared) or loaded from the history file (miss)."}
+)
+
+// The order metrics are written in.
+var allMetrics = []metricDesc{
+	jobsMetric,
+	upstreamDurationMetric,
+	upstreamErrorsMetric,
+	lastPollMetric,
+	backfillJobsMetric,
+	backfillJobsQueuedMetric,
+	sseClientsMetric,
+	sseEvictionsMetric,
+	droppedUpdatesMetric,
+	archiveErrorsMetric,
+	kerberosLoginErrorsMetric,
+	activeEndpointMetric,
+	configReloadErrorsMetric,
+	jobCacheBytesMetric,
+	jobCacheBudgetMetric,
+	jobCacheEvictionsMetric,
+	detailCacheRequestsMetric,
+}
+
+// Histogram bucket upper bounds, in seconds.
+var latencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+type histogram struct {
+	buckets []uint64
+	count   uint64
+	sum     float64
+}
+
+// metricSet holds the values of every metric, keyed by name and then by their
+// rendered labels.
+type metricSet struct {
+	lock       sync.Mutex
+	values     map[string]map[string]float64
+	histograms map[string]map[string]*histogram
+}
+
+var metrics = newMetricSet()
+
+func newMetricSet() *metricSet {
+	return &metricSet{
+		values:     make(map[string]map[string]float64),
+		histograms: make(map[string]map[string]*histogram),
+	}
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// metricLabels renders label name/value pairs, like
+// metricLabels("cluster", "a") => `cluster="a"`.
+func metricLabels(pairs ...string) string {
+	parts := make([]string, 0, len(pairs)/2)
+	for i := 0; i+1 < len(pairs); i += 2 {
+		parts = append(parts, pairs[i]+`="`+labelEscaper.Replace(pairs[i+1])+`"`)
+	}
+	return strings.Join(parts, ",")
+}
+
+func (m *metricSet) add(desc metricDesc, delta float64, labels ...string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if m.values[desc.name] == nil {
+		m.values[desc.name] = make(map[string]float64)
+	}
+	m.values[desc.name][metricLabels(labels...)] += delta
+}
+
+func (m *metricSet) set(desc metricDesc, value float64, labels ...string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if m.values[desc.name] == nil {
+		m.values[desc.name] = make(map[string]float64)
+	}
+	m.values[desc.name][metricLabels(labels...)] = value
+}
+
+// replace sets every series of a metric at once, dropping any that aren't
+// in series.
+func (m *metricSet) replace(desc metricDesc, series map[string]float64) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.values[desc.name] = series
+}
+
+func (m *metricSet) observe(desc metricDesc, value float64, labels ...string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if m.histograms[desc.name] == nil {
+		m.histograms[desc.name] = make(map[string]*histogram)
+	}
+	key := metricLabels(labels...)
+	h := m.histograms[desc.name][key]
+	if h == nil {
+		h = &histogram{buckets: make([]uint64, len(latencyBuckets))}
+		m.histograms[desc.name][key] = h
+	}
+
+	for i, bound := range latencyBuckets {
+		if value <= bound {
+			h.buckets[i]++
+		}
+	}
+	h.count++
+	h.sum += value
+}
+
+// writeTo writes every metric in the Prometheus text format.
+func (m *metricSet) writeTo(w io.Writer) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	for _, desc := range allMetrics {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", desc.name, desc.help, desc.name, desc.typ)
+
+		if desc.typ == "histogram" {
+			for _, key := range sortedKeys(m.histograms[desc.name]) {
+				h := m.histograms[desc.name][key]
+				sep := ""
+				if key != "" {
+					sep = ","
+				}
+				for i, bound := range latencyBuckets {
+					fmt.Fprintf(w, "%s_bucket{%s%sle=\"%s\"} %d\n", desc.name, key, sep, formatMetric(bound), h.buckets[i])
+				}
+				fmt.Fprintf(w, "%s_bucket{%s%sle=\"+Inf\"} %d\n", desc.name, key, sep, h.count)
+				fmt.Fprintf(w, "%s %s\n", metricSeries(desc.name+"_sum", key), formatMetric(h.sum))
+				fmt.Fprintf(w, "%s %d\n", metricSeries(desc.name+"_count", key), h.count)
+			}
+			continue
+		}
+
+		for _, key := range sortedKeys(m.values[desc.name]) {
+			fmt.Fprintf(w, "%s %s\n", metricSeries(desc.name, key), formatMetric(m.values[desc.name][key]))
+		}
+	}
+}
+
+func metricSeries(name string, labels string) string {
+	if labels == "" {
+		return name
+	}
+	return name + "{" + labels + "}"
+}
+
+func sortedKeys(series interface{}) []string {
+	var keys []string
+	switch s := series.(type) {
+	case map[string]float64:
+		for key := range s {
+			keys = append(keys, key)
+		}
+	case map[string]*histogram:
+		for key := range s {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func formatMetric(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// observeRequest records the latency and outcome of a request to one of a
+// cluster's services.
+func observeRequest(cluster string, service string, endpoint string, start time.Time, err error) {
+	labels := []string{"cluster", cluster, "service", service, "endpoint", endpoint}
+	metrics.observe(upstreamDurationMetric, time.Since(start).Seconds(), labels...)
+	if err != nil {
+		metrics.add(upstreamErrorsMetric, 1, labels...)
+	}
+}
+
+// countJobs updates the job population gauges from the job trackers.
+func countJobs() {
+	series := make(map[string]float64)
+	for _, jt := range trackers() {
+		for _, j := range jt.store.List() {
+			series[metricLabels("cluster", jt.clusterName, "state", j.Details.State)]++
+		}
+	}
+	metrics.replace(jobsMetric, series)
+}
+
+func getMetrics(c web.C, w http.ResponseWriter, r *http.Request) {
+	countJobs()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	metrics.writeTo(w)
+}
+
+// instrumentedJobClient records metrics for each request a RecentJobClient
+// makes.
+type instrumentedJobClient struct {
+	RecentJobClient
+	cluster string
+}
+
+func (c *instrumentedJobClient) listJobs() (*appsResp, error) {
+	start := time.Now()
+	resp, err := c.RecentJobClient.listJobs()
+	observeRequest(c.cluster, "rm", "listJobs", start, err)
+	return resp, err
+}
+
+func (c *instrumentedJobClient) listFinishedJobs(since time.Time) (*jobsResp, error) {
+	start := time.Now()
+	resp, err := c.RecentJobClient.listFinishedJobs(since)
+	observeRequest(c.cluster, "hs", "listFinishedJobs", start, err)
+	return resp, err
+}
+
+func (c *instrumentedJobClient) fetchAppDetails(id string) (jobDetail, error) {
+	start := time.Now()
+	details, err := c.RecentJobClient.fetchAppDetails(id)
+	observeRequest(c.cluster, "rm", "fetchAppDetails", start, err)
+	return details, err
+}
+
+func (c *instrumentedJobClient) fetchJobDetails(id string) (jobDetail, error) {
+	start := time.Now()
+	details, err := c.RecentJobClient.fetchJobDetails(id)
+	observeRequest(c.cluster, "proxy", "fetchJobDetails", start, err)
+	return details, err
+}
+
+func (c *instrumentedJobClient) fetchSparkStages(id string) ([]sparkStage, error) {
+	start := time.Now()
+	stages, err := c.RecentJobClient.fetchSparkStages(id)
+	observeRequest(c.cluster, "proxy", "fetchSparkStages", start, err)
+	return stages, err
+}
+
+func (c *instrumentedJobClient) fetchTezVertices(id string) ([]tezVertex, error) {
+	start := time.Now()
+	vertices, err := c.RecentJobClient.fetchTezVertices(id)
+	observeRequest(c.cluster, "proxy", "fetchTezVertices", start, err)
+	return vertices, err
+}
+
+func (c *instrumentedJobClient) fetchTasks(id string) (tasks, error) {
+	start := time.Now()
+	t, err := c.RecentJobClient.fetchTasks(id)
+	observeRequest(c.cluster, "proxy", "fetchTasks", start, err)
+	return t, err
+}
+
+func (c *instrumentedJobClient) listCounters(id string) ([]counter, error) {
+	start := time.Now()
+	counters, err := c.RecentJobClient.listCounters(id)
+	observeRequest(c.cluster, "proxy", "listCounters", start, err)
+	return counters, err
+}
+
+func (c *instrumentedJobClient) fetchConf(id string) (map[string]string, error) {
+	start := time.Now()
+	conf, err := c.RecentJobClient.fetchConf(id)
+	observeRequest(c.cluster, "rm", "fetchConf", start, err)
+	return conf, err
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMetricsText(t *testing.T) {
+	m := newMetricSet()
+	m.add(droppedUpdatesMetric, 1, "cluster", "a")
+	m.add(droppedUpdatesMetric, 2, "cluster", "a")
+	m.set(sseClientsMetric, 3)
+	m.set(lastPollMetric, 100, "cluster", `we"ird`)
+	m.observe(upstreamDurationMetric, 0.02, "cluster", "a", "service", "rm", "endpoint", "listJobs")
+	m.observe(upstreamDurationMetric, 3, "cluster", "a", "service", "rm", "endpoint", "listJobs")
+
+	var buf bytes.Buffer
+	m.writeTo(&buf)
+	text := buf.String()
+
+	for _, line := range []string{
+		"# TYPE timberlake_dropped_updates_total counter",
+		`timberlake_dropped_updates_total{cluster="a"} 3`,
+		"timberlake_sse_clients 3",
+		`timberlake_last_successful_poll_timestamp_seconds{cluster="we\"ird"} 100`,
+		`timberlake_upstream_request_duration_seconds_bucket{cluster="a",service="rm",endpoint="listJobs",le="0.01"} 0`,
+		`timberlake_upstream_request_duration_seconds_bucket{cluster="a",service="rm",endpoint="listJobs",le="0.025"} 1`,
+		`timberlake_upstream_request_duration_seconds_bucket{cluster="a",service="rm",endpoint="listJobs",le="5"} 2`,
+		`timberlake_upstream_request_duration_seconds_bucket{cluster="a",service="rm",endpoint="listJobs",le="+Inf"} 2`,
+		`timberlake_upstream_request_duration_seconds_sum{cluster="a",service="rm",endpoint="listJobs"} 3.02`,
+		`timberlake_upstream_request_duration_seconds_count{cluster="a",service="rm",endpoint="listJobs"} 2`,
+	} {
+		assert.Contains(t, strings.Split(text, "\n"), line)
+	}
+}
+
+func TestInstrumentedJobClient(t *testing.T) {
+	jc := new(mockJobClient)
+	jc.On("listFinishedJobs", time.Time{}).Return(nil, errors.New("boom"))
+
+	client := &instrumentedJobClient{RecentJobClient: jc, cluster: "instrumented"}
+	_, err := client.listFinishedJobs(time.Time{})
+	assert.Error(t, err)
+
+	var buf bytes.Buffer
+	metrics.writeTo(&buf)
+	assert.Contains(t, buf.String(), `timberlake_upstream_request_errors_total{cluster="instrumented",service="hs",endpoint="listFinishedJobs"} 1`)
+}
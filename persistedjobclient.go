@@ -1,10 +1,13 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
+	"net/url"
 	"strings"
 
 	"github.com/aws/aws-sdk-go/aws"
@@ -13,10 +16,74 @@ import (
 )
 
 // PersistedJobClient fetches retired jobs from persistent storage (e.g. S3) that
-// stores job indefinitely (or a very long time)
+// stores job indefinitely (or a very long time), and archives finished jobs to
+// it.
 type PersistedJobClient interface {
 	FetchJob(id string) (*job, error)
 	FetchFlowJobIds(flowID string) ([]string, error)
+	StoreJob(job *job) error
+}
+
+var errJobNotFound = errors.New("job not found")
+
+// newPersistedJobClient creates a client for the store at rawURL, which is one
+// of:
+//
+//	s3://<bucket>
+//	file:///<path>
+//	hdfs://[<namenode>]/<path>
+//	none
+//
+// HDFS stores use the default namenodes if the URL doesn't name one.
+func newPersistedJobClient(rawURL string, awsRegion string, jobsPrefix string, flowPrefix string, defaultNamenodes *endpoints) (PersistedJobClient, error) {
+	if rawURL == "none" {
+		return noneJobClient{}, nil
+	}
+
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+
+	switch u.Scheme {
+	case "s3":
+		if u.Host == "" {
+			return nil, fmt.Errorf("no bucket in persisted store URL %q", rawURL)
+		}
+		return NewS3JobClient(awsRegion, u.Host, jobsPrefix, flowPrefix), nil
+	case "file":
+		if u.Host != "" {
+			return nil, fmt.Errorf("file URLs must be absolute paths, like file:///var/lib/timberlake, not %q", rawURL)
+		}
+		return &fsJobClient{fs: localFS{}, root: u.Path, jobsPrefix: jobsPrefix, flowPrefix: flowPrefix}, nil
+	case "hdfs":
+		namenodes := defaultNamenodes
+		if u.Host != "" {
+			namenodes = &endpoints{service: "namenode", addresses: []string{u.Host}}
+			if defaultNamenodes != nil {
+				namenodes.auth = defaultNamenodes.auth
+			}
+		}
+		return &fsJobClient{fs: hdfsFS{pool: newHDFSPool(namenodes, *hdfsReads)}, root: u.Path, jobsPrefix: jobsPrefix, flowPrefix: flowPrefix}, nil
+	}
+
+	return nil, fmt.Errorf("unsupported persisted store %q", rawURL)
+}
+
+// noneJobClient is used when there's no persisted store. It doesn't have any
+// jobs, and discards the ones it's asked to store.
+type noneJobClient struct{}
+
+func (noneJobClient) FetchJob(id string) (*job, error) {
+	return nil, errJobNotFound
+}
+
+func (noneJobClient) FetchFlowJobIds(flowID string) ([]string, error) {
+	return []string{}, nil
+}
+
+func (noneJobClient) StoreJob(job *job) error {
+	return nil
 }
 
 /**
@@ -44,6 +111,10 @@ func NewS3JobClient(awsRegion string, bucketName string, jobsPrefix string, flow
 	config := &aws.Config{
 		Region: aws.String(awsRegion),
 	}
+	return newS3JobClient(config, bucketName, jobsPrefix, flowPrefix)
+}
+
+func newS3JobClient(config *aws.Config, bucketName string, jobsPrefix string, flowPrefix string) *s3JobClient {
 	return &s3JobClient{
 		bucketName: bucketName,
 		jobsPrefix: jobsPrefix,
@@ -117,3 +188,34 @@ func (client *s3JobClient) FetchJob(id string) (*job, error) {
 	// handle the translating to be consistent with job history server
 	return s3responseToJob(data), nil
 }
+
+// StoreJob archives a job, and adds it to its cascading flow's index if it
+// belongs to one.
+func (client *s3JobClient) StoreJob(job *job) error {
+	data := jobToS3Response(job)
+	jsonBytes, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+
+	keys := []string{fmt.Sprintf("%s/%s.json", client.jobsPrefix, data.ID)}
+	if flowID := data.Conf["cascading.flow.id"]; flowID != "" {
+		keys = append(keys, fmt.Sprintf("%s/%s/%s.json", client.flowPrefix, flowID, data.ID))
+	}
+
+	for _, s3Key := range keys {
+		input := &s3.PutObjectInput{
+			Bucket:      aws.String(client.bucketName),
+			Key:         aws.String(s3Key),
+			Body:        bytes.NewReader(jsonBytes),
+			ContentType: aws.String("application/json"),
+		}
+
+		if _, err := client.s3Client.PutObject(input); err != nil {
+			log.Printf("Failed to store to S3: `%s`\n", err.Error())
+			return err
+		}
+	}
+
+	return nil
+}
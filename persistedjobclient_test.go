@@ -0,0 +1,217 @@
+package main
+
+import (
+	"encoding/xml"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/stripe/timberlake/jhist"
+)
+
+// fakeS3 is just enough of the S3 API, with path style addressing, to store
+// and fetch objects from a single bucket.
+type fakeS3 struct {
+	objects map[string][]byte
+	lock    sync.Mutex
+}
+
+type fakeS3Listing struct {
+	XMLName  xml.Name `xml:"ListBucketResult"`
+	Contents []struct {
+		Key string
+	}
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)
+	key := ""
+	if len(parts) == 2 {
+		key = parts[1]
+	}
+
+	switch {
+	case r.Method == "PUT":
+		body, _ := ioutil.ReadAll(r.Body)
+		f.objects[key] = body
+	case r.Method == "GET" && key == "":
+		listing := fakeS3Listing{}
+		keys := make([]string, 0)
+		for k := range f.objects {
+			if strings.HasPrefix(k, r.URL.Query().Get("prefix")) {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			listing.Contents = append(listing.Contents, struct{ Key string }{k})
+		}
+		xml.NewEncoder(w).Encode(listing)
+	case r.Method == "GET":
+		body, ok := f.objects[key]
+		if !ok {
+			w.WriteHeader(404)
+			return
+		}
+		w.Write(body)
+	default:
+		w.WriteHeader(405)
+	}
+}
+
+func TestStoreJobRoundTrip(t *testing.T) {
+	store := &fakeS3{objects: make(map[string][]byte)}
+	server := httptest.NewServer(store)
+	defer server.Close()
+
+	client := newS3JobClient(&aws.Config{
+		Region:           aws.String("us-east-1"),
+		Endpoint:         aws.String(server.URL),
+		Credentials:      credentials.NewStaticCredentials("id", "secret", ""),
+		S3ForcePathStyle: aws.Bool(true),
+		DisableSSL:       aws.Bool(true),
+	}, "bucket", "jobs", "flows")
+
+	flowID := "ABC123"
+	j := &job{
+		Details: jobDetail{
+			ID:           "job_1_0001",
+			Name:         "sleep",
+			User:         "alice",
+			State:        "SUCCEEDED",
+			StartTime:    1000,
+			FinishTime:   5000,
+			MapsTotal:    2,
+			ReducesTotal: 1,
+		},
+		conf: conf{Flags: map[string]string{"mapreduce.input.fileinputformat.inputdir": "/in"}},
+		Tasks: tasks{
+			Map:    [][]int64{{1000, 2000}, {1500, 2500}},
+			Reduce: [][]int64{{3000, 4000}},
+		},
+		Counters: []counter{
+			{Name: "FileSystemCounter.HDFS_BYTES_READ", Total: 10, Map: 10},
+			{Name: "FileSystemCounter.S3_BYTES_READ", Total: 5, Map: 5},
+			{Name: "TaskCounter.CPU_MILLISECONDS", Total: 30, Map: 20, Reduce: 10},
+		},
+		FlowID: &flowID,
+		attempts: []jhist.Attempt{
+			{Type: "MAP", StartTime: 1000, FinishTime: 2000, Status: "SUCCEEDED"},
+			{Type: "MAP", StartTime: 1500, FinishTime: 2500, Status: "SUCCEEDED"},
+			{Type: "MAP", StartTime: 1200, FinishTime: 1400, Status: "FAILED"},
+			{Type: "REDUCE", StartTime: 3000, FinishTime: 4000, Status: "SUCCEEDED"},
+		},
+	}
+
+	require.NoError(t, client.StoreJob(j))
+	_, ok := j.conf.Flags["cascading.flow.id"]
+	assert.False(t, ok, "storing a job shouldn't change its conf")
+
+	ids, err := client.FetchFlowJobIds(flowID)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"job_1_0001"}, ids)
+
+	stored, err := client.FetchJob("job_1_0001")
+	require.NoError(t, err)
+	assert.Equal(t, "SUCCEEDED", stored.Details.State)
+	assert.Equal(t, "alice", stored.Details.User)
+	assert.Equal(t, 2, stored.Details.MapsCompleted)
+	assert.Equal(t, 1, stored.Details.MapsFailed, "task outcomes should be archived")
+	assert.Equal(t, 1, stored.Details.ReducesCompleted)
+	assert.Len(t, stored.Tasks.Map, 3, "every attempt should be archived")
+	assert.Equal(t, j.Tasks.Reduce, stored.Tasks.Reduce)
+	assert.Equal(t, "/in", stored.conf.Input)
+	assert.Equal(t, flowID, *stored.FlowID)
+
+	sort.Slice(stored.Counters, func(i, k int) bool { return stored.Counters[i].Name < stored.Counters[k].Name })
+	assert.Equal(t, j.Counters, stored.Counters, "each counter should be loaded once, with its group")
+	assert.Equal(t, int64(20), stored.Details.MapsTotalTime)
+	assert.Equal(t, int64(10), stored.Details.ReducesTotalTime)
+
+	// Jobs archived before counters kept their groups.
+	legacy := s3jobdetailToJobDetail(&S3JobDetail{
+		MapCounters:    map[string]int{"CPU_MILLISECONDS": 7},
+		ReduceCounters: map[string]int{"CPU_MILLISECONDS": 3},
+	})
+	assert.Equal(t, int64(7), legacy.MapsTotalTime)
+	assert.Equal(t, int64(3), legacy.ReducesTotalTime)
+}
+
+func TestFileStoreRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "timberlake")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	client, err := newPersistedJobClient("file://"+dir, "", "jobs", "flows", nil)
+	require.NoError(t, err)
+
+	flowID := "ABC123"
+	j := &job{
+		Details:  jobDetail{ID: "job_1_0001", State: "FAILED", MapsTotal: 1},
+		FlowID:   &flowID,
+		attempts: []jhist.Attempt{{Type: "MAP", StartTime: 1000, FinishTime: 2000, Status: "FAILED"}},
+	}
+	require.NoError(t, client.StoreJob(j))
+	require.NoError(t, client.StoreJob(j))
+
+	_, err = os.Stat(filepath.Join(dir, "flows", flowID, "job_1_0001.json"))
+	assert.NoError(t, err)
+
+	ids, err := client.FetchFlowJobIds(flowID)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"job_1_0001"}, ids)
+
+	ids, err = client.FetchFlowJobIds("missing")
+	require.NoError(t, err)
+	assert.Empty(t, ids)
+
+	stored, err := client.FetchJob("job_1_0001")
+	require.NoError(t, err)
+	assert.Equal(t, "FAILED", stored.Details.State)
+	assert.Equal(t, tasks{Map: [][]int64{{1000, 2000}}, Reduce: [][]int64{}}, stored.Tasks)
+
+	_, err = client.FetchJob("job_1_0002")
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestNewPersistedJobClient(t *testing.T) {
+	client, err := newPersistedJobClient("none", "", "", "", nil)
+	require.NoError(t, err)
+	job, err := client.FetchJob("job_1_0001")
+	assert.Nil(t, job)
+	assert.Equal(t, errJobNotFound, err)
+
+	auth := &hadoopAuth{namenodePrincipal: "nn/_HOST"}
+	namenodes := newEndpoints("persisted", "namenode", []string{"nn:8020", "nn2:8020"}, auth, nil)
+	client, err = newPersistedJobClient("hdfs:///timberlake", "", "jobs", "flows", namenodes)
+	require.NoError(t, err)
+	assert.Equal(t, namenodes, client.(*fsJobClient).fs.(hdfsFS).pool.namenodes)
+	assert.Equal(t, "/timberlake", client.(*fsJobClient).root)
+
+	client, err = newPersistedJobClient("hdfs://other:9000/timberlake", "", "jobs", "flows", namenodes)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"other:9000"}, client.(*fsJobClient).fs.(hdfsFS).pool.namenodes.all())
+	assert.Equal(t, auth, client.(*fsJobClient).fs.(hdfsFS).pool.namenodes.auth, "other namenodes should use the default cluster's auth")
+
+	client, err = newPersistedJobClient("s3://bucket", "us-east-1", "jobs", "flows", nil)
+	require.NoError(t, err)
+	assert.Equal(t, "bucket", client.(*s3JobClient).bucketName)
+
+	for _, invalid := range []string{"s3://", "file://host/path", "ftp://host/path", "/path"} {
+		_, err := newPersistedJobClient(invalid, "", "", "", nil)
+		assert.Error(t, err, invalid)
+	}
+}
@@ -1,30 +1,115 @@
 package main
 
 import (
-	"github.com/stretchr/testify/mock"
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
 	"testing"
 	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"github.com/zenazn/goji/web"
 )
 
 func TestJobTrackerJobsMapRace(t *testing.T) {
+	defer func(saved map[string]*jobTracker) { jts = saved }(jts)
+	defer func(saved PersistedJobClient) { persistedJobClient = saved }(persistedJobClient)
+	persistedJobClient = noneJobClient{}
+
 	mockClient := new(mockJobClient)
 	mockHistoryClient := new(mockHdfsJobHistoryClient)
 
 	jobresp := jobsResp{
 		Jobs: jobsDetailList{
-			Job: []jobDetail{jobDetail{}},
+			Job: []jobDetail{jobDetail{ID: "job_1_0002", State: "SUCCEEDED"}},
 		},
 	}
 	mockClient.On("listFinishedJobs", mock.AnythingOfType("time.Time")).Return(&jobresp, nil)
 
 	appresp := appsResp{
 		Apps: appsDetailList{
-			App: []jobDetail{jobDetail{}},
+			App: []appDetail{appDetail{ID: "application_1_0001", State: "RUNNING"}},
 		},
 	}
 	mockClient.On("listJobs").Return(&appresp, nil)
 	jt := newJobTracker("foo", "", "", mockClient, mockHistoryClient)
+	jt.config.PollInterval = 10 * time.Millisecond
+	jts = map[string]*jobTracker{"foo": jt}
 
+	s := newSSE()
+	go s.Loop()
 	jt.Loop()
-	time.Sleep(time.Second * 5)
+	jt.start(func() { jt.sendUpdates(s) })
+	defer jt.Stop()
+
+	mux := web.New()
+	mux.Get("/sse", s)
+	mux.Get("/jobs/", getJobs)
+	mux.Get("/jobs/:id", getJobAPIHandler)
+	mux.Put("/jobs/:id/pin", pinJob)
+	mux.Get("/metrics", getMetrics)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req, err := http.NewRequest("GET", server.URL+"/sse", nil)
+	require.NoError(t, err)
+	stream, err := http.DefaultClient.Do(req.WithContext(ctx))
+	require.NoError(t, err)
+	go io.Copy(ioutil.Discard, stream.Body)
+
+	// Hit the API while the tracker's loops replace the jobs, and trimming
+	// and killing change them.
+	deadline := time.Now().Add(2 * time.Second)
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for time.Now().Before(deadline) {
+				for _, path := range []string{"/jobs/", "/jobs/job_1_0001", "/jobs/job_1_0002", "/metrics"} {
+					res, err := http.Get(server.URL + path)
+					if !assert.NoError(t, err) {
+						return
+					}
+					io.Copy(ioutil.Discard, res.Body)
+					res.Body.Close()
+				}
+
+				req, _ := http.NewRequest("PUT", server.URL+"/jobs/job_1_0002/pin", nil)
+				if res, err := http.DefaultClient.Do(req); assert.NoError(t, err) {
+					res.Body.Close()
+				}
+			}
+		}()
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for time.Now().Before(deadline) {
+			jt.shrinkCache(time.Now())
+			jt.store.Update("job_1_0001", func(j *job) {
+				j.Details.State = "KILLED"
+				j.Tasks.Map = killTasks(j.Tasks.Map, 1)
+			})
+			time.Sleep(time.Millisecond)
+		}
+	}()
+	wg.Wait()
+
+	res, err := http.Get(server.URL + "/jobs/")
+	require.NoError(t, err)
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	require.NoError(t, err)
+	assert.Contains(t, string(body), `"application_1_0001"`)
+	assert.Contains(t, string(body), `"job_1_0002"`)
+	assert.Equal(t, 2, jt.store.Len())
 }
@@ -6,8 +6,9 @@ import (
 	"io/ioutil"
 	"log"
 	"net/http"
-	"regexp"
+	"reflect"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -16,50 +17,51 @@ import (
 type RecentJobClient interface {
 	listJobs() (*appsResp, error)
 	listFinishedJobs(since time.Time) (*jobsResp, error)
+	fetchAppDetails(id string) (jobDetail, error)
 	fetchJobDetails(id string) (jobDetail, error)
+	fetchSparkStages(id string) ([]sparkStage, error)
+	fetchTezVertices(id string) ([]tezVertex, error)
 	fetchTasks(id string) (tasks, error)
 	listCounters(id string) ([]counter, error)
 	fetchConf(id string) (map[string]string, error)
-	getNamenodeAddress() string
-	getRMAddress() string
-	getJobHistoryAddress() string
+	getEndpoints() *clusterEndpoints
 }
 
 type hadoopJobClient struct {
-	resourceManagerHost string
-	jobHistoryHost      string
-	proxyHost           string
-	namenodeAddresses   string
-}
+	endpoints clusterEndpoints
 
-// Redirects are banned for two reasons:
-// 1. When a job is in the accepted state the JSON API redirects to an HTML page.
-// 2. When a job is finished The RM redirects to the history server over an
-//    address we may not be able to follow.
-var httpClient = http.Client{
-	Timeout: *httpTimeout,
-	CheckRedirect: func(req *http.Request, via []*http.Request) error {
-		return fmt.Errorf("no redirects allowed. Blocked redirect to %s", req.URL)
-	},
+	// The index of the last DAG seen in each Tez application.
+	tezDAGs     map[string]int
+	tezDAGsLock sync.Mutex
 }
 
-var redirectRegexp, _ = regexp.Compile("This is standby RM. Redirecting to the current active RM: (https?://[^/]*)")
+// newRecentJobClient creates a client for a cluster. Each of its services
+// can have several addresses, for high availability. If there's no separate
+// proxy, the resource managers are used.
+func newRecentJobClient(cluster string, resourceManagerHosts []string, jobHistoryHosts []string, proxyHosts []string, namenodeAddresses []string, auth *hadoopAuth) RecentJobClient {
+	rm := newEndpoints(cluster, "rm", resourceManagerHosts, auth, probeResourceManager)
+	proxy := rm
+	if len(proxyHosts) > 0 && !reflect.DeepEqual(proxyHosts, resourceManagerHosts) {
+		proxy = newEndpoints(cluster, "proxy", proxyHosts, auth, probeHTTP)
+	}
 
-func newRecentJobClient(resourceManagerHost string, jobHistoryHost string, proxyHost string, namenodeAddresses string) RecentJobClient {
 	return &hadoopJobClient{
-		resourceManagerHost: resourceManagerHost,
-		jobHistoryHost:      jobHistoryHost,
-		proxyHost:           proxyHost,
-		namenodeAddresses:   namenodeAddresses,
+		endpoints: clusterEndpoints{
+			ResourceManager: rm,
+			HistoryServer:   newEndpoints(cluster, "hs", jobHistoryHosts, auth, probeHistoryServer),
+			Proxy:           proxy,
+			Namenode:        newEndpoints(cluster, "namenode", namenodeAddresses, auth, nil),
+		},
+		tezDAGs: make(map[string]int),
 	}
 }
 
 // if response is not valid JSON, the response string will be returned along
 // with the error
-func getJSON(url string, data interface{}) (string, error) {
+func getJSON(client httpDoer, url string, data interface{}) (string, error) {
 	req, err := http.NewRequest("GET", url, nil)
 	req.Close = true
-	resp, err := httpClient.Do(req)
+	resp, err := client.Do(req)
 	if err != nil {
 		if strings.Index(err.Error(), "use of closed network connection") != -1 {
 			log.Println("Could not get JSON due to closed network connection.")
@@ -85,29 +87,22 @@ func getJSON(url string, data interface{}) (string, error) {
 	return "", err
 }
 
-func (jt *hadoopJobClient) getNamenodeAddress() string {
-	return jt.namenodeAddresses
+func (jt *hadoopJobClient) getEndpoints() *clusterEndpoints {
+	return &jt.endpoints
 }
 
-func (jt *hadoopJobClient) getRMAddress() string {
-	return jt.resourceManagerHost
-}
-
-func (jt *hadoopJobClient) getJobHistoryAddress() string {
-	return jt.jobHistoryHost
+// getJSONFrom calls getJSON with the path on the active address of a
+// service, failing over to its other addresses if it's down.
+func getJSONFrom(e *endpoints, path string, data interface{}) error {
+	return e.do(func(address string) error {
+		_, err := getJSON(e.auth.http, address+path, data)
+		return err
+	})
 }
 
 func (jt *hadoopJobClient) listJobs() (*appsResp, error) {
-	url := fmt.Sprintf("%s/ws/v1/cluster/apps/?states=running,submitted,accepted,new", jt.resourceManagerHost)
-	log.Printf("RM URL: %s\n", url)
 	resp := &appsResp{}
-	responseStr, err := getJSON(url, resp)
-	var submatch = redirectRegexp.FindStringSubmatch(responseStr)
-	if len(submatch) == 2 {
-		log.Printf("Response indicated a redirect but it was not followed: `%s`\n", responseStr)
-		log.Printf("Updating jt.resourceManagerHost from %s to %s\n", jt.resourceManagerHost, submatch[1])
-		jt.resourceManagerHost = submatch[1]
-	}
+	err := getJSONFrom(jt.endpoints.ResourceManager, "/ws/v1/cluster/apps/?states=running,submitted,accepted,new", resp)
 	if err != nil {
 		return nil, err
 	}
@@ -116,9 +111,9 @@ func (jt *hadoopJobClient) listJobs() (*appsResp, error) {
 }
 
 func (jt *hadoopJobClient) listFinishedJobs(since time.Time) (*jobsResp, error) {
-	url := fmt.Sprintf("%s/ws/v1/history/mapreduce/jobs?finishedTimeBegin=%d000", jt.jobHistoryHost, since.Unix())
+	path := fmt.Sprintf("/ws/v1/history/mapreduce/jobs?finishedTimeBegin=%d000", since.Unix())
 	resp := &jobsResp{}
-	_, err := getJSON(url, resp)
+	err := getJSONFrom(jt.endpoints.HistoryServer, path, resp)
 	if err != nil {
 		return nil, err
 	}
@@ -126,31 +121,94 @@ func (jt *hadoopJobClient) listFinishedJobs(since time.Time) (*jobsResp, error)
 	return resp, nil
 }
 
+// fetchAppDetails reads an application's details from the RM. Unlike the
+// other fetches this works for any application type, and for applications
+// that have already finished.
+func (jt *hadoopJobClient) fetchAppDetails(id string) (jobDetail, error) {
+	appID, _ := hadoopIDs(id)
+	path := fmt.Sprintf("/ws/v1/cluster/apps/%s", appID)
+
+	resp := &appResp{}
+	if err := getJSONFrom(jt.endpoints.ResourceManager, path, resp); err != nil {
+		return jobDetail{}, err
+	}
+
+	if resp.App.FinishTime != 0 {
+		jt.tezDAGsLock.Lock()
+		delete(jt.tezDAGs, appID)
+		jt.tezDAGsLock.Unlock()
+	}
+
+	return resp.App.jobDetail(), nil
+}
+
 func (jt *hadoopJobClient) fetchJobDetails(id string) (jobDetail, error) {
 	appID, _ := hadoopIDs(id)
-	url := fmt.Sprintf("%s/proxy/%s/ws/v1/mapreduce/jobs", jt.proxyHost, appID)
+	path := fmt.Sprintf("/proxy/%s/ws/v1/mapreduce/jobs", appID)
 
 	jobs := &jobsResp{}
-	responseStr, err := getJSON(url, jobs)
-	var submatch = redirectRegexp.FindStringSubmatch(responseStr)
-	if len(submatch) == 2 {
-		log.Printf("Response indicated a redirect but it was not followed: `%s`\n", responseStr)
-		log.Printf("Updating jt.proxyHost from %s to %s\n", jt.proxyHost, submatch[1])
-		jt.proxyHost = submatch[1]
-	}
-	if err != nil {
+	if err := getJSONFrom(jt.endpoints.Proxy, path, jobs); err != nil {
 		return jobDetail{}, err
 	}
 
 	return jobs.Jobs.Job[0], nil
 }
 
+// fetchSparkStages reads the stages of a running Spark application from the
+// driver's REST API.
+func (jt *hadoopJobClient) fetchSparkStages(id string) ([]sparkStage, error) {
+	appID, _ := hadoopIDs(id)
+	path := fmt.Sprintf("/proxy/%s/api/v1/applications/%s/stages", appID, appID)
+
+	var stages []sparkStage
+	if err := getJSONFrom(jt.endpoints.Proxy, path, &stages); err != nil {
+		return nil, err
+	}
+
+	return stages, nil
+}
+
+// fetchTezVertices reads the vertices of the DAG currently running in a Tez
+// application master. The AM only answers for its current DAG, and a session
+// runs its DAGs one after another, so we remember the last DAG we saw and
+// step forward to the next one when the AM stops answering for it.
+func (jt *hadoopJobClient) fetchTezVertices(id string) ([]tezVertex, error) {
+	appID, _ := hadoopIDs(id)
+
+	jt.tezDAGsLock.Lock()
+	if jt.tezDAGs == nil {
+		jt.tezDAGs = make(map[string]int)
+	}
+	dag := jt.tezDAGs[appID]
+	jt.tezDAGsLock.Unlock()
+	if dag == 0 {
+		dag = 1
+	}
+
+	resp := &struct {
+		Vertices []tezVertex `json:"vertices"`
+	}{}
+
+	var err error
+	for _, dagID := range []int{dag, dag + 1} {
+		path := fmt.Sprintf("/proxy/%s/ui/ws/v2/tez/verticesInfo?dagID=%d", appID, dagID)
+		if err = getJSONFrom(jt.endpoints.Proxy, path, resp); err == nil {
+			jt.tezDAGsLock.Lock()
+			jt.tezDAGs[appID] = dagID
+			jt.tezDAGsLock.Unlock()
+			return resp.Vertices, nil
+		}
+	}
+
+	return nil, err
+}
+
 func (jt *hadoopJobClient) fetchTasks(id string) (tasks, error) {
 	appID, jobID := hadoopIDs(id)
-	url := fmt.Sprintf("%s/proxy/%s/ws/v1/mapreduce/jobs/%s/tasks", jt.proxyHost, appID, jobID)
+	path := fmt.Sprintf("/proxy/%s/ws/v1/mapreduce/jobs/%s/tasks", appID, jobID)
 
 	taskResp := &tasksResp{}
-	if _, err := getJSON(url, taskResp); err != nil {
+	if err := getJSONFrom(jt.endpoints.Proxy, path, taskResp); err != nil {
 		return tasks{}, err
 	}
 
@@ -176,10 +234,10 @@ func (jt *hadoopJobClient) fetchTasks(id string) (tasks, error) {
 
 func (jt *hadoopJobClient) listCounters(id string) ([]counter, error) {
 	appID, jobID := hadoopIDs(id)
-	url := fmt.Sprintf("%s/proxy/%s/ws/v1/mapreduce/jobs/%s/counters", jt.proxyHost, appID, jobID)
+	path := fmt.Sprintf("/proxy/%s/ws/v1/mapreduce/jobs/%s/counters", appID, jobID)
 
 	counterResp := &countersResp{}
-	if _, err := getJSON(url, counterResp); err != nil {
+	if err := getJSONFrom(jt.endpoints.Proxy, path, counterResp); err != nil {
 		return nil, err
 	}
 
@@ -204,9 +262,9 @@ func (jt *hadoopJobClient) listCounters(id string) ([]counter, error) {
 // fetchConf pulls a job's hadoop conf from the RM.
 func (jt *hadoopJobClient) fetchConf(id string) (map[string]string, error) {
 	appID, jobID := hadoopIDs(id)
-	url := fmt.Sprintf("%s/proxy/%s/ws/v1/mapreduce/jobs/%s/conf", jt.resourceManagerHost, appID, jobID)
+	path := fmt.Sprintf("/proxy/%s/ws/v1/mapreduce/jobs/%s/conf", appID, jobID)
 	confResp := &confResp{}
-	if _, err := getJSON(url, confResp); err != nil {
+	if err := getJSONFrom(jt.endpoints.ResourceManager, path, confResp); err != nil {
 		return nil, err
 	}
 
@@ -0,0 +1,376 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/stripe/timberlake/jhist"
+)
+
+var replayDir = flag.String("replay-dir", "", "Serve the finished jobs in a directory of .jhist and _conf.xml files, like a copy of the history server's done directory, instead of tracking live clusters.")
+var replaySpeed = flag.Float64("replay-speed", 0, "With --replay-dir, replay the jobs as if they were running again, this many times faster than they really ran. By default they're all finished from the start.")
+
+var errReplay = errors.New("not available when replaying history files")
+
+// replayJobClient is a RecentJobClient for a directory of history files, in
+// place of a live cluster. Without a clock every job has already finished.
+// With one, the cluster's history plays out again: jobs are listed as running
+// from when they started until they finished.
+//
+// It's also the tracker's historySource, since it's already found every job's
+// files.
+type replayJobClient struct {
+	*localHistorySource
+	jobs  []*replayedJob
+	byID  map[jobID]*replayedJob
+	clock *replayClock
+}
+
+// replayedJob is a job found in the replay directory.
+type replayedJob struct {
+	details  jobDetail
+	histFile string
+	confFile string
+}
+
+// replayClock runs the replayed cluster's time forward from just before its
+// first job started, speed times faster than real time.
+type replayClock struct {
+	started time.Time
+	origin  int64
+	speed   float64
+}
+
+// at is the replayed time at t, in milliseconds.
+func (c *replayClock) at(t time.Time) int64 {
+	return c.origin + int64(float64(t.Sub(c.started)/time.Millisecond)*c.speed)
+}
+
+func (c *replayClock) now() int64 {
+	return c.at(time.Now())
+}
+
+// replayHistoryClient loads replayed jobs' history files, and marks the jobs
+// it loads without their tasks and counters as partial, so that they're
+// loaded in full when they're viewed. Replayed jobs are usually older than
+// fullDataDuration, so most are only loaded that way.
+type replayHistoryClient struct {
+	hdfsJobHistoryClient
+}
+
+func (c *replayHistoryClient) updateFromHistoryFile(jt *jobTracker, job *job, full bool) error {
+	if err := c.hdfsJobHistoryClient.updateFromHistoryFile(jt, job, full); err != nil {
+		return err
+	}
+	if !full {
+		job.partial = true
+	}
+	return nil
+}
+
+// replayClusterConfig is the one cluster tracked with --replay-dir.
+func replayClusterConfig() []clusterConfig {
+	return []clusterConfig{flagDefaults(clusterConfig{
+		Name:        strings.Split(*clusterNames, ",")[0],
+		ReplayDir:   *replayDir,
+		ReplaySpeed: *replaySpeed,
+	})}
+}
+
+// newReplayTracker creates a tracker for a replayed cluster, without starting
+// it.
+func newReplayTracker(cfg clusterConfig) (*jobTracker, error) {
+	client, err := newReplayJobClient(cfg.ReplayDir, cfg.ReplaySpeed)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't replay cluster %s: %s", cfg.Name, err)
+	}
+	log.Printf("Replaying %d jobs from %s as cluster %s\n", len(client.jobs), cfg.ReplayDir, cfg.Name)
+
+	jt := newJobTracker(cfg.Name, "", "", client, &replayHistoryClient{})
+	jt.config = cfg
+	jt.history = client
+	return jt, nil
+}
+
+// newReplayJobClient finds the jobs in dir. A speed of zero or less means
+// every job has finished.
+func newReplayJobClient(dir string, speed float64) (*replayJobClient, error) {
+	c := &replayJobClient{
+		localHistorySource: newLocalHistorySource(dir),
+		byID:               make(map[jobID]*replayedJob),
+	}
+
+	confFiles := make(map[jobID]string)
+	err := filepath.Walk(filepath.FromSlash(dir), func(p string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+
+		name := info.Name()
+		if strings.HasSuffix(name, "_conf.xml") {
+			confFiles[jobID(strings.TrimSuffix(name, "_conf.xml"))] = filepath.ToSlash(p)
+		} else if strings.HasSuffix(name, ".jhist") {
+			details, err := replayedJobDetails(p)
+			if err != nil {
+				log.Printf("Skipping %s: %s\n", p, err)
+				return nil
+			}
+			_, id := hadoopIDs(details.ID)
+			if c.byID[id] == nil {
+				j := &replayedJob{details: details, histFile: filepath.ToSlash(p)}
+				c.byID[id] = j
+				c.jobs = append(c.jobs, j)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(c.jobs) == 0 {
+		return nil, fmt.Errorf("no history files found under %s", dir)
+	}
+
+	for id, j := range c.byID {
+		j.confFile = confFiles[id]
+	}
+	sort.Slice(c.jobs, func(i, k int) bool { return c.jobs[i].details.StartTime < c.jobs[k].details.StartTime })
+
+	if speed > 0 {
+		c.clock = &replayClock{started: time.Now(), origin: c.jobs[0].details.StartTime - 1, speed: speed}
+	}
+	return c, nil
+}
+
+// replayedJobDetails reads a job's details from the name of its history
+// file, which the history server makes from its ID, submit time, user, name,
+// finish time, maps, reduces, state, queue and start time, escaped and
+// separated by dashes. If the file was renamed, it's read instead.
+func replayedJobDetails(histFile string) (jobDetail, error) {
+	fields := strings.Split(strings.TrimSuffix(filepath.Base(histFile), ".jhist"), "-")
+	if len(fields) >= 9 && strings.HasPrefix(fields[0], "job_") {
+		for i, field := range fields {
+			fields[i], _ = url.QueryUnescape(field)
+		}
+
+		details := jobDetail{ID: fields[0], User: fields[2], Name: fields[3], State: fields[7]}
+		details.StartTime, _ = strconv.ParseInt(fields[1], 10, 64)
+		if len(fields) >= 10 {
+			if started, err := strconv.ParseInt(fields[9], 10, 64); err == nil && started > 0 {
+				details.StartTime = started
+			}
+		}
+		details.FinishTime, _ = strconv.ParseInt(fields[4], 10, 64)
+		details.MapsTotal, _ = strconv.Atoi(fields[5])
+		details.ReducesTotal, _ = strconv.Atoi(fields[6])
+		details.Type = appTypeMapReduce
+		details.Queue = fields[8]
+		if details.FinishTime > 0 && details.State != "" {
+			return details, nil
+		}
+	}
+
+	f, err := os.Open(histFile)
+	if err != nil {
+		return jobDetail{}, err
+	}
+	defer f.Close()
+
+	loaded, err := jhist.Load(f)
+	if err != nil {
+		return jobDetail{}, err
+	}
+	if loaded.ID == "" || loaded.FinishTime == 0 {
+		return jobDetail{}, errors.New("the job never finished")
+	}
+	return jobDetail{
+		ID:           loaded.ID,
+		Name:         loaded.Name,
+		User:         loaded.User,
+		State:        loaded.State,
+		StartTime:    loaded.StartTime,
+		FinishTime:   loaded.FinishTime,
+		MapsTotal:    loaded.MapsTotal,
+		ReducesTotal: loaded.ReducesTotal,
+		yarnApp:      yarnApp{Type: appTypeMapReduce},
+	}, nil
+}
+
+// now is the replayed time, and whether there's a clock at all.
+func (c *replayJobClient) now() (int64, bool) {
+	if c.clock == nil {
+		return 0, false
+	}
+	return c.clock.now(), true
+}
+
+// listJobs lists the jobs that would be running at the replayed time.
+func (c *replayJobClient) listJobs() (*appsResp, error) {
+	resp := &appsResp{}
+	now, ok := c.now()
+	if !ok {
+		return resp, nil
+	}
+
+	for _, j := range c.jobs {
+		if j.details.StartTime > now {
+			break
+		}
+		if j.details.FinishTime > now {
+			appID, _ := hadoopIDs(j.details.ID)
+			app := appDetail{
+				ID:        appID,
+				Name:      j.details.Name,
+				User:      j.details.User,
+				State:     "RUNNING",
+				StartTime: j.details.StartTime,
+				yarnApp:   j.details.yarnApp,
+			}
+			app.Progress = 100 * j.progress(now)
+			resp.Apps.App = append(resp.Apps.App, app)
+		}
+	}
+	return resp, nil
+}
+
+// listFinishedJobs lists the jobs that finished between since and the
+// replayed time. Without a clock, that's all of them.
+func (c *replayJobClient) listFinishedJobs(since time.Time) (*jobsResp, error) {
+	resp := &jobsResp{}
+	now, ok := c.now()
+	var from int64
+	if ok {
+		from = c.clock.at(since)
+	}
+	for _, j := range c.jobs {
+		if !ok || (j.details.FinishTime > from && j.details.FinishTime <= now) {
+			resp.Jobs.Job = append(resp.Jobs.Job, j.details)
+		}
+	}
+	return resp, nil
+}
+
+// progress is how far through the job is at the replayed time, from 0 to 1.
+func (j *replayedJob) progress(now int64) float32 {
+	if now >= j.details.FinishTime {
+		return 1
+	}
+	if now <= j.details.StartTime {
+		return 0
+	}
+	return float32(now-j.details.StartTime) / float32(j.details.FinishTime-j.details.StartTime)
+}
+
+func (c *replayJobClient) get(id string) (*replayedJob, error) {
+	_, jid := hadoopIDs(id)
+	j := c.byID[jid]
+	if j == nil {
+		return nil, fmt.Errorf("no history file for %s", id)
+	}
+	return j, nil
+}
+
+func (c *replayJobClient) fetchAppDetails(id string) (jobDetail, error) {
+	j, err := c.get(id)
+	if err != nil {
+		return jobDetail{}, err
+	}
+	return j.details, nil
+}
+
+// fetchJobDetails makes up the progress of a running job: its maps run
+// through the first half of it, and its reduces the second.
+func (c *replayJobClient) fetchJobDetails(id string) (jobDetail, error) {
+	j, err := c.get(id)
+	if err != nil {
+		return jobDetail{}, err
+	}
+	now, ok := c.now()
+	if !ok || now >= j.details.FinishTime {
+		return j.details, nil
+	}
+
+	details := j.details
+	details.State = "RUNNING"
+	details.FinishTime = 0
+	progress := j.progress(now)
+	mapProgress := minFloat(1, 2*progress)
+	reduceProgress := maxFloat(0, 2*progress-1)
+	details.MapProgress = 100 * mapProgress
+	details.MapsCompleted = int(mapProgress * float32(details.MapsTotal))
+	details.ReduceProgress = 100 * reduceProgress
+	details.ReducesCompleted = int(reduceProgress * float32(details.ReducesTotal))
+	return details, nil
+}
+
+func (c *replayJobClient) fetchSparkStages(id string) ([]sparkStage, error) {
+	return nil, errReplay
+}
+
+func (c *replayJobClient) fetchTezVertices(id string) ([]tezVertex, error) {
+	return nil, errReplay
+}
+
+func (c *replayJobClient) fetchTasks(id string) (tasks, error) {
+	return tasks{Map: [][]int64{}, Reduce: [][]int64{}}, nil
+}
+
+func (c *replayJobClient) listCounters(id string) ([]counter, error) {
+	return nil, nil
+}
+
+func (c *replayJobClient) fetchConf(id string) (map[string]string, error) {
+	j, err := c.get(id)
+	if err != nil {
+		return nil, err
+	}
+	if j.confFile == "" {
+		return map[string]string{}, nil
+	}
+
+	var conf map[string]string
+	err = c.read(j.confFile, func(r io.Reader) error {
+		var err error
+		conf, err = loadConf(r)
+		return err
+	})
+	return conf, err
+}
+
+// getEndpoints returns no endpoints, since there's no cluster.
+func (c *replayJobClient) getEndpoints() *clusterEndpoints {
+	return &clusterEndpoints{}
+}
+
+// find returns the files found for a job when the directory was read.
+func (c *replayJobClient) find(id jobID, user string, finishTime int64) (string, string, error) {
+	j := c.byID[id]
+	if j == nil || j.confFile == "" {
+		return c.localHistorySource.find(id, user, finishTime)
+	}
+	return j.confFile, j.histFile, nil
+}
+
+func minFloat(a, b float32) float32 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func maxFloat(a, b float32) float32 {
+	if a > b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReplayJobClient(t *testing.T) {
+	dir, err := ioutil.TempDir("", "timberlake-replay")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	copyHistoryFiles(t, filepath.Join(dir, "done"))
+
+	// A history file that's been renamed is read for its details.
+	data, err := ioutil.ReadFile("test/sleepjob.jhist")
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "renamed.jhist"), data, 0644))
+
+	c, err := newReplayJobClient(dir, 0)
+	require.NoError(t, err)
+	require.Len(t, c.jobs, 1, "the renamed file is the same job")
+	details := c.jobs[0].details
+	assert.Equal(t, string(testJobID), details.ID)
+	assert.Equal(t, "Sleep job", details.Name)
+	assert.Equal(t, "user", details.User)
+	assert.Equal(t, "SUCCEEDED", details.State)
+	assert.Equal(t, int64(1329348448308), details.StartTime)
+	assert.Equal(t, testJobFinishTime, details.FinishTime)
+	assert.Equal(t, 10, details.MapsTotal)
+	assert.Equal(t, "default", details.Queue)
+
+	renamed, err := replayedJobDetails(filepath.Join(dir, "renamed.jhist"))
+	require.NoError(t, err)
+	assert.Equal(t, details.ID, renamed.ID)
+	assert.Equal(t, details.FinishTime, renamed.FinishTime)
+
+	running, err := c.listJobs()
+	require.NoError(t, err)
+	assert.Empty(t, running.Apps.App)
+	finished, err := c.listFinishedJobs(time.Now())
+	require.NoError(t, err)
+	assert.Len(t, finished.Jobs.Job, 1, "without a clock, every job has finished")
+
+	conf, err := c.fetchConf(details.ID)
+	require.NoError(t, err)
+	assert.Equal(t, "/input/dir", conf["mapreduce.input.fileinputformat.inputdir"])
+
+	// Halfway through the job.
+	c.clock = &replayClock{started: time.Now(), origin: details.StartTime + 10000, speed: 1}
+	running, err = c.listJobs()
+	require.NoError(t, err)
+	require.Len(t, running.Apps.App, 1)
+	assert.Equal(t, "application_1329348432655_0001", running.Apps.App[0].ID)
+	assert.Equal(t, "RUNNING", running.Apps.App[0].State)
+	finished, err = c.listFinishedJobs(time.Now().Add(-time.Hour))
+	require.NoError(t, err)
+	assert.Empty(t, finished.Jobs.Job)
+
+	progress, err := c.fetchJobDetails(running.Apps.App[0].ID)
+	require.NoError(t, err)
+	assert.Equal(t, "RUNNING", progress.State)
+	assert.True(t, progress.MapProgress > 90 && progress.ReduceProgress < 10, "%v", progress)
+
+	// And after it.
+	c.clock.origin = details.FinishTime
+	running, err = c.listJobs()
+	require.NoError(t, err)
+	assert.Empty(t, running.Apps.App)
+	finished, err = c.listFinishedJobs(time.Now().Add(-time.Minute))
+	require.NoError(t, err)
+	assert.Len(t, finished.Jobs.Job, 1)
+
+	_, err = newReplayJobClient(filepath.Join(dir, "missing"), 0)
+	assert.Error(t, err)
+}
+
+func TestReplayTracker(t *testing.T) {
+	dir, err := ioutil.TempDir("", "timberlake-replay")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	copyHistoryFiles(t, dir)
+
+	cfg := flagDefaults(clusterConfig{Name: "replay", ReplayDir: dir, PollInterval: 10 * time.Millisecond})
+	require.NoError(t, validateClusterConfig([]clusterConfig{cfg}), "replayed clusters don't need any servers")
+	jt, err := newClusterTracker(cfg)
+	require.NoError(t, err)
+
+	go func() {
+		for range jt.updates {
+		}
+	}()
+	jt.Loop()
+	defer jt.Stop()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for jt.getJob(string(testJobID)) == nil && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	j := jt.getJob(string(testJobID))
+	require.NotNil(t, j, "the job should be backfilled")
+	assert.Equal(t, "Sleep job", j.Details.Name)
+
+	full := jt.reifyJob(j)
+	assert.False(t, full.partial)
+	assert.Len(t, full.Tasks.Map, 11)
+	assert.Equal(t, "/input/dir", full.conf.Input)
+
+	assert.Error(t, jt.killJob("application_1329348432655_0001", "user"))
+	assert.Equal(t, errNoHDFS, jt.testLogsDir())
+}
@@ -1,6 +1,10 @@
 package main
 
-import "strings"
+import (
+	"strings"
+
+	"github.com/stripe/timberlake/jhist"
+)
 
 // S3JobDetail represents our stored job format, which is a little different from
 // what we get from job history server
@@ -45,7 +49,10 @@ func s3responseToJob(data *S3JobDetail) *job {
  * Translates counter names
  */
 func getCounterName(s3name string) string {
-	if strings.Contains(s3name, "BYTES_READ") || strings.Contains(s3name, "BYTES_WRITTEN") {
+	if strings.Contains(s3name, ".") {
+		// Jobs we archived ourselves keep their counters' groups.
+		return s3name
+	} else if strings.Contains(s3name, "BYTES_READ") || strings.Contains(s3name, "BYTES_WRITTEN") {
 		return "FileSystemCounter." + s3name
 	} else if s3name == "REDUCE_SHUFFLE_BYTES" || strings.Contains(s3name, "PUT_RECORDS") {
 		return "TaskCounter." + s3name
@@ -56,27 +63,35 @@ func getCounterName(s3name string) string {
 func s3responseToCounters(s *S3JobDetail) []counter {
 	counters := make([]counter, 0)
 
-	for key := range s.ReduceCounters {
-		counters = append(counters, counter{
-			Name:   getCounterName(key),
-			Total:  s.MapCounters[key] + s.ReduceCounters[key],
-			Map:    s.MapCounters[key],
-			Reduce: s.ReduceCounters[key],
-		})
-	}
-
-	for key := range s.MapCounters {
-		counters = append(counters, counter{
-			Name:   getCounterName(key),
-			Total:  s.MapCounters[key] + s.ReduceCounters[key],
-			Map:    s.MapCounters[key],
-			Reduce: s.ReduceCounters[key],
-		})
+	seen := make(map[string]bool)
+	for _, keys := range []map[string]int{s.MapCounters, s.ReduceCounters} {
+		for key := range keys {
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+
+			counters = append(counters, counter{
+				Name:   getCounterName(key),
+				Total:  s.MapCounters[key] + s.ReduceCounters[key],
+				Map:    s.MapCounters[key],
+				Reduce: s.ReduceCounters[key],
+			})
+		}
 	}
 
 	return counters
 }
 
+// cpuMillis returns a stored job's CPU time. Jobs we archived ourselves keep
+// the counter's group, and older ones don't.
+func cpuMillis(counters map[string]int) int64 {
+	if v, ok := counters["TaskCounter.CPU_MILLISECONDS"]; ok {
+		return int64(v)
+	}
+	return int64(counters["CPU_MILLISECONDS"])
+}
+
 func s3responseToTasks(s *S3JobDetail) tasks {
 	tasks := tasks{Map: make([][]int64, len(s.MapTasks)), Reduce: make([][]int64, len(s.ReduceTasks))}
 
@@ -129,7 +144,7 @@ func s3jobdetailToJobDetail(s *S3JobDetail) jobDetail {
 		MapsCompleted: len(filter(s.MapTasks, func(t task) bool { return t.Status == "SUCCESS" })),
 		MapsFailed:    len(filter(s.MapTasks, func(t task) bool { return t.Status == "FAILED" })),
 		MapsKilled:    len(filter(s.MapTasks, func(t task) bool { return t.Status == "KILLED" })),
-		MapsTotalTime: int64(s.MapCounters["CPU_MILLISECONDS"]),
+		MapsTotalTime: cpuMillis(s.MapCounters),
 
 		ReducesTotal:     s.ReducesTotal,
 		ReduceProgress:   100,
@@ -138,6 +153,68 @@ func s3jobdetailToJobDetail(s *S3JobDetail) jobDetail {
 		ReducesCompleted: len(filter(s.ReduceTasks, func(t task) bool { return t.Status == "SUCCESS" })),
 		ReducesFailed:    len(filter(s.ReduceTasks, func(t task) bool { return t.Status == "FAILED" })),
 		ReducesKilled:    len(filter(s.ReduceTasks, func(t task) bool { return t.Status == "KILLED" })),
-		ReducesTotalTime: int64(s.ReduceCounters["CPU_MILLISECONDS"]),
+		ReducesTotalTime: cpuMillis(s.ReduceCounters),
+	}
+}
+
+// jobToS3Response translates a job into our stored job format, so that it
+// can be read back with s3responseToJob. Its tasks come from the attempts of
+// a full load, since the job's own tasks are trimmed and have no outcomes.
+func jobToS3Response(j *job) *S3JobDetail {
+	state := j.Details.State
+	if state == "SUCCEEDED" {
+		state = "SUCCESS"
+	}
+
+	data := &S3JobDetail{
+		ID:             j.Details.ID,
+		Name:           j.Details.Name,
+		User:           j.Details.User,
+		StartTime:      j.Details.StartTime,
+		FinishTime:     j.Details.FinishTime,
+		State:          state,
+		Conf:           make(map[string]string, len(j.conf.Flags)),
+		MapTasks:       attemptsToS3Tasks(j.attempts, "MAP"),
+		ReduceTasks:    attemptsToS3Tasks(j.attempts, "REDUCE"),
+		MapCounters:    make(map[string]int),
+		ReduceCounters: make(map[string]int),
+		MapsTotal:      j.Details.MapsTotal,
+		ReducesTotal:   j.Details.ReducesTotal,
+	}
+
+	for k, v := range j.conf.Flags {
+		data.Conf[k] = v
 	}
+	if j.FlowID != nil && *j.FlowID != "" {
+		data.Conf["cascading.flow.id"] = *j.FlowID
+	}
+
+	for _, c := range j.Counters {
+		if c.Map != 0 || c.Reduce == 0 {
+			data.MapCounters[c.Name] = c.Map
+		}
+		if c.Reduce != 0 {
+			data.ReduceCounters[c.Name] = c.Reduce
+		}
+	}
+
+	return data
+}
+
+// attemptsToS3Tasks translates every attempt of the given type into a stored
+// task, with the attempt's outcome as its status.
+func attemptsToS3Tasks(attempts []jhist.Attempt, typ string) []task {
+	tasks := make([]task, 0)
+	for _, attempt := range attempts {
+		if attempt.Type != typ {
+			continue
+		}
+
+		status := attempt.Status
+		if status == "SUCCEEDED" {
+			status = "SUCCESS"
+		}
+		tasks = append(tasks, task{StartTime: attempt.StartTime, EndTime: attempt.FinishTime, Status: status})
+	}
+	return tasks
 }
@@ -5,75 +5,317 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
 )
 
+const (
+	// How many events can be waiting to be broadcast before new ones are
+	// dropped.
+	sseEventBuffer = 1024
+
+	// How many events can be waiting to be written to a client. Clients that
+	// fall further behind than this are disconnected.
+	sseClientBuffer = 256
+
+	// How many past events are kept for clients that reconnect.
+	sseReplayBuffer = sseClientBuffer
+)
+
+// How often to send a comment to idle clients, so that proxies don't close
+// the stream.
+var sseHeartbeatInterval = 15 * time.Second
+
+type sseEvent struct {
+	id      uint64
+	typ     string
+	cluster string
+	data    []byte
+
+	// A summary of the job the event is about, for filtering. Cluster events
+	// don't have one. prev is the summary from the last event about the same
+	// job, if there was one.
+	job  *job
+	prev *job
+
+	// Updates to running jobs can also be sent as a job.delta against an
+	// earlier event, the base, to clients that were sent that event.
+	// Diffable events can be the base for later deltas.
+	delta    []byte
+	base     uint64
+	diffable bool
+}
+
+// key identifies the job an event is about across clusters.
+func (event sseEvent) key() string {
+	_, id := hadoopIDs(event.job.Details.ID)
+	return event.cluster + "/" + string(id)
+}
+
+// matches reports whether a client with the given query should get an
+// event. Events that aren't about a job are only filtered by cluster. Clients
+// that matched the job before the event also get it, so that they find out
+// when a job finishes or goes away, and no longer matches.
+func (event sseEvent) matches(q *jobQuery) bool {
+	if event.job != nil {
+		return q.matches(event.job) || (event.prev != nil && q.matches(event.prev))
+	}
+	return q.clusters == nil || q.clusters[event.cluster]
+}
+
+// sseSubscription is a client connecting, along with the ID of the last
+// event it saw if it's reconnecting. Clients can ask to only get updates
+// about the jobs that match a query.
+type sseSubscription struct {
+	events chan sseEvent
+	lastID uint64
+	query  *jobQuery
+}
+
+// sse broadcasts job and cluster events to browsers as server-sent events.
+// Publishing never blocks: each client has its own bounded queue, and the
+// broadcast loop drops clients rather than wait for them.
+//
+// Every event has an ID, and the most recent ones are kept so that a client
+// reconnecting with Last-Event-ID gets the events it missed. IDs start at the
+// time the server started, in milliseconds, so that they keep going up
+// across restarts.
 type sse struct {
-	events       chan []byte
-	addClient    chan chan []byte
-	removeClient chan chan []byte
-	clients      map[chan []byte]bool
+	events       chan sseEvent
+	addClient    chan *sseSubscription
+	removeClient chan chan sseEvent
+	clients      map[chan sseEvent]*jobQuery
+	history      []sseEvent
+	nextID       uint64
+
+	// The ID of the last diffable event about each job.
+	versions map[string]uint64
+
+	// The summary from the last event about each job that's still tracked.
+	summaries map[string]*job
 }
 
 func newSSE() *sse {
 	return &sse{
-		events:       make(chan []byte, 0),
-		addClient:    make(chan chan []byte, 0),
-		removeClient: make(chan chan []byte, 0),
-		clients:      make(map[chan []byte]bool, 0),
+		events:       make(chan sseEvent, sseEventBuffer),
+		addClient:    make(chan *sseSubscription, 0),
+		removeClient: make(chan chan sseEvent, 0),
+		clients:      make(map[chan sseEvent]*jobQuery, 0),
+		history:      make([]sseEvent, 0, sseReplayBuffer),
+		nextID:       uint64(time.Now().UnixNano() / int64(time.Millisecond)),
+		versions:     make(map[string]uint64),
+		summaries:    make(map[string]*job),
+	}
+}
+
+// publish queues an event for every client. It returns false if the event
+// had to be dropped because the broadcast loop is behind.
+func (sse *sse) publish(event sseEvent) bool {
+	select {
+	case sse.events <- event:
+		return true
+	default:
+		return false
 	}
 }
 
 func (sse *sse) Loop() {
 	for {
 		select {
-		case s := <-sse.addClient:
-			sse.clients[s] = true
-			log.Println("Added sse client.", len(sse.clients))
+		case sub := <-sse.addClient:
+			sse.add(sub)
 		case s := <-sse.removeClient:
-			delete(sse.clients, s)
+			if _, ok := sse.clients[s]; ok {
+				sse.drop(s)
+			}
 			log.Println("Removed sse client.", len(sse.clients))
 		case event := <-sse.events:
-			for client := range sse.clients {
-				client <- event
-			}
+			sse.broadcast(event)
+		}
+	}
+}
+
+// add registers a client, and queues any events it missed while it was
+// disconnected. If the events it missed are no longer all kept, or there are
+// too many of them to queue, it's told to resync instead. The resync event
+// has the latest ID, so that the client doesn't ask for the same events
+// again the next time it reconnects.
+func (sse *sse) add(sub *sseSubscription) {
+	sse.clients[sub.events] = sub.query
+	metrics.set(sseClientsMetric, float64(len(sse.clients)))
+	log.Println("Added sse client.", len(sse.clients))
+
+	latest := sse.nextID - 1
+	if sub.lastID == 0 || sub.lastID == latest {
+		return
+	}
+
+	var missed []sseEvent
+	for _, event := range sse.history {
+		if event.id > sub.lastID && event.matches(sub.query) {
+			missed = append(missed, event)
 		}
 	}
+
+	// We can only replay if we still have every event after the client's.
+	replayable := len(sse.history) > 0 && sse.history[0].id <= sub.lastID+1 && sub.lastID < latest
+	if !replayable || len(missed) > cap(sub.events) {
+		log.Println("Asking reconnecting sse client to resync from event", sub.lastID)
+		sub.events <- sseEvent{id: latest, typ: eventResync, data: []byte("{}")}
+		return
+	}
+
+	for _, event := range missed {
+		sub.events <- event
+	}
 }
 
-var ssecounter = 0
+// broadcast assigns the next ID to an event, keeps it for replays, and
+// queues it for every client it matches.
+func (sse *sse) broadcast(event sseEvent) {
+	event.id = sse.nextID
+	sse.nextID++
+
+	if event.job != nil {
+		key := event.key()
+		if event.delta != nil {
+			event.base = sse.versions[key]
+		}
+		if event.diffable {
+			sse.versions[key] = event.id
+		} else {
+			delete(sse.versions, key)
+		}
+
+		event.prev = sse.summaries[key]
+		if event.typ == eventJobRemoved {
+			delete(sse.summaries, key)
+		} else {
+			sse.summaries[key] = event.job
+		}
+	}
+
+	if len(sse.history) == sseReplayBuffer {
+		sse.history = append(sse.history[1:], event)
+	} else {
+		sse.history = append(sse.history, event)
+	}
+
+	for client, query := range sse.clients {
+		if !event.matches(query) {
+			continue
+		}
+
+		select {
+		case client <- event:
+		default:
+			sse.drop(client)
+			metrics.add(sseEvictionsMetric, 1)
+			log.Println("Evicted slow sse client.", len(sse.clients))
+		}
+	}
+}
+
+// drop forgets a client. Closing its queue ends its stream if it's still
+// connected, and it will pick up from the last event it saw when it
+// reconnects.
+func (sse *sse) drop(client chan sseEvent) {
+	delete(sse.clients, client)
+	close(client)
+	metrics.set(sseClientsMetric, float64(len(sse.clients)))
+}
+
+var ssecounter int64
 
 func (sse *sse) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+	query, err := parseJobQuery(params)
+	if err != nil {
+		w.WriteHeader(400)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	// Events aren't a list, so they can't be sorted or paged.
+	for _, param := range []string{"sort", "limit", "cursor"} {
+		if _, ok := params[param]; ok {
+			w.WriteHeader(400)
+			w.Write([]byte(fmt.Sprintf("%s isn't supported for events", param)))
+			return
+		}
+	}
+
+	// Clients get deltas unless they ask for every update in full.
+	format := params.Get("format")
+	if format != "" && format != "delta" && format != "full" {
+		w.WriteHeader(400)
+		w.Write([]byte(fmt.Sprintf("invalid format %q", format)))
+		return
+	}
+	deltas := format != "full"
+
 	w.Header().Add("Content-Type", "text/event-stream")
 	w.Header().Add("Cache-Control", "no-cache")
 	w.Header().Add("Connection", "keep-alive")
 	w.(http.Flusher).Flush()
 
-	ssecounter++
-	id := ssecounter
+	id := atomic.AddInt64(&ssecounter, 1)
 	header := r.Header["User-Agent"]
 
-	events := make(chan []byte)
-	sse.addClient <- events
+	// An invalid ID is treated like a new client.
+	lastID, _ := strconv.ParseUint(r.Header.Get("Last-Event-ID"), 10, 64)
+
+	events := make(chan sseEvent, sseClientBuffer)
+	sse.addClient <- &sseSubscription{events: events, lastID: lastID, query: query}
 
 	defer func() {
 		sse.removeClient <- events
 	}()
 
-	go func() {
-		<-w.(http.CloseNotifier).CloseNotify()
-		sse.removeClient <- events
-		close(events)
-	}()
+	// The ID of the last diffable event this client was sent about each job.
+	seen := make(map[string]uint64)
+
+	heartbeat := time.NewTicker(sseHeartbeatInterval)
+	defer heartbeat.Stop()
 
 	newline := []byte("\n")
 	prefix := []byte("\ndata: ")
-	for event := range events {
-		// When we see a newline we need to add the prefix again.
-		event = bytes.Replace(event, newline, prefix, -1)
-		if _, err := fmt.Fprintf(w, "data: %s\n\n", event); err != nil {
-			log.Println("Error writing to SSE", id, header, err)
-			continue
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(w, ": heartbeat\n\n"); err != nil {
+				return
+			}
+			w.(http.Flusher).Flush()
+		case event, ok := <-events:
+			if !ok {
+				return
+			}
+
+			typ, data := event.typ, event.data
+			if deltas && event.job != nil {
+				key := event.key()
+				if event.delta != nil && event.base != 0 && seen[key] == event.base {
+					typ, data = eventJobDelta, event.delta
+				}
+				if event.diffable {
+					seen[key] = event.id
+				} else {
+					delete(seen, key)
+				}
+			}
+
+			// When we see a newline we need to add the prefix again.
+			data = bytes.Replace(data, newline, prefix, -1)
+			_, err := fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", event.id, typ, data)
+			if err != nil {
+				log.Println("Error writing to SSE", id, header, err)
+				continue
+			}
+			w.(http.Flusher).Flush()
 		}
-		w.(http.Flusher).Flush()
 	}
 }
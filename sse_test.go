@@ -0,0 +1,300 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// stalledWriter is a browser that stops reading: writes block until it's
+// released.
+type stalledWriter struct {
+	header  http.Header
+	writing chan struct{}
+	release chan struct{}
+	once    sync.Once
+	lock    sync.Mutex
+	buf     bytes.Buffer
+}
+
+func newStalledWriter() *stalledWriter {
+	return &stalledWriter{
+		header:  make(http.Header),
+		writing: make(chan struct{}),
+		release: make(chan struct{}),
+	}
+}
+
+func (w *stalledWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *stalledWriter) WriteHeader(int) {}
+
+func (w *stalledWriter) Write(b []byte) (int, error) {
+	w.once.Do(func() { close(w.writing) })
+	<-w.release
+
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return w.buf.Write(b)
+}
+
+func (w *stalledWriter) Flush() {}
+
+func (w *stalledWriter) String() string {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return w.buf.String()
+}
+
+func TestSSESlowClientDoesNotBlockPolling(t *testing.T) {
+	evictions := metricValue(sseEvictionsMetric)
+	s := newSSE()
+	go s.Loop()
+
+	jt := newJobTracker("slow", "", "", nil, nil)
+	go jt.sendUpdates(s)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stalled := newStalledWriter()
+	served := make(chan struct{})
+	go func() {
+		s.ServeHTTP(stalled, httptest.NewRequest("GET", "/sse", nil).WithContext(ctx))
+		close(served)
+	}()
+
+	// Wait until the client is stuck writing its first event.
+	for published := false; !published; {
+		select {
+		case <-stalled.writing:
+			published = true
+		case jt.updates <- trackerEvent{typ: eventJobUpdated, job: &job{Details: jobDetail{ID: "job_1_0000"}}}:
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	// These are the poller goroutines, which have to keep going even though
+	// the client isn't reading.
+	var pollers sync.WaitGroup
+	for p := 0; p < 4; p++ {
+		pollers.Add(1)
+		go func(p int) {
+			defer pollers.Done()
+			for i := 0; i < sseClientBuffer*2; i++ {
+				j := &job{Details: jobDetail{ID: fmt.Sprintf("job_%d_%04d", p, i)}, running: true}
+				jt.updates <- trackerEvent{typ: eventJobUpdated, job: j}
+			}
+		}(p)
+	}
+
+	polled := make(chan struct{})
+	go func() {
+		pollers.Wait()
+		close(polled)
+	}()
+
+	select {
+	case <-polled:
+	case <-time.After(10 * time.Second):
+		require.FailNow(t, "pollers blocked on a stalled SSE client")
+	}
+
+	// The pollers can finish before the broadcast loop gets to the events
+	// that fill the client's queue.
+	for metricValue(sseEvictionsMetric) == evictions {
+		time.Sleep(time.Millisecond)
+	}
+
+	// Once the client catches up on the events queued for it, it should be
+	// disconnected.
+	close(stalled.release)
+	select {
+	case <-served:
+	case <-time.After(10 * time.Second):
+		require.FailNow(t, "evicted SSE client wasn't disconnected")
+	}
+	assert.Equal(t, sseClientBuffer+1, strings.Count(stalled.String(), "\ndata: "))
+}
+
+func TestSSEPublishDoesNotBlock(t *testing.T) {
+	// Nothing is running the broadcast loop, so the buffer fills up.
+	s := newSSE()
+	for i := 0; i < sseEventBuffer; i++ {
+		assert.True(t, s.publish(sseEvent{typ: eventJobUpdated, job: &job{}, data: []byte("{}")}))
+	}
+	assert.False(t, s.publish(sseEvent{typ: eventJobUpdated, job: &job{}, data: []byte("{}")}))
+}
+
+func TestSSEReplay(t *testing.T) {
+	s := newSSE()
+	for i := 0; i < sseReplayBuffer+10; i++ {
+		s.broadcast(sseEvent{data: []byte(fmt.Sprint(i)), job: &job{}})
+	}
+	latest := s.nextID - 1
+
+	// A client that's only missed a few events gets them replayed.
+	sub := &sseSubscription{events: make(chan sseEvent, sseClientBuffer), lastID: latest - 2, query: &jobQuery{}}
+	s.add(sub)
+	require.Len(t, sub.events, 2)
+	assert.Equal(t, sseEvent{id: latest - 1, data: []byte(fmt.Sprint(sseReplayBuffer + 8)), job: &job{}, prev: &job{}}, <-sub.events)
+	assert.Equal(t, sseEvent{id: latest, data: []byte(fmt.Sprint(sseReplayBuffer + 9)), job: &job{}, prev: &job{}}, <-sub.events)
+
+	// New clients, and clients that are up to date, get nothing.
+	for _, lastID := range []uint64{0, latest} {
+		sub := &sseSubscription{events: make(chan sseEvent, sseClientBuffer), lastID: lastID, query: &jobQuery{}}
+		s.add(sub)
+		assert.Len(t, sub.events, 0)
+	}
+
+	// Clients that have missed events we no longer have, or that have IDs
+	// we've never given out, have to resync.
+	for _, lastID := range []uint64{latest - sseReplayBuffer - 1, latest + 100} {
+		sub := &sseSubscription{events: make(chan sseEvent, sseClientBuffer), lastID: lastID, query: &jobQuery{}}
+		s.add(sub)
+		require.Len(t, sub.events, 1)
+		assert.Equal(t, sseEvent{id: latest, typ: eventResync, data: []byte("{}")}, <-sub.events)
+	}
+}
+
+func TestSSEStream(t *testing.T) {
+	sseHeartbeatInterval = 10 * time.Millisecond
+	defer func() { sseHeartbeatInterval = 15 * time.Second }()
+
+	s := newSSE()
+	go s.Loop()
+	server := httptest.NewServer(s)
+	defer server.Close()
+
+	s.broadcast(sseEvent{typ: eventJobUpdated, data: []byte("missed"), job: &job{}})
+	req, err := http.NewRequest("GET", server.URL, nil)
+	require.NoError(t, err)
+	req.Header.Set("Last-Event-ID", fmt.Sprint(s.nextID-2))
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	reader := bufio.NewReader(resp.Body)
+	var lines []string
+	for len(lines) < 5 {
+		line, err := reader.ReadString('\n')
+		require.NoError(t, err)
+		lines = append(lines, line)
+	}
+	assert.Equal(t, []string{fmt.Sprintf("id: %d\n", s.nextID-1), "event: job.updated\n", "data: missed\n", "\n", ": heartbeat\n"}, lines)
+}
+
+func TestSSEFilters(t *testing.T) {
+	s := newSSE()
+	params, err := url.ParseQuery("cluster=a&state=failed&id=application_1_0002")
+	require.NoError(t, err)
+	query, err := parseJobQuery(params)
+	require.NoError(t, err)
+
+	filtered := &sseSubscription{events: make(chan sseEvent, sseClientBuffer), query: query}
+	everything := &sseSubscription{events: make(chan sseEvent, sseClientBuffer), query: &jobQuery{}}
+	s.add(filtered)
+	s.add(everything)
+
+	for _, j := range []*job{
+		{Cluster: "a", Details: jobDetail{ID: "job_1_0001", State: "FAILED"}},
+		{Cluster: "a", Details: jobDetail{ID: "job_1_0002", State: "RUNNING"}},
+		{Cluster: "b", Details: jobDetail{ID: "job_1_0002", State: "FAILED"}},
+		{Cluster: "a", Details: jobDetail{ID: "job_1_0002", State: "FAILED"}},
+	} {
+		s.broadcast(sseEvent{data: []byte(j.Details.ID), job: j})
+	}
+
+	assert.Len(t, everything.events, 4)
+	require.Len(t, filtered.events, 1)
+	event := <-filtered.events
+	assert.Equal(t, "a", event.job.Cluster)
+	assert.Equal(t, "FAILED", event.job.Details.State)
+
+	// Replays are filtered too.
+	replayed := &sseSubscription{events: make(chan sseEvent, sseClientBuffer), lastID: event.id - 3, query: query}
+	s.add(replayed)
+	require.Len(t, replayed.events, 1)
+	assert.Equal(t, event.id, (<-replayed.events).id)
+}
+
+func TestSSEFiltersTransitions(t *testing.T) {
+	s := newSSE()
+	params, err := url.ParseQuery("state=running")
+	require.NoError(t, err)
+	query, err := parseJobQuery(params)
+	require.NoError(t, err)
+
+	running := &sseSubscription{events: make(chan sseEvent, sseClientBuffer), query: query}
+	s.add(running)
+
+	for _, event := range []sseEvent{
+		{typ: eventJobAdded, job: &job{Details: jobDetail{ID: "job_1_0001", State: "RUNNING"}}},
+		{typ: eventJobFinished, job: &job{Details: jobDetail{ID: "job_1_0001", State: "SUCCEEDED"}}},
+		{typ: eventJobUpdated, job: &job{Details: jobDetail{ID: "job_1_0001", State: "SUCCEEDED"}}},
+		{typ: eventJobAdded, job: &job{Details: jobDetail{ID: "job_1_0002", State: "RUNNING"}}},
+		{typ: eventJobRemoved, job: &job{Details: jobDetail{ID: "job_1_0002", State: "RUNNING"}}},
+		{typ: eventJobAdded, job: &job{Details: jobDetail{ID: "job_1_0002", State: "SUCCEEDED"}}},
+	} {
+		s.broadcast(event)
+	}
+
+	var types []string
+	for len(running.events) > 0 {
+		types = append(types, (<-running.events).typ)
+	}
+	assert.Equal(t, []string{eventJobAdded, eventJobFinished, eventJobAdded, eventJobRemoved}, types,
+		"clients should hear about jobs that stop matching, but nothing after that")
+}
+
+func TestSSERejectsPaging(t *testing.T) {
+	s := newSSE()
+	for _, q := range []string{"sort=startTime", "limit=10", "cursor=abc"} {
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, httptest.NewRequest("GET", "/sse?"+q, nil))
+		assert.Equal(t, 400, w.Code, q)
+	}
+}
+
+func TestTypedEvents(t *testing.T) {
+	jt := newJobTracker("typed", "", "", nil, nil)
+	assert.Equal(t, eventJobAdded, jt.saveJob(&job{Details: jobDetail{ID: "job_1_0001"}, running: true}))
+	assert.Equal(t, eventJobUpdated, jt.saveJob(&job{Details: jobDetail{ID: "job_1_0001"}, running: true}))
+	assert.Equal(t, eventJobFinished, jt.saveJob(&job{Details: jobDetail{ID: "job_1_0001", State: "SUCCEEDED"}}))
+	assert.Equal(t, eventJobUpdated, jt.saveJob(&job{Details: jobDetail{ID: "job_1_0001", State: "SUCCEEDED"}}))
+
+	s := newSSE()
+	go jt.sendUpdates(s)
+	jt.updates <- trackerEvent{typ: eventJobRemoved, job: &job{Details: jobDetail{ID: "job_1_0002", State: "RUNNING"}}, reason: removedGone}
+	jt.updates <- trackerEvent{typ: eventClusterStatus, status: &clusterStatus{Cluster: "typed", OK: true, RunningJobs: 1}}
+	jt.updates <- trackerEvent{typ: eventJobsTrimmed, trimmed: []string{"job_1_0001", "job_1_0003"}}
+
+	removed := <-s.events
+	assert.Equal(t, eventJobRemoved, removed.typ)
+	assert.Equal(t, "RUNNING", removed.job.Details.State, "removed jobs should still be filtered by their last state")
+	assert.JSONEq(t, `{"id":"job_1_0002","cluster":"typed","reason":"gone"}`, string(removed.data))
+
+	status := <-s.events
+	assert.Equal(t, eventClusterStatus, status.typ)
+	assert.Nil(t, status.job)
+	assert.JSONEq(t, `{"cluster":"typed","ok":true,"runningJobs":1,"trackedJobs":0,"lastPoll":0}`, string(status.data))
+	assert.True(t, status.matches(&jobQuery{clusters: map[string]bool{"typed": true}}))
+	assert.False(t, status.matches(&jobQuery{clusters: map[string]bool{"other": true}}))
+
+	trimmed := <-s.events
+	assert.Equal(t, eventJobsTrimmed, trimmed.typ)
+	assert.Nil(t, trimmed.job)
+	assert.JSONEq(t, `{"cluster":"typed","ids":["job_1_0001","job_1_0003"]}`, string(trimmed.data))
+}
@@ -3,6 +3,8 @@ package main
 import (
 	"sort"
 	"time"
+
+	"github.com/stripe/timberlake/jhist"
 )
 
 type tasks struct {
@@ -11,11 +13,7 @@ type tasks struct {
 	Errors map[string][]taskAttempt `json:"errors"`
 }
 
-type taskAttempt struct {
-	ID       string `json:"id"`
-	Hostname string `json:"hostname"`
-	Type     string `json:"type"`
-}
+type taskAttempt = jhist.TaskAttempt
 
 type taskListByStartTime [][]int64
 
@@ -0,0 +1,315 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+)
+
+// This is a reader for Hadoop's TFile format, which YARN uses for aggregated
+// container logs. A TFile is a BCFile (block compressed file) whose data
+// blocks hold a sequence of key/value records. The BCFile ends with a fixed
+// size tail:
+//
+//   <offset of the meta index (int64)> <version (2 x int16)> <magic (16 bytes)>
+//
+// The meta index names the "BCFile.index" meta block, which in turn lists the
+// regions of each data block. We only need to read records in order, so the
+// TFile's own key index is ignored.
+
+var bcfileMagic = []byte{
+	0xd1, 0x11, 0xd3, 0x68, 0x91, 0xb5, 0xd7, 0xb6,
+	0x39, 0xdf, 0x41, 0x40, 0x92, 0xba, 0xe1, 0x50,
+}
+
+const (
+	bcfileTailSize       = 8 + 4 + 16
+	bcfileDataIndexBlock = "BCFile.index"
+)
+
+var errCorruptVLong = errors.New("corrupted vlong encoding")
+
+type blockRegion struct {
+	offset         int64
+	compressedSize int64
+	rawSize        int64
+}
+
+type tfile struct {
+	r           io.ReaderAt
+	compression string
+	blocks      []blockRegion
+}
+
+// openTFile reads the block indexes of the TFile represented by r.
+func openTFile(r io.ReaderAt, size int64) (*tfile, error) {
+	if size < bcfileTailSize {
+		return nil, errors.New("file is too short to be a TFile")
+	}
+
+	tail := make([]byte, bcfileTailSize)
+	if _, err := r.ReadAt(tail, size-bcfileTailSize); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(tail[12:], bcfileMagic) {
+		return nil, errors.New("invalid BCFile magic")
+	}
+
+	metaIndexOffset := int64(binary.BigEndian.Uint64(tail[:8]))
+	if metaIndexOffset < 0 || metaIndexOffset >= size {
+		return nil, fmt.Errorf("invalid meta index offset %d", metaIndexOffset)
+	}
+
+	metaIndex := bufio.NewReader(io.NewSectionReader(r, metaIndexOffset, size-bcfileTailSize-metaIndexOffset))
+	count, err := readVLong(metaIndex)
+	if err != nil {
+		return nil, err
+	}
+
+	var dataIndex *blockRegion
+	var dataIndexCompression string
+	for i := int64(0); i < count; i++ {
+		name, err := readTFileString(metaIndex)
+		if err != nil {
+			return nil, err
+		}
+		compression, err := readTFileString(metaIndex)
+		if err != nil {
+			return nil, err
+		}
+		region, err := readBlockRegion(metaIndex)
+		if err != nil {
+			return nil, err
+		}
+
+		if name == "data:"+bcfileDataIndexBlock {
+			dataIndex = &region
+			dataIndexCompression = compression
+		}
+	}
+
+	if dataIndex == nil {
+		return nil, errors.New("no data index in BCFile")
+	}
+
+	t := &tfile{r: r}
+	block, err := t.openBlock(*dataIndex, dataIndexCompression)
+	if err != nil {
+		return nil, err
+	}
+	defer block.Close()
+
+	index := bufio.NewReader(block)
+	if t.compression, err = readTFileString(index); err != nil {
+		return nil, err
+	}
+	blocks, err := readVLong(index)
+	if err != nil {
+		return nil, err
+	}
+	for i := int64(0); i < blocks; i++ {
+		region, err := readBlockRegion(index)
+		if err != nil {
+			return nil, err
+		}
+		t.blocks = append(t.blocks, region)
+	}
+
+	return t, nil
+}
+
+// openBlock returns a reader over the uncompressed contents of a block.
+func (t *tfile) openBlock(region blockRegion, compression string) (io.ReadCloser, error) {
+	section := io.NewSectionReader(t.r, region.offset, region.compressedSize)
+	switch compression {
+	case "none":
+		return ioutil.NopCloser(section), nil
+	case "gz":
+		// Despite the name, this is Hadoop's DefaultCodec, which is zlib.
+		return zlib.NewReader(section)
+	default:
+		return nil, fmt.Errorf("unsupported TFile compression %q", compression)
+	}
+}
+
+// scan calls fn with each record in the TFile, in order. The value reader is
+// only valid until fn returns, and any of it left unread is skipped.
+func (t *tfile) scan(fn func(key []byte, value io.Reader) error) error {
+	for _, region := range t.blocks {
+		block, err := t.openBlock(region, t.compression)
+		if err != nil {
+			return err
+		}
+
+		err = scanBlock(bufio.NewReader(block), fn)
+		block.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func scanBlock(block *bufio.Reader, fn func(key []byte, value io.Reader) error) error {
+	for {
+		if _, err := block.Peek(1); err == io.EOF {
+			return nil
+		}
+
+		keyLength, err := readVLong(block)
+		if err != nil {
+			return err
+		}
+		key := make([]byte, keyLength)
+		if _, err := io.ReadFull(block, key); err != nil {
+			return err
+		}
+
+		value := &tfileValue{r: block}
+		if err := fn(key, value); err != nil {
+			return err
+		}
+		if _, err := io.Copy(ioutil.Discard, value); err != nil {
+			return err
+		}
+	}
+}
+
+// tfileValue reads a value written as a series of chunks. Each chunk is
+// prefixed by its length, which is negated for every chunk but the last.
+type tfileValue struct {
+	r         *bufio.Reader
+	remaining int64
+	last      bool
+	started   bool
+}
+
+func (v *tfileValue) Read(b []byte) (int, error) {
+	for v.remaining == 0 {
+		if v.started && v.last {
+			return 0, io.EOF
+		}
+
+		length, err := readVLong(v.r)
+		if err != nil {
+			return 0, err
+		}
+		v.started = true
+		v.last = length >= 0
+		if length < 0 {
+			length = -length
+		}
+		v.remaining = length
+	}
+
+	if int64(len(b)) > v.remaining {
+		b = b[:v.remaining]
+	}
+	n, err := v.r.Read(b)
+	v.remaining -= int64(n)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+func readBlockRegion(r io.ByteReader) (blockRegion, error) {
+	var region blockRegion
+	var err error
+	if region.offset, err = readVLong(r); err != nil {
+		return region, err
+	}
+	if region.compressedSize, err = readVLong(r); err != nil {
+		return region, err
+	}
+	region.rawSize, err = readVLong(r)
+	return region, err
+}
+
+type byteReader interface {
+	io.Reader
+	io.ByteReader
+}
+
+// readTFileString reads a string prefixed by its vint encoded length.
+func readTFileString(r byteReader) (string, error) {
+	length, err := readVLong(r)
+	if err != nil {
+		return "", err
+	}
+	if length == -1 {
+		return "", nil
+	}
+	if length < 0 {
+		return "", fmt.Errorf("invalid string length %d", length)
+	}
+
+	b := make([]byte, length)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// readVLong decodes the variable length integers used by TFile, which are not
+// the same as the ones in Hadoop's WritableUtils. Small values are stored in
+// the first byte directly; otherwise the first byte determines how many more
+// bytes follow and holds the high bits of the value.
+func readVLong(r io.ByteReader) (int64, error) {
+	b, err := r.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+
+	first := int64(int8(b))
+	if first >= -32 {
+		return first, nil
+	}
+
+	switch (first + 128) / 8 {
+	case 11, 10, 9, 8, 7:
+		rest, err := readBigEndian(r, 1)
+		return (first+52)<<8 | rest, err
+	case 6, 5, 4, 3:
+		rest, err := readBigEndian(r, 2)
+		return (first+88)<<16 | rest, err
+	case 2, 1:
+		rest, err := readBigEndian(r, 3)
+		return (first+112)<<24 | rest, err
+	}
+
+	length := int(first + 129)
+	if length < 4 || length > 8 {
+		return 0, errCorruptVLong
+	}
+
+	rest, err := readBigEndian(r, length)
+	if err != nil {
+		return 0, err
+	}
+
+	// Sign extend the value from its encoded length.
+	shift := uint(64 - 8*length)
+	return rest << shift >> shift, nil
+}
+
+func readBigEndian(r io.ByteReader, n int) (int64, error) {
+	var v int64
+	for i := 0; i < n; i++ {
+		b, err := r.ReadByte()
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return 0, err
+		}
+		v = v<<8 | int64(b)
+	}
+	return v, nil
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writeVLong encodes n the same way as TFile's Utils.writeVLong.
+func writeVLong(buf *bytes.Buffer, n int64) {
+	if n < 128 && n >= -32 {
+		buf.WriteByte(byte(n))
+		return
+	}
+
+	un := n
+	if n < 0 {
+		un = ^n
+	}
+	length := 1
+	for un>>uint(length*8-1) != 0 {
+		length++
+	}
+	first := n >> uint((length-1)*8)
+
+	// Smaller values borrow bits from the first byte, like the fallthrough
+	// cases in the java implementation.
+	if length == 1 {
+		first >>= 8
+		length = 2
+	}
+	if length == 2 {
+		if first < 20 && first >= -20 {
+			buf.Write([]byte{byte(first - 52), byte(n)})
+			return
+		}
+		first >>= 8
+		length = 3
+	}
+	if length == 3 {
+		if first < 16 && first >= -16 {
+			buf.Write([]byte{byte(first - 88), byte(n >> 8), byte(n)})
+			return
+		}
+		first >>= 8
+		length = 4
+	}
+	if length == 4 && first < 8 && first >= -8 {
+		buf.Write([]byte{byte(first - 112), byte(n >> 16), byte(n >> 8), byte(n)})
+		return
+	}
+
+	buf.WriteByte(byte(length - 129))
+	for i := length - 1; i >= 0; i-- {
+		buf.WriteByte(byte(n >> uint(8*i)))
+	}
+}
+
+func writeTFileString(buf *bytes.Buffer, s string) {
+	writeVLong(buf, int64(len(s)))
+	buf.WriteString(s)
+}
+
+func writeUTF(buf *bytes.Buffer, s string) {
+	binary.Write(buf, binary.BigEndian, uint16(len(s)))
+	buf.WriteString(s)
+}
+
+type testLogRecord struct {
+	container string
+	logs      [][2]string
+}
+
+// buildAggregatedLogs writes an aggregated log file holding the given
+// containers, with one data block per container.
+func buildAggregatedLogs(compression string, records []testLogRecord) []byte {
+	file := &bytes.Buffer{}
+	var regions [][3]int64
+
+	for _, record := range records {
+		block := &bytes.Buffer{}
+
+		key := &bytes.Buffer{}
+		writeUTF(key, "VERSION")
+		writeVLong(block, int64(key.Len()))
+		block.Write(key.Bytes())
+		writeVLong(block, 4)
+		block.Write([]byte{0, 0, 0, 1})
+
+		key.Reset()
+		writeUTF(key, record.container)
+		writeVLong(block, int64(key.Len()))
+		block.Write(key.Bytes())
+
+		value := &bytes.Buffer{}
+		for _, l := range record.logs {
+			writeUTF(value, l[0])
+			writeUTF(value, strconv.Itoa(len(l[1])))
+			value.WriteString(l[1])
+		}
+
+		// Split the value into two chunks to exercise chunked values.
+		half := value.Len() / 2
+		writeVLong(block, -int64(half))
+		block.Write(value.Bytes()[:half])
+		writeVLong(block, int64(value.Len()-half))
+		block.Write(value.Bytes()[half:])
+
+		raw := block.Len()
+		if compression == "gz" {
+			compressed := &bytes.Buffer{}
+			w := zlib.NewWriter(compressed)
+			w.Write(block.Bytes())
+			w.Close()
+			block = compressed
+		}
+
+		regions = append(regions, [3]int64{int64(file.Len()), int64(block.Len()), int64(raw)})
+		file.Write(block.Bytes())
+	}
+
+	dataIndex := &bytes.Buffer{}
+	writeTFileString(dataIndex, compression)
+	writeVLong(dataIndex, int64(len(regions)))
+	for _, region := range regions {
+		writeVLong(dataIndex, region[0])
+		writeVLong(dataIndex, region[1])
+		writeVLong(dataIndex, region[2])
+	}
+	dataIndexOffset := file.Len()
+	file.Write(dataIndex.Bytes())
+
+	metaIndexOffset := file.Len()
+	writeVLong(file, 1)
+	writeTFileString(file, "data:BCFile.index")
+	writeTFileString(file, "none")
+	writeVLong(file, int64(dataIndexOffset))
+	writeVLong(file, int64(dataIndex.Len()))
+	writeVLong(file, int64(dataIndex.Len()))
+
+	binary.Write(file, binary.BigEndian, int64(metaIndexOffset))
+	binary.Write(file, binary.BigEndian, []int16{1, 0})
+	file.Write(bcfileMagic)
+
+	return file.Bytes()
+}
+
+func TestVLongRoundTrip(t *testing.T) {
+	values := []int64{0, 1, -1, -32, -33, 127, 128, 5000, -5000, 1 << 20, -(1 << 20), 1 << 27,
+		1 << 31, -(1 << 31), 1 << 40, 1<<62 + 7, -(1 << 62)}
+	for _, v := range values {
+		buf := &bytes.Buffer{}
+		writeVLong(buf, v)
+		decoded, err := readVLong(buf)
+		require.NoError(t, err, "decoding %d should work", v)
+		assert.Equal(t, v, decoded, "%d should round trip", v)
+		assert.Equal(t, 0, buf.Len(), "decoding %d should consume all its bytes", v)
+	}
+}
+
+func TestReadAggregatedLogs(t *testing.T) {
+	records := []testLogRecord{
+		{"container_1_0001_01_000001", [][2]string{{"stderr", "oh no"}, {"stdout", ""}, {"syslog", "INFO starting\nINFO done\n"}}},
+		{"container_1_0001_01_000002", [][2]string{{"stderr", "Exception in thread main"}}},
+	}
+
+	for _, compression := range []string{"none", "gz"} {
+		data := buildAggregatedLogs(compression, records)
+
+		logs := make(map[string]map[string]string)
+		err := readAggregatedLogs(bytes.NewReader(data), int64(len(data)), func(container string, r io.Reader) error {
+			logs[container] = make(map[string]string)
+			return readContainerLogs(r, func(logType string, length int64, body io.Reader) error {
+				b, err := ioutil.ReadAll(body)
+				assert.Equal(t, length, int64(len(b)), "the log length should be correct")
+				logs[container][logType] = string(b)
+				return err
+			})
+		})
+		require.NoError(t, err, "reading %s aggregated logs should work", compression)
+
+		assert.Equal(t, 2, len(logs), "all containers should be read, and VERSION skipped")
+		assert.Equal(t, "oh no", logs["container_1_0001_01_000001"]["stderr"], "stderr should be read")
+		assert.Equal(t, "", logs["container_1_0001_01_000001"]["stdout"], "empty logs should be read")
+		assert.Equal(t, "INFO starting\nINFO done\n", logs["container_1_0001_01_000001"]["syslog"], "syslog should be read")
+		assert.Equal(t, "Exception in thread main", logs["container_1_0001_01_000002"]["stderr"], "the second block should be read")
+	}
+}
+
+func TestReadLogRange(t *testing.T) {
+	body := "0123456789"
+
+	f, err := readLogRange("stdout", 10, strings.NewReader(body), logRange{offset: 2, limit: 3})
+	require.NoError(t, err)
+	assert.Equal(t, logFile{Type: "stdout", Length: 10, Offset: 2, Data: "234"}, f, "a range should be read from the start")
+
+	f, err = readLogRange("stdout", 10, strings.NewReader(body), logRange{offset: -4})
+	require.NoError(t, err)
+	assert.Equal(t, logFile{Type: "stdout", Length: 10, Offset: 6, Data: "6789"}, f, "a negative offset should tail the log")
+
+	f, err = readLogRange("stdout", 10, strings.NewReader(body), logRange{offset: 20})
+	require.NoError(t, err)
+	assert.Equal(t, "", f.Data, "reading past the end should return nothing")
+}
+
+func TestOpenTFileRejectsOtherFormats(t *testing.T) {
+	data := []byte("this is definitely not a TFile, but it is long enough")
+	_, err := openTFile(bytes.NewReader(data), int64(len(data)))
+	assert.Error(t, err, "files without the BCFile magic should be rejected")
+}